@@ -0,0 +1,3 @@
+// Package customhandler provides the Azure Functions custom handler request and response model
+// for Cosmos DB triggered functions.
+package customhandler
@@ -0,0 +1,84 @@
+package customhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFunctionTimeout is the function timeout the host applies when host.json does not set one
+// (the default of the Consumption plan).
+const DefaultFunctionTimeout = 5 * time.Minute
+
+// HostFilePath returns the path of the host.json file of the function app. The host starts custom handlers
+// in the root directory of the app; AzureWebJobsScriptRoot is used when it is set.
+func HostFilePath() string {
+	return filepath.Join(os.Getenv("AzureWebJobsScriptRoot"), "host.json")
+}
+
+// FunctionTimeout reads the functionTimeout setting of the host.json file at path.
+// It returns DefaultFunctionTimeout if the setting is missing, and 0 if the timeout is unlimited ("-1").
+func FunctionTimeout(path string) (time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var host struct {
+		FunctionTimeout *string `json:"functionTimeout"`
+	}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+
+	if host.FunctionTimeout == nil {
+		return DefaultFunctionTimeout, nil
+	}
+	return ParseTimeSpan(*host.FunctionTimeout)
+}
+
+// ParseTimeSpan parses a .NET TimeSpan as used by host.json, e.g. "00:05:00" or "1.02:00:00" (with days).
+// The value "-1" means no timeout and is returned as 0.
+func ParseTimeSpan(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "-1" {
+		return 0, nil
+	}
+
+	invalid := fmt.Errorf("invalid time span %q: expected [d.]hh:mm:ss[.fff]", value)
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, invalid
+	}
+
+	var days int
+	hours := parts[0]
+	if d, h, found := strings.Cut(parts[0], "."); found {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 {
+			return 0, invalid
+		}
+		days, hours = n, h
+	}
+
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 23 {
+		return 0, invalid
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, invalid
+	}
+	s, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || s < 0 || s >= 60 {
+		return 0, invalid
+	}
+
+	return time.Duration(days)*24*time.Hour + time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s*float64(time.Second)), nil
+}
@@ -0,0 +1,54 @@
+package customhandler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeSpan(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"00:05:00", 5 * time.Minute},
+		{"01:30:15", time.Hour + 30*time.Minute + 15*time.Second},
+		{"00:00:01.5", 1500 * time.Millisecond},
+		{"1.02:00:00", 26 * time.Hour},
+		{"-1", 0},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTimeSpan(tt.value)
+		require.NoError(t, err, "failed to parse %q", tt.value)
+		assert.Equal(t, tt.want, got, "unexpected duration for %q", tt.value)
+	}
+
+	for _, value := range []string{"", "5m", "00:60:00", "24:00:00", "x.01:00:00", "00:05"} {
+		_, err := ParseTimeSpan(value)
+		assert.Error(t, err, "expected %q to be rejected", value)
+	}
+}
+
+func TestFunctionTimeout(t *testing.T) {
+	dir := t.TempDir()
+
+	withTimeout := filepath.Join(dir, "with.json")
+	require.NoError(t, os.WriteFile(withTimeout, []byte(`{"version": "2.0", "functionTimeout": "00:10:00"}`), 0o600))
+	timeout, err := FunctionTimeout(withTimeout)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, timeout, "expected the configured timeout")
+
+	withoutTimeout := filepath.Join(dir, "without.json")
+	require.NoError(t, os.WriteFile(withoutTimeout, []byte(`{"version": "2.0"}`), 0o600))
+	timeout, err = FunctionTimeout(withoutTimeout)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultFunctionTimeout, timeout, "expected the default timeout")
+
+	_, err = FunctionTimeout(filepath.Join(dir, "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "expected an error for a missing file")
+}
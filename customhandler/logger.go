@@ -0,0 +1,138 @@
+package customhandler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of an invocation log line.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level as it appears in the log lines.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// ParseLevel converts a level name (case insensitive) into a Level.
+// An empty name is interpreted as LevelInfo.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DEBUG":
+		return LevelDebug, nil
+	case "", "INFO":
+		return LevelInfo, nil
+	case "WARN", "WARNING":
+		return LevelWarn, nil
+	case "ERROR":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Logger collects the log lines of a single function invocation, which are returned to the
+// Functions host in InvokeResponse.Logs. It is safe for concurrent use.
+type Logger struct {
+	mu      sync.Mutex
+	level   Level
+	discard bool
+	lines   []string
+}
+
+// NewLogger creates a Logger that keeps the lines logged at the given level or above.
+func NewLogger(level Level) *Logger {
+	return &Logger{level: level, lines: []string{}}
+}
+
+// Logf adds a line with the given level to the invocation logs.
+func (l *Logger) Logf(level Level, format string, args ...any) {
+	if l.discard || level < l.level {
+		return
+	}
+
+	line := fmt.Sprintf("[%s] %s", level, fmt.Sprintf(format, args...))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+// Debugf adds a debug line to the invocation logs.
+func (l *Logger) Debugf(format string, args ...any) { l.Logf(LevelDebug, format, args...) }
+
+// Infof adds an informational line to the invocation logs.
+func (l *Logger) Infof(format string, args ...any) { l.Logf(LevelInfo, format, args...) }
+
+// Warnf adds a warning line to the invocation logs.
+func (l *Logger) Warnf(format string, args ...any) { l.Logf(LevelWarn, format, args...) }
+
+// Errorf adds an error line to the invocation logs.
+func (l *Logger) Errorf(format string, args ...any) { l.Logf(LevelError, format, args...) }
+
+// Lines returns a copy of the lines logged so far.
+func (l *Logger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lines := make([]string, len(l.lines))
+	copy(lines, l.lines)
+	return lines
+}
+
+// Child returns a logger with the same level whose lines are kept apart until they are added with Flush.
+// It lets concurrent work log without interleaving its lines with the lines of other work.
+func (l *Logger) Child() *Logger {
+	return &Logger{level: l.level, discard: l.discard, lines: []string{}}
+}
+
+// Flush moves the lines logged by child, in order, to l.
+func (l *Logger) Flush(child *Logger) {
+	child.mu.Lock()
+	lines := child.lines
+	child.lines = []string{}
+	child.mu.Unlock()
+
+	if l.discard || len(lines) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, lines...)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries the invocation logger.
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the invocation logger carried by ctx.
+// If ctx has no logger, a logger that discards every line is returned, so callers never have to check for nil.
+func LoggerFromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok && logger != nil {
+		return logger
+	}
+	return &Logger{discard: true}
+}
@@ -0,0 +1,86 @@
+package customhandler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	logger := NewLogger(LevelInfo)
+
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+
+	assert.Equal(t, []string{"[INFO] info 2", "[WARN] warn 3", "[ERROR] error 4"}, logger.Lines(), "expected debug line to be dropped")
+}
+
+func TestLoggerConcurrentInvocations(t *testing.T) {
+	first := NewLogger(LevelDebug)
+	second := NewLogger(LevelDebug)
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			LoggerFromContext(WithLogger(context.Background(), first)).Infof("first %d", i)
+		}()
+		go func() {
+			defer wg.Done()
+			LoggerFromContext(WithLogger(context.Background(), second)).Infof("second %d", i)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, first.Lines(), 100, "expected all lines of the first invocation")
+	assert.Len(t, second.Lines(), 100, "expected all lines of the second invocation")
+	for i := range 100 {
+		assert.Contains(t, first.Lines(), fmt.Sprintf("[INFO] first %d", i), "expected line in first invocation")
+		assert.NotContains(t, second.Lines(), fmt.Sprintf("[INFO] first %d", i), "expected line not to leak into second invocation")
+	}
+}
+
+func TestLoggerChildFlush(t *testing.T) {
+	logger := NewLogger(LevelInfo)
+	children := []*Logger{logger.Child(), logger.Child()}
+
+	children[1].Infof("second document")
+	children[0].Debugf("dropped")
+	children[0].Warnf("first document")
+	logger.Infof("invocation")
+
+	for _, child := range children {
+		logger.Flush(child)
+	}
+	logger.Flush(children[0])
+
+	assert.Equal(t, []string{"[INFO] invocation", "[WARN] first document", "[INFO] second document"}, logger.Lines(),
+		"expected the child lines in flush order, and only once")
+	assert.Empty(t, children[0].Lines(), "expected flushed lines to be removed from the child")
+}
+
+func TestLoggerFromContextWithoutLogger(t *testing.T) {
+	logger := LoggerFromContext(context.Background())
+	logger.Errorf("dropped")
+
+	assert.Empty(t, logger.Lines(), "expected lines to be discarded")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("warning")
+	assert.NoError(t, err, "ParseLevel returned an error")
+	assert.Equal(t, LevelWarn, level, "expected warn level")
+
+	level, err = ParseLevel("")
+	assert.NoError(t, err, "ParseLevel returned an error")
+	assert.Equal(t, LevelInfo, level, "expected info level by default")
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err, "expected an error for an unknown level")
+}
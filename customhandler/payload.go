@@ -0,0 +1,40 @@
+package customhandler
+
+import "encoding/json"
+
+// InvokeRequest represents the generic structure of the request sent by the Functions host to a custom handler.
+// The keys of Data are the names of the input bindings, the keys of Metadata are trigger specific.
+type InvokeRequest struct {
+	Data     map[string]json.RawMessage `json:"Data"`
+	Metadata map[string]json.RawMessage `json:"Metadata"`
+}
+
+// Data represents the data field in the Cosmos DB trigger payload.
+type Data struct {
+	Documents string `json:"documents"`
+}
+
+// SysMetadata represents the system metadata the Functions host adds to every invocation.
+type SysMetadata struct {
+	MethodName string `json:"MethodName"`
+	UtcNow     string `json:"UtcNow"`
+	RandGuid   string `json:"RandGuid"`
+}
+
+// Metadata represents the metadata field in the Cosmos DB trigger payload.
+type Metadata struct {
+	Sys SysMetadata `json:"sys"`
+}
+
+// CosmosDBTriggerPayload represents the structure of the Cosmos DB trigger payload.
+type CosmosDBTriggerPayload struct {
+	Data     Data     `json:"Data"`
+	Metadata Metadata `json:"Metadata"`
+}
+
+// InvokeResponse represents the structure of the response returned by the handler.
+type InvokeResponse struct {
+	Outputs     map[string]any `json:"outputs"`
+	Logs        []string       `json:"logs"`
+	ReturnValue any            `json:"returnValue,omitempty"`
+}
@@ -0,0 +1,4 @@
+package customhandler
+
+// Version is the version of this module. It matches the customhandler/vX.Y.Z tag the module is released under.
+const Version = "0.3.0"
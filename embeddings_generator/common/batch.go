@@ -0,0 +1,85 @@
+package common
+
+import "time"
+
+const (
+	defaultBatchMaxInputs   = 256
+	defaultBatchMaxTokens   = 100000
+	defaultBatchConcurrency = 4
+)
+
+// BatchOptions limits the size of the embedding requests sent for a batch of inputs.
+type BatchOptions struct {
+	// MaxInputs is the maximum number of inputs sent in one request.
+	MaxInputs int `json:"maxInputs"`
+	// MaxTokens is the maximum (estimated) number of tokens of all inputs sent in one request.
+	MaxTokens int `json:"maxTokens"`
+	// Timeout limits the time spent on each request, including its retries. Zero leaves it to the context.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Concurrency is the maximum number of requests sent at the same time.
+	Concurrency int `json:"concurrency"`
+}
+
+// DefaultBatchOptions returns batch options that stay well within the Azure OpenAI request limits.
+func DefaultBatchOptions() BatchOptions {
+	return BatchOptions{
+		MaxInputs:   defaultBatchMaxInputs,
+		MaxTokens:   defaultBatchMaxTokens,
+		Concurrency: defaultBatchConcurrency,
+	}
+}
+
+// LoadEnv overrides the options with the EMBEDDING_BATCH_MAX_INPUTS, EMBEDDING_BATCH_MAX_TOKENS,
+// EMBEDDING_BATCH_TIMEOUT and EMBEDDING_BATCH_CONCURRENCY environment variables that are set.
+func (o *BatchOptions) LoadEnv() error {
+	var err error
+	if o.MaxInputs, err = IntFromEnv("EMBEDDING_BATCH_MAX_INPUTS", o.MaxInputs); err != nil {
+		return err
+	}
+	if o.MaxTokens, err = IntFromEnv("EMBEDDING_BATCH_MAX_TOKENS", o.MaxTokens); err != nil {
+		return err
+	}
+	if o.Concurrency, err = IntFromEnv("EMBEDDING_BATCH_CONCURRENCY", o.Concurrency); err != nil {
+		return err
+	}
+	timeout, err := DurationFromEnv("EMBEDDING_BATCH_TIMEOUT", time.Duration(o.Timeout))
+	if err != nil {
+		return err
+	}
+	o.Timeout = Duration(timeout)
+
+	return nil
+}
+
+// split groups the indices of the inputs into batches that respect the options.
+// An input that exceeds MaxTokens on its own is sent in a batch of its own.
+func (o BatchOptions) split(inputs []string) [][]int {
+	var batches [][]int
+	var current []int
+	currentTokens := 0
+
+	for i, input := range inputs {
+		tokens := EstimateTokens(input)
+
+		full := len(current) > 0 &&
+			((o.MaxInputs > 0 && len(current) >= o.MaxInputs) || (o.MaxTokens > 0 && currentTokens+tokens > o.MaxTokens))
+		if full {
+			batches = append(batches, current)
+			current, currentTokens = nil, 0
+		}
+
+		current = append(current, i)
+		currentTokens += tokens
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// EstimateTokens returns a rough estimate of the number of tokens in a text, assuming about four bytes per token.
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
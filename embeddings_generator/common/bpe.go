@@ -0,0 +1,240 @@
+package common
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bpeTokenizer is a byte pair encoding tokenizer compatible with the cl100k_base encoding of the
+// OpenAI embedding models: the text is split into pieces like the cl100k_base pattern does, and each
+// piece is encoded by repeatedly merging the adjacent byte sequences with the lowest rank.
+type bpeTokenizer struct {
+	ranks map[string]int
+}
+
+// LoadBPETokenizer creates a Tokenizer from a tiktoken ranks file, e.g. cl100k_base.tiktoken, in which
+// each line holds a base64 encoded token and its rank. The file is read from disk; nothing is downloaded.
+func LoadBPETokenizer(path string) (Tokenizer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranks, err := readRanks(file, path)
+	if err != nil {
+		return nil, err
+	}
+	return &bpeTokenizer{ranks: ranks}, nil
+}
+
+// readRanks reads the ranks of a tiktoken ranks file; name identifies the file in errors.
+func readRanks(r io.Reader, name string) (map[string]int, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		encoded, rank, found := strings.Cut(text, " ")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected a token and a rank", name, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid token: %w", name, line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid rank: %w", name, line, err)
+		}
+		ranks[string(token)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("%s contains no tokens", name)
+	}
+	return ranks, nil
+}
+
+// NewBPETokenizer creates a Tokenizer from the ranks of its tokens.
+func NewBPETokenizer(ranks map[string]int) Tokenizer {
+	return &bpeTokenizer{ranks: ranks}
+}
+
+// Split splits text into its tokens. A token that ends inside a multi-byte character is joined with
+// the tokens that follow it, so that every piece is valid UTF-8; such pieces hold more than one token.
+func (t *bpeTokenizer) Split(text string) []string {
+	var pieces []string
+
+	start := 0
+	for _, end := range t.boundaries(text) {
+		if end < len(text) && !utf8.RuneStart(text[end]) {
+			continue
+		}
+		pieces = append(pieces, text[start:end])
+		start = end
+	}
+
+	return pieces
+}
+
+// Count returns the number of tokens in text.
+func (t *bpeTokenizer) Count(text string) int {
+	return len(t.boundaries(text))
+}
+
+// boundaries returns the byte offsets at which the tokens of text end.
+func (t *bpeTokenizer) boundaries(text string) []int {
+	var ends []int
+
+	offset := 0
+	for _, piece := range cl100kPieces(text) {
+		for _, end := range t.encode(piece) {
+			ends = append(ends, offset+end)
+		}
+		offset += len(piece)
+	}
+
+	return ends
+}
+
+// encode returns the offsets at which the tokens of a piece end.
+func (t *bpeTokenizer) encode(piece string) []int {
+	if _, ok := t.ranks[piece]; ok {
+		return []int{len(piece)}
+	}
+
+	// ends[i] is the end offset of the i-th part; the parts start out as single bytes
+	ends := make([]int, len(piece))
+	for i := range ends {
+		ends[i] = i + 1
+	}
+
+	for len(ends) > 1 {
+		best, bestRank := -1, 0
+		start := 0
+		for i := 0; i < len(ends)-1; i++ {
+			if rank, ok := t.ranks[piece[start:ends[i+1]]]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+			start = ends[i]
+		}
+		if best < 0 {
+			break
+		}
+
+		// Merge part best with the part that follows it
+		ends = append(ends[:best], ends[best+1:]...)
+	}
+
+	return ends
+}
+
+// cl100kPieces splits text like the pre-tokenization pattern of cl100k_base:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// The pattern is implemented by hand, because Go regular expressions do not support the lookahead.
+func cl100kPieces(text string) []string {
+	var pieces []string
+
+	for start := 0; start < len(text); {
+		end := start + cl100kMatch(text[start:])
+		pieces = append(pieces, text[start:end])
+		start = end
+	}
+
+	return pieces
+}
+
+// cl100kMatch returns the length of the pattern match at the start of text, which is never empty.
+func cl100kMatch(text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+
+	// (?i:'s|'t|'re|'ve|'m|'ll|'d)
+	if r == '\'' {
+		rest := strings.ToLower(text[size:min(len(text), size+2)])
+		for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if strings.HasPrefix(rest, suffix) {
+				return size + len(suffix)
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if unicode.IsLetter(r) {
+		return size + runLength(text[size:], unicode.IsLetter, -1)
+	}
+	if r != '\r' && r != '\n' && !unicode.IsNumber(r) {
+		if letters := runLength(text[size:], unicode.IsLetter, -1); letters > 0 {
+			return size + letters
+		}
+	}
+
+	// \p{N}{1,3}
+	if unicode.IsNumber(r) {
+		return size + runLength(text[size:], unicode.IsNumber, 2)
+	}
+
+	// ?[^\s\p{L}\p{N}]+[\r\n]*
+	prefix := 0
+	if r == ' ' {
+		prefix = size
+	}
+	if symbols := runLength(text[prefix:], isSymbol, -1); symbols > 0 {
+		end := prefix + symbols
+		return end + runLength(text[end:], isNewline, -1)
+	}
+
+	// \s*[\r\n]+
+	spaces := runLength(text, unicode.IsSpace, -1)
+	if last := strings.LastIndexAny(text[:spaces], "\r\n"); last >= 0 {
+		return last + 1
+	}
+
+	// \s+(?!\S)
+	if spaces == len(text) {
+		return spaces
+	}
+	_, lastSize := utf8.DecodeLastRuneInString(text[:spaces])
+	if spaces > lastSize {
+		return spaces - lastSize
+	}
+
+	// \s+ (or a single character the pattern does not cover, e.g. invalid UTF-8)
+	return max(spaces, size)
+}
+
+// runLength returns the length in bytes of the longest prefix of text whose characters satisfy f,
+// and that has at most limit characters if limit is not negative.
+func runLength(text string, f func(rune) bool, limit int) int {
+	n := 0
+	for count := 0; n < len(text) && count != limit; count++ {
+		r, size := utf8.DecodeRuneInString(text[n:])
+		if !f(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
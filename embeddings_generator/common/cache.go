@@ -0,0 +1,436 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+	"github.com/redis/go-redis/v9"
+)
+
+// Embedding cache backends.
+const (
+	// CacheBackendNone keeps the cached embeddings in memory only.
+	CacheBackendNone = "none"
+	// CacheBackendDisk stores the cached embeddings as files in a directory.
+	CacheBackendDisk = "disk"
+	// CacheBackendRedis stores the cached embeddings in Redis, or a server compatible with it.
+	CacheBackendRedis = "redis"
+)
+
+const defaultCacheSize = 1000
+
+// CacheOptions configures the embedding cache, which keeps the embeddings of texts by model, dimensions
+// and SHA-256 hash of the text, so that identical texts are only embedded once.
+type CacheOptions struct {
+	// Size is the number of embeddings kept in memory, the least recently used are evicted first.
+	// Zero disables the cache.
+	Size int `json:"size"`
+	// Backend is CacheBackendNone (default), CacheBackendDisk or CacheBackendRedis. It is consulted for
+	// the embeddings that are not in memory, and outlives the process.
+	Backend string `json:"backend,omitempty"`
+	// Directory holds the files of CacheBackendDisk.
+	Directory string `json:"directory,omitempty"`
+	// RedisAddress (host:port), RedisPassword and RedisDB select the server of CacheBackendRedis.
+	RedisAddress  string `json:"redisAddress,omitempty"`
+	RedisPassword string `json:"redisPassword,omitempty"`
+	RedisDB       int    `json:"redisDB,omitempty"`
+	// TTL is how long CacheBackendRedis keeps an embedding. Zero keeps it until Redis evicts it.
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+// DefaultCacheOptions returns an in-memory cache of 1000 embeddings.
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{Size: defaultCacheSize}
+}
+
+// LoadEnv overrides the options with the EMBEDDING_CACHE_SIZE, EMBEDDING_CACHE_BACKEND, EMBEDDING_CACHE_DIR,
+// EMBEDDING_CACHE_REDIS_ADDRESS, EMBEDDING_CACHE_REDIS_PASSWORD, EMBEDDING_CACHE_REDIS_DB and EMBEDDING_CACHE_TTL
+// environment variables that are set.
+func (o *CacheOptions) LoadEnv() error {
+	o.Backend = strings.ToLower(StringFromEnv("EMBEDDING_CACHE_BACKEND", o.Backend))
+	o.Directory = StringFromEnv("EMBEDDING_CACHE_DIR", o.Directory)
+	o.RedisAddress = StringFromEnv("EMBEDDING_CACHE_REDIS_ADDRESS", o.RedisAddress)
+	o.RedisPassword = StringFromEnv("EMBEDDING_CACHE_REDIS_PASSWORD", o.RedisPassword)
+
+	var err error
+	if o.Size, err = IntFromEnv("EMBEDDING_CACHE_SIZE", o.Size); err != nil {
+		return err
+	}
+	if o.RedisDB, err = IntFromEnv("EMBEDDING_CACHE_REDIS_DB", o.RedisDB); err != nil {
+		return err
+	}
+	ttl, err := DurationFromEnv("EMBEDDING_CACHE_TTL", time.Duration(o.TTL))
+	o.TTL = Duration(ttl)
+	return err
+}
+
+// Validate checks that the options are consistent.
+func (o CacheOptions) Validate() error {
+	if o.Size < 0 {
+		return errors.New("size must not be negative")
+	}
+
+	switch o.Backend {
+	case "", CacheBackendNone:
+	case CacheBackendDisk:
+		if o.Directory == "" {
+			return fmt.Errorf("backend %s requires a directory (EMBEDDING_CACHE_DIR)", o.Backend)
+		}
+	case CacheBackendRedis:
+		if o.RedisAddress == "" {
+			return fmt.Errorf("backend %s requires an address (EMBEDDING_CACHE_REDIS_ADDRESS)", o.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown cache backend %q", o.Backend)
+	}
+
+	return nil
+}
+
+// Enabled reports whether embeddings are cached.
+func (o CacheOptions) Enabled() bool {
+	return o.Size > 0 || (o.Backend != "" && o.Backend != CacheBackendNone)
+}
+
+// CacheBackend stores embeddings by key, beyond the in-memory cache.
+type CacheBackend interface {
+	// Get returns the embedding stored for key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]float32, error)
+	// Set stores the embedding for key.
+	Set(ctx context.Context, key string, embedding []float32) error
+}
+
+// CacheStats counts the lookups of the embedding cache.
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Errors counts the failed lookups and updates of the backend. A failed lookup is also a miss.
+	Errors int64 `json:"errors,omitempty"`
+}
+
+// Events counted by cacheCounters.
+const (
+	cacheHit = iota
+	cacheMiss
+	cacheError
+)
+
+// cacheCounters are the counters of CacheStats, indexed by event and updated concurrently.
+type cacheCounters [3]atomic.Int64
+
+func (c *cacheCounters) stats() CacheStats {
+	return CacheStats{Hits: c[cacheHit].Load(), Misses: c[cacheMiss].Load(), Errors: c[cacheError].Load()}
+}
+
+type cacheStatsKey struct{}
+
+// WithCacheStats returns a context that counts the lookups of the embedding cache made with it,
+// e.g. for one invocation, and a function that returns the counts.
+func WithCacheStats(ctx context.Context) (context.Context, func() CacheStats) {
+	counters := &cacheCounters{}
+	return context.WithValue(ctx, cacheStatsKey{}, counters), counters.stats
+}
+
+// EmbeddingCache is an in-memory LRU cache of embeddings, in front of an optional CacheBackend.
+// It is safe for concurrent use.
+type EmbeddingCache struct {
+	size    int
+	backend CacheBackend
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	counters cacheCounters
+}
+
+// cacheEntry is an element of the LRU list.
+type cacheEntry struct {
+	key       string
+	embedding []float32
+}
+
+// NewEmbeddingCache creates the cache configured by the options.
+func NewEmbeddingCache(opts CacheOptions) (*EmbeddingCache, error) {
+	var backend CacheBackend
+	switch opts.Backend {
+	case CacheBackendDisk:
+		if err := os.MkdirAll(opts.Directory, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		backend = &diskCache{dir: opts.Directory}
+	case CacheBackendRedis:
+		backend = &redisCache{
+			client: redis.NewClient(&redis.Options{Addr: opts.RedisAddress, Password: opts.RedisPassword, DB: opts.RedisDB}),
+			ttl:    time.Duration(opts.TTL),
+		}
+	}
+
+	return NewEmbeddingCacheWithBackend(opts.Size, backend), nil
+}
+
+// NewEmbeddingCacheWithBackend creates a cache that keeps size embeddings in memory, in front of an optional backend.
+func NewEmbeddingCacheWithBackend(size int, backend CacheBackend) *EmbeddingCache {
+	return &EmbeddingCache{size: size, backend: backend, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// Stats returns the lookups counted since the cache was created.
+func (c *EmbeddingCache) Stats() CacheStats {
+	return c.counters.stats()
+}
+
+// CacheKey returns the key of the embedding of input by a model with the given dimensions.
+func CacheKey(model string, dimensions int, input string) string {
+	hash := sha256.Sum256([]byte(input))
+	return fmt.Sprintf("%s:%d:%s", model, dimensions, hex.EncodeToString(hash[:]))
+}
+
+// count counts an event in the statistics of the cache, and in those of ctx if it has any.
+func (c *EmbeddingCache) count(ctx context.Context, event int) {
+	c.counters[event].Add(1)
+	if counters, ok := ctx.Value(cacheStatsKey{}).(*cacheCounters); ok {
+		counters[event].Add(1)
+	}
+}
+
+// get returns the embedding for key from memory or the backend, or nil if it is not cached.
+// A backend that fails is treated like a miss, so that the embedding is generated instead.
+func (c *EmbeddingCache) get(ctx context.Context, key string) []float32 {
+	if embedding := c.getMemory(key); embedding != nil {
+		c.count(ctx, cacheHit)
+		return embedding
+	}
+
+	if c.backend != nil {
+		embedding, err := c.backend.Get(ctx, key)
+		if err != nil {
+			c.count(ctx, cacheError)
+			customhandler.LoggerFromContext(ctx).Warnf("Failed to read embedding from cache: %v", err)
+		} else if embedding != nil {
+			c.count(ctx, cacheHit)
+			c.setMemory(key, embedding)
+			return embedding
+		}
+	}
+
+	c.count(ctx, cacheMiss)
+	return nil
+}
+
+// set stores the embedding for key in memory and in the backend.
+func (c *EmbeddingCache) set(ctx context.Context, key string, embedding []float32) {
+	c.setMemory(key, embedding)
+
+	if c.backend != nil {
+		if err := c.backend.Set(ctx, key, embedding); err != nil {
+			c.count(ctx, cacheError)
+			customhandler.LoggerFromContext(ctx).Warnf("Failed to write embedding to cache: %v", err)
+		}
+	}
+}
+
+func (c *EmbeddingCache) getMemory(key string) []float32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).embedding
+}
+
+func (c *EmbeddingCache) setMemory(key string, embedding []float32) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).embedding = embedding
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, embedding: embedding})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cachingEmbedder looks up the embeddings of its inputs in a cache before it calls the Embedder it wraps.
+type cachingEmbedder struct {
+	Embedder
+	cache *EmbeddingCache
+}
+
+// WithCache wraps an Embedder so that the embeddings of inputs already in the cache are taken from it,
+// and the embeddings it generates are added to it. Identical inputs of a batch are only embedded once.
+// The embeddings returned from the cache are shared, and must not be modified.
+func WithCache(embedder Embedder, cache *EmbeddingCache) Embedder {
+	if cache == nil {
+		return embedder
+	}
+	return &cachingEmbedder{Embedder: embedder, cache: cache}
+}
+
+// Embed returns the cached embedding of the input, or generates it.
+func (e *cachingEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	key := CacheKey(e.Model(), e.Dimensions(), input)
+	if embedding := e.cache.get(ctx, key); embedding != nil {
+		return embedding, nil
+	}
+
+	embedding, err := e.Embedder.Embed(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	e.cache.set(ctx, key, embedding)
+	return embedding, nil
+}
+
+// EmbedBatch returns the cached embeddings of the inputs, and generates the others in a single request.
+func (e *cachingEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+
+	// missing maps the key of each input that is not cached to the indexes of the inputs with that key
+	var keys []string
+	var missingInputs []string
+	missing := map[string][]int{}
+	for i, input := range inputs {
+		key := CacheKey(e.Model(), e.Dimensions(), input)
+		if indexes, ok := missing[key]; ok {
+			// A duplicate of an input that is embedded anyway counts as a hit
+			e.cache.count(ctx, cacheHit)
+			missing[key] = append(indexes, i)
+			continue
+		}
+		if embeddings[i] = e.cache.get(ctx, key); embeddings[i] == nil {
+			missing[key] = []int{i}
+			keys = append(keys, key)
+			missingInputs = append(missingInputs, input)
+		}
+	}
+
+	if len(missingInputs) == 0 {
+		return embeddings, nil
+	}
+
+	generated, err := e.Embedder.EmbedBatch(ctx, missingInputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(generated) != len(missingInputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(missingInputs), len(generated))
+	}
+
+	for i, key := range keys {
+		e.cache.set(ctx, key, generated[i])
+		for _, index := range missing[key] {
+			embeddings[index] = generated[i]
+		}
+	}
+
+	return embeddings, nil
+}
+
+// encodeEmbedding encodes an embedding as little-endian float32 values.
+func encodeEmbedding(embedding []float32) []byte {
+	data := make([]byte, 4*len(embedding))
+	for i, value := range embedding {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+	return data
+}
+
+// decodeEmbedding decodes an embedding encoded by encodeEmbedding.
+func decodeEmbedding(data []byte) ([]float32, error) {
+	if len(data) == 0 || len(data)%4 != 0 {
+		return nil, fmt.Errorf("invalid cached embedding of %d bytes", len(data))
+	}
+
+	embedding := make([]float32, len(data)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return embedding, nil
+}
+
+// diskCache stores each embedding in a file of the directory, named by the hash of its key.
+type diskCache struct {
+	dir string
+}
+
+func (c *diskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:]))
+}
+
+func (c *diskCache) Get(ctx context.Context, key string) ([]float32, error) {
+	data, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEmbedding(data)
+}
+
+// Set writes the embedding to a temporary file that replaces the file of the key, so that concurrent
+// readers never see a partially written file.
+func (c *diskCache) Set(ctx context.Context, key string, embedding []float32) error {
+	file, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(encodeEmbedding(embedding)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), c.path(key))
+}
+
+// redisCache stores the embeddings in Redis, with the prefix "embedding:" before their keys.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]float32, error) {
+	data, err := c.client.Get(ctx, "embedding:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEmbedding(data)
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, embedding []float32) error {
+	return c.client.Set(ctx, "embedding:"+key, encodeEmbedding(embedding), c.ttl).Err()
+}
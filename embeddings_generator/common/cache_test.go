@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBackend is a CacheBackend whose lookups and updates fail.
+type failingBackend struct{}
+
+func (failingBackend) Get(ctx context.Context, key string) ([]float32, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (failingBackend) Set(ctx context.Context, key string, embedding []float32) error {
+	return errors.New("backend unavailable")
+}
+
+func TestCachingEmbedder(t *testing.T) {
+	stub := &stubEmbedder{}
+	cache := NewEmbeddingCacheWithBackend(10, nil)
+	embedder := WithCache(stub, cache)
+
+	embeddings, err := embedder.EmbedBatch(context.Background(), []string{"a", "bb", "a"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1}, {2}, {1}}, embeddings, "unexpected embeddings")
+
+	ctx, stats := WithCacheStats(context.Background())
+	embeddings, err = embedder.EmbedBatch(ctx, []string{"bb", "ccc"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{2}, {3}}, embeddings, "unexpected embeddings")
+
+	embedding, err := embedder.Embed(ctx, "ccc")
+	require.NoError(t, err)
+	assert.Equal(t, []float32{3}, embedding, "unexpected embedding")
+
+	assert.Equal(t, [][]string{{"a", "bb"}, {"ccc"}}, stub.requests, "expected only the inputs that are not cached to be embedded")
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, stats(), "unexpected statistics of the context")
+	assert.Equal(t, CacheStats{Hits: 3, Misses: 3}, cache.Stats(), "unexpected statistics of the cache")
+}
+
+func TestEmbeddingCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := NewEmbeddingCacheWithBackend(2, nil)
+
+	cache.set(ctx, "a", []float32{1})
+	cache.set(ctx, "b", []float32{2})
+	assert.NotNil(t, cache.get(ctx, "a"), "expected a to be cached")
+	cache.set(ctx, "c", []float32{3})
+
+	assert.Nil(t, cache.get(ctx, "b"), "expected b to be evicted")
+	assert.Equal(t, []float32{1}, cache.get(ctx, "a"), "expected a to be kept")
+	assert.Equal(t, []float32{3}, cache.get(ctx, "c"), "expected c to be kept")
+}
+
+func TestEmbeddingCacheDiskBackend(t *testing.T) {
+	ctx := context.Background()
+	opts := CacheOptions{Size: 10, Backend: CacheBackendDisk, Directory: t.TempDir()}
+	require.NoError(t, opts.Validate())
+
+	cache, err := NewEmbeddingCache(opts)
+	require.NoError(t, err)
+	key := CacheKey("model", 3, "text")
+	cache.set(ctx, key, []float32{0.5, -1, 3.25})
+
+	// A new cache, e.g. after a restart, finds the embedding on disk
+	cache, err = NewEmbeddingCache(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.5, -1, 3.25}, cache.get(ctx, key), "expected the embedding to be read from disk")
+	assert.Nil(t, cache.get(ctx, CacheKey("model", 1536, "text")), "expected the dimensions to be part of the key")
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cache.Stats(), "unexpected statistics")
+}
+
+func TestEmbeddingCacheBackendErrors(t *testing.T) {
+	stub := &stubEmbedder{}
+	cache := NewEmbeddingCacheWithBackend(0, failingBackend{})
+
+	embedding, err := WithCache(stub, cache).Embed(context.Background(), "text")
+	require.NoError(t, err, "expected the backend errors to be ignored")
+	assert.Equal(t, []float32{4}, embedding, "unexpected embedding")
+	assert.Equal(t, CacheStats{Misses: 1, Errors: 2}, cache.Stats(), "unexpected statistics")
+}
+
+func TestCacheOptionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultCacheOptions().Validate(), "expected the defaults to be valid")
+	assert.ErrorContains(t, CacheOptions{Backend: CacheBackendDisk}.Validate(), "directory", "expected the directory to be required")
+	assert.ErrorContains(t, CacheOptions{Backend: CacheBackendRedis}.Validate(), "address", "expected the address to be required")
+	assert.ErrorContains(t, CacheOptions{Backend: "memcached"}.Validate(), "unknown cache backend", "expected an unknown backend to be rejected")
+}
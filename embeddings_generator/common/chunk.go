@@ -0,0 +1,364 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ChunkStrategy determines how long texts are split into chunks before they are embedded.
+type ChunkStrategy string
+
+const (
+	// ChunkNone embeds the whole text at once.
+	ChunkNone ChunkStrategy = "none"
+	// ChunkTokens splits the text into chunks of Size tokens.
+	ChunkTokens ChunkStrategy = "tokens"
+	// ChunkSentences packs whole sentences into chunks of at most Size tokens.
+	ChunkSentences ChunkStrategy = "sentences"
+	// ChunkFixed splits the text into chunks of Size characters.
+	ChunkFixed ChunkStrategy = "fixed"
+)
+
+// ChunkOutput determines how the embeddings of the chunks of a text are stored.
+type ChunkOutput string
+
+const (
+	// ChunkOutputChunks stores one embedding per chunk, together with the position of the chunk in the text.
+	ChunkOutputChunks ChunkOutput = "chunks"
+	// ChunkOutputMean stores the element-wise mean of the chunk embeddings.
+	ChunkOutputMean ChunkOutput = "mean"
+	// ChunkOutputMax stores the element-wise maximum of the chunk embeddings.
+	ChunkOutputMax ChunkOutput = "max"
+)
+
+const (
+	defaultChunkTokens     = 512
+	defaultChunkCharacters = 2000
+)
+
+// ChunkOptions configures how texts are chunked and how the chunk embeddings are stored.
+type ChunkOptions struct {
+	Strategy ChunkStrategy `json:"strategy"`
+	// Size is the maximum size of a chunk, in tokens or (for ChunkFixed) characters.
+	Size int `json:"size"`
+	// Overlap is the number of tokens or characters shared by consecutive chunks.
+	Overlap int         `json:"overlap"`
+	Output  ChunkOutput `json:"output"`
+	// Tokenizer counts and splits tokens. ApproximateTokenizer is used if it is nil.
+	Tokenizer Tokenizer `json:"-"`
+}
+
+// LoadEnv overrides the options with the CHUNK_STRATEGY, CHUNK_SIZE, CHUNK_OVERLAP and CHUNK_OUTPUT
+// environment variables that are set. Chunking is disabled by default.
+func (o *ChunkOptions) LoadEnv() error {
+	o.Strategy = ChunkStrategy(strings.ToLower(StringFromEnv("CHUNK_STRATEGY", string(o.Strategy))))
+	o.Output = ChunkOutput(strings.ToLower(StringFromEnv("CHUNK_OUTPUT", string(o.Output))))
+
+	var err error
+	if o.Size, err = IntFromEnv("CHUNK_SIZE", o.Size); err != nil {
+		return err
+	}
+	if o.Overlap, err = IntFromEnv("CHUNK_OVERLAP", o.Overlap); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WithDefaults returns the options with the defaults filled in for unset options.
+func (o ChunkOptions) WithDefaults() ChunkOptions {
+	if o.Strategy == "" {
+		o.Strategy = ChunkNone
+	}
+	if o.Output == "" {
+		o.Output = ChunkOutputChunks
+	}
+	if o.Size == 0 {
+		o.Size = defaultChunkTokens
+		if o.Strategy == ChunkFixed {
+			o.Size = defaultChunkCharacters
+		}
+	}
+	if o.Tokenizer == nil {
+		o.Tokenizer = ApproximateTokenizer()
+	}
+	return o
+}
+
+// Validate checks that the options are consistent.
+func (o ChunkOptions) Validate() error {
+	switch o.Strategy {
+	case ChunkNone, ChunkTokens, ChunkSentences, ChunkFixed:
+	default:
+		return fmt.Errorf("unknown chunk strategy %q", o.Strategy)
+	}
+
+	switch o.Output {
+	case ChunkOutputChunks, ChunkOutputMean, ChunkOutputMax:
+	default:
+		return fmt.Errorf("unknown chunk output %q", o.Output)
+	}
+
+	if o.Strategy != ChunkNone && o.Overlap >= o.Size {
+		return fmt.Errorf("chunk overlap (%d) must be smaller than the chunk size (%d)", o.Overlap, o.Size)
+	}
+
+	return nil
+}
+
+// Enabled reports whether texts are split into chunks.
+func (o ChunkOptions) Enabled() bool {
+	return o.Strategy != "" && o.Strategy != ChunkNone
+}
+
+// Chunk is a part of a text. Offset and Length are measured in characters (Unicode code points).
+type Chunk struct {
+	Index  int
+	Offset int
+	Length int
+	Text   string
+}
+
+// ChunkEmbedding is the stored form of the embedding of a chunk.
+type ChunkEmbedding struct {
+	ChunkIndex int       `json:"chunkIndex"`
+	Offset     int       `json:"offset"`
+	Length     int       `json:"length"`
+	Vector     []float32 `json:"vector"`
+}
+
+// Split splits text into chunks according to the options. A text that fits into one chunk,
+// including an empty text, results in a single chunk.
+func (o ChunkOptions) Split(text string) []Chunk {
+	o = o.WithDefaults()
+
+	var spans []span
+	switch o.Strategy {
+	case ChunkTokens:
+		spans = window(spansOf(o.Tokenizer.Split(text), 0), o.Size, o.Overlap)
+	case ChunkSentences:
+		spans = o.packSentences(text)
+	case ChunkFixed:
+		spans = window(spansOf(strings.Split(text, ""), 0), o.Size, o.Overlap)
+	}
+
+	if len(spans) == 0 {
+		spans = []span{{start: 0, end: len(text)}}
+	}
+
+	chunks := make([]Chunk, len(spans))
+	for i, sp := range spans {
+		chunks[i] = Chunk{
+			Index:  i,
+			Offset: utf8.RuneCountInString(text[:sp.start]),
+			Length: utf8.RuneCountInString(text[sp.start:sp.end]),
+			Text:   text[sp.start:sp.end],
+		}
+	}
+
+	return chunks
+}
+
+// span is a part of a text, given by byte offsets.
+type span struct {
+	start, end int
+}
+
+// spansOf returns the spans of consecutive pieces of a text that start at offset.
+func spansOf(pieces []string, offset int) []span {
+	spans := make([]span, len(pieces))
+	for i, piece := range pieces {
+		spans[i] = span{start: offset, end: offset + len(piece)}
+		offset += len(piece)
+	}
+	return spans
+}
+
+// window joins consecutive units into spans of at most size units, with overlap units shared
+// by consecutive spans. It returns nil if all units fit into a single span.
+func window(units []span, size, overlap int) []span {
+	if len(units) <= size {
+		return nil
+	}
+
+	var spans []span
+	for start := 0; start < len(units); start += size - overlap {
+		end := min(start+size, len(units))
+		spans = append(spans, span{start: units[start].start, end: units[end-1].end})
+		if end == len(units) {
+			break
+		}
+	}
+
+	return spans
+}
+
+// packSentences packs whole sentences into spans of at most Size tokens. The last sentences of a span
+// are repeated at the start of the next span, as long as they fit into Overlap tokens.
+// Sentences longer than Size are split by tokens.
+func (o ChunkOptions) packSentences(text string) []span {
+	if o.Tokenizer.Count(text) <= o.Size {
+		return nil
+	}
+
+	type sentence struct {
+		span
+		tokens int
+	}
+
+	var sentences []sentence
+	for _, sp := range splitSentences(text) {
+		tokens := o.Tokenizer.Count(text[sp.start:sp.end])
+		if tokens <= o.Size {
+			sentences = append(sentences, sentence{span: sp, tokens: tokens})
+			continue
+		}
+		for _, part := range window(spansOf(o.Tokenizer.Split(text[sp.start:sp.end]), sp.start), o.Size, 0) {
+			sentences = append(sentences, sentence{span: part, tokens: o.Tokenizer.Count(text[part.start:part.end])})
+		}
+	}
+
+	var spans []span
+	var current []sentence
+	currentTokens := 0
+	for _, s := range sentences {
+		if len(current) > 0 && currentTokens+s.tokens > o.Size {
+			spans = append(spans, span{start: current[0].start, end: current[len(current)-1].end})
+
+			// Keep the trailing sentences that fit into the overlap
+			keep := len(current)
+			overlapTokens := 0
+			for keep > 0 && overlapTokens+current[keep-1].tokens <= o.Overlap && overlapTokens+current[keep-1].tokens+s.tokens <= o.Size {
+				keep--
+				overlapTokens += current[keep].tokens
+			}
+			current = append([]sentence(nil), current[keep:]...)
+			currentTokens = overlapTokens
+		}
+
+		current = append(current, s)
+		currentTokens += s.tokens
+	}
+	spans = append(spans, span{start: current[0].start, end: current[len(current)-1].end})
+
+	return spans
+}
+
+// splitSentences splits text after sentence terminators (., ! and ?) that are followed by whitespace,
+// and after line breaks. The whitespace stays with the preceding sentence, so no text is lost.
+func splitSentences(text string) []span {
+	var sentences []span
+
+	start := 0
+	for offset := 0; offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+
+		next, _ := utf8.DecodeRuneInString(text[offset:])
+		terminator := r == '\n' || ((r == '.' || r == '!' || r == '?') && offset < len(text) && unicode.IsSpace(next))
+		if !terminator {
+			continue
+		}
+
+		// Include the whitespace after the terminator
+		for offset < len(text) {
+			next, size := utf8.DecodeRuneInString(text[offset:])
+			if !unicode.IsSpace(next) {
+				break
+			}
+			offset += size
+		}
+
+		sentences = append(sentences, span{start: start, end: offset})
+		start = offset
+	}
+
+	if start < len(text) {
+		sentences = append(sentences, span{start: start, end: len(text)})
+	}
+
+	return sentences
+}
+
+// Combine converts the embeddings of the chunks of a text into the value stored in the document:
+// a single vector if the text was not chunked or the output is pooled, or a list of ChunkEmbedding otherwise.
+// Pooling fails if the embeddings do not have the same dimensions.
+func (o ChunkOptions) Combine(chunks []Chunk, embeddings [][]float32) (any, error) {
+	if !o.Enabled() {
+		return embeddings[0], nil
+	}
+
+	switch o.Output {
+	case ChunkOutputMean:
+		return meanPool(embeddings)
+	case ChunkOutputMax:
+		return maxPool(embeddings)
+	default:
+		result := make([]ChunkEmbedding, len(chunks))
+		for i, chunk := range chunks {
+			result[i] = ChunkEmbedding{ChunkIndex: chunk.Index, Offset: chunk.Offset, Length: chunk.Length, Vector: embeddings[i]}
+		}
+		return result, nil
+	}
+}
+
+// meanPool returns the element-wise mean of the vectors, which must have the same dimensions.
+func meanPool(vectors [][]float32) ([]float32, error) {
+	if err := sameDimensions(vectors); err != nil {
+		return nil, err
+	}
+
+	pooled := make([]float32, len(vectors[0]))
+	for _, vector := range vectors {
+		for i, value := range vector {
+			pooled[i] += value / float32(len(vectors))
+		}
+	}
+	return pooled, nil
+}
+
+// Normalize returns the vector scaled to unit length (L2 norm). A zero vector is returned unchanged.
+func Normalize(vector []float32) []float32 {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	if sum == 0 {
+		return vector
+	}
+
+	norm := math.Sqrt(sum)
+	normalized := make([]float32, len(vector))
+	for i, value := range vector {
+		normalized[i] = float32(float64(value) / norm)
+	}
+	return normalized
+}
+
+// maxPool returns the element-wise maximum of the vectors, which must have the same dimensions.
+func maxPool(vectors [][]float32) ([]float32, error) {
+	if err := sameDimensions(vectors); err != nil {
+		return nil, err
+	}
+
+	pooled := append([]float32(nil), vectors[0]...)
+	for _, vector := range vectors[1:] {
+		for i, value := range vector {
+			pooled[i] = max(pooled[i], value)
+		}
+	}
+	return pooled, nil
+}
+
+// sameDimensions checks that the chunk embeddings have the same dimensions, so that they can be pooled.
+func sameDimensions(vectors [][]float32) error {
+	for i, vector := range vectors[1:] {
+		if len(vector) != len(vectors[0]) {
+			return fmt.Errorf("cannot pool chunk embeddings of different dimensions: chunk 0 has %d, chunk %d has %d", len(vectors[0]), i+1, len(vector))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkTexts returns the texts of the chunks.
+func chunkTexts(chunks []Chunk) []string {
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+	return texts
+}
+
+func TestChunkOptionsSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ChunkOptions
+		text     string
+		expected []string
+	}{
+		{name: "disabled", opts: ChunkOptions{}, text: "one two three", expected: []string{"one two three"}},
+		{name: "empty text", opts: ChunkOptions{Strategy: ChunkTokens, Size: 2}, text: "", expected: []string{""}},
+		{name: "fits into one chunk", opts: ChunkOptions{Strategy: ChunkTokens, Size: 5}, text: "one two three", expected: []string{"one two three"}},
+		{name: "tokens", opts: ChunkOptions{Strategy: ChunkTokens, Size: 2}, text: "one two three four five", expected: []string{"one two", " three four", " five"}},
+		{name: "tokens with overlap", opts: ChunkOptions{Strategy: ChunkTokens, Size: 3, Overlap: 1}, text: "one two three four five", expected: []string{"one two three", " three four five"}},
+		{name: "characters", opts: ChunkOptions{Strategy: ChunkFixed, Size: 4}, text: "héllo wörld", expected: []string{"héll", "o wö", "rld"}},
+		{name: "characters with overlap", opts: ChunkOptions{Strategy: ChunkFixed, Size: 4, Overlap: 1}, text: "héllo wörld", expected: []string{"héll", "lo w", "wörl", "ld"}},
+		{name: "sentences", opts: ChunkOptions{Strategy: ChunkSentences, Size: 8}, text: "One two. Three four. Five six.", expected: []string{"One two. Three four. ", "Five six."}},
+		{name: "sentences with overlap", opts: ChunkOptions{Strategy: ChunkSentences, Size: 8, Overlap: 4}, text: "One two. Three four. Five six.", expected: []string{"One two. Three four. ", "Three four. Five six."}},
+		{name: "sentence longer than a chunk", opts: ChunkOptions{Strategy: ChunkSentences, Size: 2}, text: "a b c d. e", expected: []string{"a b", " c d", ". ", "e"}},
+	}
+
+	for _, tt := range tests {
+		chunks := tt.opts.Split(tt.text)
+		assert.Equal(t, tt.expected, chunkTexts(chunks), "unexpected chunks for %s", tt.name)
+		if tt.opts.Overlap == 0 {
+			assert.Equal(t, tt.text, strings.Join(chunkTexts(chunks), ""), "expected the chunks to cover the text for %s", tt.name)
+		}
+	}
+}
+
+func TestChunkOptionsSplitPositions(t *testing.T) {
+	chunks := ChunkOptions{Strategy: ChunkTokens, Size: 2}.Split("héllo wörld und mehr")
+	expected := []Chunk{
+		{Index: 0, Offset: 0, Length: 11, Text: "héllo wörld"},
+		{Index: 1, Offset: 11, Length: 9, Text: " und mehr"},
+	}
+	assert.Equal(t, expected, chunks, "expected the offsets and lengths in characters")
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := map[string][]string{
+		"First one. Second one!  Third? Last": {"First one. ", "Second one!  ", "Third? ", "Last"},
+		"line\nnext\n":                        {"line\n", "next\n"},
+		"Pi is 3.14 roughly.":                 {"Pi is 3.14 roughly."},
+		"Trailing. ":                          {"Trailing. "},
+		"":                                    nil,
+	}
+
+	for text, expected := range tests {
+		var sentences []string
+		for _, sp := range splitSentences(text) {
+			sentences = append(sentences, text[sp.start:sp.end])
+		}
+		assert.Equal(t, expected, sentences, "unexpected sentences of %q", text)
+	}
+}
+
+func TestChunkOptionsCombine(t *testing.T) {
+	chunks := []Chunk{{Index: 0, Offset: 0, Length: 3, Text: "one"}, {Index: 1, Offset: 3, Length: 4, Text: " two"}}
+	embeddings := [][]float32{{1, 5}, {3, 4}}
+
+	combined, err := ChunkOptions{}.Combine(chunks[:1], embeddings[:1])
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 5}, combined, "expected the embedding of the whole text")
+
+	combined, err = ChunkOptions{Strategy: ChunkTokens, Output: ChunkOutputChunks}.Combine(chunks, embeddings)
+	require.NoError(t, err)
+	assert.Equal(t, []ChunkEmbedding{
+		{ChunkIndex: 0, Offset: 0, Length: 3, Vector: []float32{1, 5}},
+		{ChunkIndex: 1, Offset: 3, Length: 4, Vector: []float32{3, 4}},
+	}, combined, "expected an embedding per chunk")
+
+	combined, err = ChunkOptions{Strategy: ChunkTokens, Output: ChunkOutputMean}.Combine(chunks, embeddings)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{2, 4.5}, combined, "expected the element-wise mean")
+
+	combined, err = ChunkOptions{Strategy: ChunkTokens, Output: ChunkOutputMax}.Combine(chunks, embeddings)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{3, 5}, combined, "expected the element-wise maximum")
+}
+
+func TestPoolingRejectsDifferentDimensions(t *testing.T) {
+	embeddings := [][]float32{{1, 2}, {3, 4}, {5}}
+
+	_, err := meanPool(embeddings)
+	assert.ErrorContains(t, err, "chunk 0 has 2, chunk 2 has 1", "expected mean pooling to fail")
+
+	_, err = maxPool(embeddings)
+	assert.ErrorContains(t, err, "different dimensions", "expected max pooling to fail")
+
+	_, err = maxPool([][]float32{{1}, {2, 3}})
+	assert.Error(t, err, "expected max pooling to fail for a longer vector")
+}
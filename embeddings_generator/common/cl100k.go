@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	_ "embed"
+	"sync"
+)
+
+// cl100kFile is the tiktoken ranks file of cl100k_base, the encoding of the OpenAI embedding models. It is
+// checked in, with the checksum published by tiktoken recorded in tiktoken/README.md, and embedded into the
+// binary, so a build without it fails.
+const cl100kFile = "tiktoken/cl100k_base.tiktoken"
+
+//go:embed tiktoken/cl100k_base.tiktoken
+var cl100kRanks []byte
+
+// CL100kTokenizer returns the tokenizer of the cl100k_base encoding, from the embedded ranks. The ranks are
+// parsed once, on the first call.
+func CL100kTokenizer() (Tokenizer, error) {
+	return cl100kTokenizer()
+}
+
+var cl100kTokenizer = sync.OnceValues(func() (Tokenizer, error) {
+	ranks, err := readRanks(bytes.NewReader(cl100kRanks), cl100kFile)
+	if err != nil {
+		return nil, err
+	}
+	return &bpeTokenizer{ranks: ranks}, nil
+})
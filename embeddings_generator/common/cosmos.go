@@ -0,0 +1,462 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+const (
+	defaultCosmosPartitionKey = "/id"
+
+	// MaxPatchOperations is the maximum number of operations of a single patch request.
+	MaxPatchOperations = 10
+
+	// maxBatchOperations is the maximum number of operations of a transactional batch.
+	maxBatchOperations = 100
+
+	// EmulatorEndpoint and EmulatorKey are the default endpoint and the well-known key of the Cosmos DB emulator.
+	EmulatorEndpoint = "https://localhost:8081"
+	EmulatorKey      = "C2y6yDjf5/R+ob0N8A7Cgv30VRDJIWEHLM+4QDU5DE2nQ9nDuVTqobD4b8mGGyPMbIZnqyMsEcaGQy67XIw/Jw=="
+)
+
+// CosmosOptions configures the connection to the Cosmos DB container the enriched documents are written to.
+type CosmosOptions struct {
+	// ConnectionString is an account connection string ("AccountEndpoint=...;AccountKey=...;"). It is read from
+	// COSMOS_CONNECTION, the connection setting of the trigger and the output binding.
+	ConnectionString string `json:"connectionString,omitempty"`
+	// Endpoint is the account endpoint. Without a key, requests are authenticated with Microsoft Entra ID
+	// (DefaultAzureCredential). It is read from COSMOS_ENDPOINT, or COSMOS_CONNECTION__accountEndpoint, the
+	// setting of an identity-based connection of the bindings.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Key is the account key (COSMOS_KEY).
+	Key string `json:"key,omitempty"`
+	// Database and Container name the container (COSMOS_DATABASE_NAME and COSMOS_CONTAINER_NAME, like the bindings).
+	Database  string `json:"database,omitempty"`
+	Container string `json:"container,omitempty"`
+	// PartitionKey is the partition key path of the container (COSMOS_PARTITION_KEY). It defaults to /id.
+	PartitionKey string `json:"partitionKey,omitempty"`
+	// Emulator connects to the local Cosmos DB emulator (COSMOS_EMULATOR): the endpoint and the key default to
+	// those of the emulator, and its self-signed certificate is accepted.
+	Emulator bool `json:"emulator,omitempty"`
+
+	// Credential authenticates requests when there is no key. DefaultAzureCredential is used if it is nil.
+	Credential azcore.TokenCredential `json:"-"`
+	// HTTPClient sends the requests. A default client is used if it is nil.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// LoadEnv overrides the options with the COSMOS_CONNECTION, COSMOS_ENDPOINT (or COSMOS_CONNECTION__accountEndpoint),
+// COSMOS_KEY, COSMOS_DATABASE_NAME, COSMOS_CONTAINER_NAME, COSMOS_PARTITION_KEY and COSMOS_EMULATOR environment
+// variables that are set.
+func (o *CosmosOptions) LoadEnv() error {
+	return o.LoadEnvWithPrefix("COSMOS_")
+}
+
+// LoadEnvWithPrefix is like LoadEnv, with the variables named with the given prefix instead of COSMOS_, such as
+// COSMOS_TARGET_CONTAINER_NAME for the prefix COSMOS_TARGET_.
+func (o *CosmosOptions) LoadEnvWithPrefix(prefix string) error {
+	o.ConnectionString = StringFromEnv(prefix+"CONNECTION", o.ConnectionString)
+	o.Endpoint = StringFromEnv(prefix+"ENDPOINT", StringFromEnv(prefix+"CONNECTION__accountEndpoint", o.Endpoint))
+	o.Key = StringFromEnv(prefix+"KEY", o.Key)
+	o.Database = StringFromEnv(prefix+"DATABASE_NAME", o.Database)
+	o.Container = StringFromEnv(prefix+"CONTAINER_NAME", o.Container)
+	o.PartitionKey = StringFromEnv(prefix+"PARTITION_KEY", o.PartitionKey)
+
+	var err error
+	o.Emulator, err = BoolFromEnv(prefix+"EMULATOR", o.Emulator)
+	return err
+}
+
+// HasAccount reports whether the options name an account, with a connection string, an endpoint or the emulator.
+func (o CosmosOptions) HasAccount() bool {
+	return o.ConnectionString != "" || o.Endpoint != "" || o.Emulator
+}
+
+// SameContainer reports whether the options and other name the same container of the same account.
+func (o CosmosOptions) SameContainer(other CosmosOptions) bool {
+	endpoint, _, err := o.account()
+	otherEndpoint, _, otherErr := other.account()
+	return err == nil && otherErr == nil && strings.EqualFold(endpoint, otherEndpoint) &&
+		o.Database == other.Database && o.Container == other.Container
+}
+
+// Validate checks that the options name an account and a container.
+func (o CosmosOptions) Validate() error {
+	var errs []error
+	if _, _, err := o.account(); err != nil {
+		errs = append(errs, err)
+	}
+	if o.Database == "" || o.Container == "" {
+		errs = append(errs, errors.New("database and container are required (COSMOS_DATABASE_NAME and COSMOS_CONTAINER_NAME)"))
+	}
+	if o.PartitionKey != "" && !strings.HasPrefix(o.PartitionKey, "/") {
+		errs = append(errs, fmt.Errorf("partition key %q must be a path such as /id", o.PartitionKey))
+	}
+	return errors.Join(errs...)
+}
+
+// account returns the endpoint and the key of the account, from the connection string or the endpoint and key.
+func (o CosmosOptions) account() (string, string, error) {
+	endpoint, key := o.Endpoint, o.Key
+	if o.ConnectionString != "" {
+		for _, part := range strings.Split(o.ConnectionString, ";") {
+			name, value, _ := strings.Cut(part, "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "accountendpoint":
+				endpoint = value
+			case "accountkey":
+				key = value
+			}
+		}
+	}
+
+	if o.Emulator {
+		if endpoint == "" {
+			endpoint = EmulatorEndpoint
+		}
+		if key == "" {
+			key = EmulatorKey
+		}
+	}
+
+	if endpoint == "" {
+		return "", "", errors.New("account endpoint is required (COSMOS_CONNECTION, COSMOS_ENDPOINT or COSMOS_CONNECTION__accountEndpoint)")
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid account endpoint %q", endpoint)
+	}
+	if key != "" {
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			return "", "", errors.New("account key is not base64 encoded")
+		}
+	}
+	return strings.TrimSuffix(endpoint, "/"), key, nil
+}
+
+// CosmosItem is a document read or written by a CosmosClient, along with the response that returned it.
+type CosmosItem struct {
+	Document map[string]any
+	ETag     string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// RequestCharge is the number of request units charged for the request.
+	RequestCharge float64
+}
+
+// PatchOperation is an operation of a partial document update. Path is a JSON pointer.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// PatchSet returns an operation that sets the property at path to value. The parent of a nested property must exist.
+func PatchSet(path Path, value any) PatchOperation {
+	return PatchOperation{Op: "set", Path: path.String(), Value: value}
+}
+
+// ItemOptions are the options of a request for a document.
+type ItemOptions struct {
+	// IfMatch makes a write conditional: it fails with 412 Precondition Failed if the etag of the document differs.
+	IfMatch string
+}
+
+// CosmosClient reads and writes the documents of a Cosmos DB container with the azcosmos SDK.
+type CosmosClient struct {
+	container    *azcosmos.ContainerClient
+	partitionKey Path
+}
+
+// NewCosmosClient creates a client for the configured container.
+func NewCosmosClient(opts CosmosOptions) (*CosmosClient, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	partitionKey := opts.PartitionKey
+	if partitionKey == "" {
+		partitionKey = defaultCosmosPartitionKey
+	}
+	path, err := ParsePath(partitionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid partition key: %w", err)
+	}
+
+	client, err := newAccountClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	container, err := client.NewContainer(opts.Database, opts.Container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	return &CosmosClient{container: container, partitionKey: path}, nil
+}
+
+// newAccountClient creates an azcosmos client for the account of the options, authenticated with the account key,
+// or with Microsoft Entra ID if there is no key.
+func newAccountClient(opts CosmosOptions) (*azcosmos.Client, error) {
+	endpoint, key, err := opts.account()
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := &azcosmos.ClientOptions{}
+	if opts.HTTPClient != nil {
+		clientOptions.Transport = opts.HTTPClient
+	} else if opts.Emulator {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		clientOptions.Transport = &http.Client{Transport: transport}
+	}
+
+	if key != "" {
+		cred, err := azcosmos.NewKeyCredential(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account key: %w", err)
+		}
+		return azcosmos.NewClientWithKey(endpoint, cred, clientOptions)
+	}
+
+	cred := opts.Credential
+	if cred == nil {
+		defaultCred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create credential: %w", err)
+		}
+		cred = defaultCred
+	}
+	return azcosmos.NewClient(endpoint, cred, clientOptions)
+}
+
+// PartitionKey returns the partition key value of a document, which is nil if it is null. A document without
+// the partition key property is rejected: Cosmos DB stores it under an undefined partition key, which differs
+// from null and cannot be addressed with the SDK.
+func (c *CosmosClient) PartitionKey(doc map[string]any) (any, error) {
+	value, exists := c.partitionKey.Get(doc)
+	if !exists {
+		return nil, fmt.Errorf("document has no partition key %s", c.partitionKey)
+	}
+	return value, nil
+}
+
+// ReadItem reads a document.
+func (c *CosmosClient) ReadItem(ctx context.Context, id string, partitionKey any) (*CosmosItem, error) {
+	pk, err := cosmosPartitionKey(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.container.ReadItem(ctx, pk, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newCosmosItem(resp.Response, resp.Value)
+}
+
+// UpsertItem creates or replaces a document, and returns the stored document.
+func (c *CosmosClient) UpsertItem(ctx context.Context, partitionKey any, doc map[string]any, opts *ItemOptions) (*CosmosItem, error) {
+	pk, err := cosmosPartitionKey(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal document: %w", err)
+	}
+	resp, err := c.container.UpsertItem(ctx, pk, data, opts.itemOptions())
+	if err != nil {
+		return nil, err
+	}
+	return newCosmosItem(resp.Response, resp.Value)
+}
+
+// ReplaceItem replaces a document, and returns the stored document.
+func (c *CosmosClient) ReplaceItem(ctx context.Context, id string, partitionKey any, doc map[string]any, opts *ItemOptions) (*CosmosItem, error) {
+	pk, err := cosmosPartitionKey(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal document: %w", err)
+	}
+	resp, err := c.container.ReplaceItem(ctx, pk, id, data, opts.itemOptions())
+	if err != nil {
+		return nil, err
+	}
+	return newCosmosItem(resp.Response, resp.Value)
+}
+
+// PatchItem applies operations to a document, and returns the patched document. A patch of more than
+// MaxPatchOperations operations is split into several patches of the same document that are applied atomically
+// in a transactional batch, the first one on the condition of opts.
+func (c *CosmosClient) PatchItem(ctx context.Context, id string, partitionKey any, operations []PatchOperation, opts *ItemOptions) (*CosmosItem, error) {
+	if len(operations) > MaxPatchOperations*maxBatchOperations {
+		return nil, fmt.Errorf("a patch has at most %d operations, got %d", MaxPatchOperations*maxBatchOperations, len(operations))
+	}
+	pk, err := cosmosPartitionKey(partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(operations) > MaxPatchOperations {
+		return c.patchItemInBatch(ctx, id, pk, operations, opts)
+	}
+
+	patch, err := patchOperations(operations)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.container.PatchItem(ctx, pk, id, patch, opts.itemOptions())
+	if err != nil {
+		return nil, err
+	}
+	return newCosmosItem(resp.Response, resp.Value)
+}
+
+// patchItemInBatch applies the operations in patches of up to MaxPatchOperations operations of a transactional
+// batch. If a patch fails, none is applied, and the error is a response error with the status of the failed patch.
+func (c *CosmosClient) patchItemInBatch(ctx context.Context, id string, pk azcosmos.PartitionKey, operations []PatchOperation, opts *ItemOptions) (*CosmosItem, error) {
+	batch := c.container.NewTransactionalBatch(pk)
+	itemOptions := opts.itemOptions()
+	for len(operations) > 0 {
+		n := min(len(operations), MaxPatchOperations)
+		patch, err := patchOperations(operations[:n])
+		if err != nil {
+			return nil, err
+		}
+		batch.PatchItem(id, patch, &azcosmos.TransactionalBatchItemOptions{IfMatchETag: itemOptions.IfMatchEtag})
+		operations, itemOptions.IfMatchEtag = operations[n:], nil
+	}
+
+	resp, err := c.container.ExecuteTransactionalBatch(ctx, batch, &azcosmos.TransactionalBatchOptions{EnableContentResponseOnWrite: true})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		// The failed patch is the first one that does not fail because another one did
+		for i, result := range resp.OperationResults {
+			if result.StatusCode != http.StatusFailedDependency {
+				status := int(result.StatusCode)
+				return nil, fmt.Errorf("patch %d of the batch failed: %w", i+1,
+					&azcore.ResponseError{StatusCode: status, ErrorCode: http.StatusText(status), RawResponse: resp.RawResponse})
+			}
+		}
+		return nil, &azcore.ResponseError{StatusCode: resp.RawResponse.StatusCode, RawResponse: resp.RawResponse}
+	}
+
+	last := resp.OperationResults[len(resp.OperationResults)-1]
+	item, err := newCosmosItem(resp.Response, last.ResourceBody)
+	if err != nil {
+		return nil, err
+	}
+	item.ETag = string(last.ETag)
+	return item, nil
+}
+
+// itemOptions returns the SDK options of a write. The stored document is always returned.
+func (o *ItemOptions) itemOptions() *azcosmos.ItemOptions {
+	options := &azcosmos.ItemOptions{EnableContentResponseOnWrite: true}
+	if o != nil && o.IfMatch != "" {
+		etag := azcore.ETag(o.IfMatch)
+		options.IfMatchEtag = &etag
+	}
+	return options
+}
+
+// newCosmosItem returns the document of a response.
+func newCosmosItem(resp azcosmos.Response, body []byte) (*CosmosItem, error) {
+	item := &CosmosItem{ETag: string(resp.ETag), StatusCode: resp.RawResponse.StatusCode, RequestCharge: requestCharge(resp.RawResponse)}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &item.Document); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return item, nil
+}
+
+// patchOperations converts operations to those of the SDK.
+func patchOperations(operations []PatchOperation) (azcosmos.PatchOperations, error) {
+	var patch azcosmos.PatchOperations
+	for _, op := range operations {
+		switch op.Op {
+		case "set":
+			patch.AppendSet(op.Path, op.Value)
+		case "add":
+			patch.AppendAdd(op.Path, op.Value)
+		case "replace":
+			patch.AppendReplace(op.Path, op.Value)
+		case "remove":
+			patch.AppendRemove(op.Path)
+		default:
+			return patch, fmt.Errorf("unsupported patch operation %q", op.Op)
+		}
+	}
+	return patch, nil
+}
+
+// cosmosPartitionKey returns the partition key of a partition key value decoded from JSON. A nil value is the
+// null partition key.
+func cosmosPartitionKey(value any) (azcosmos.PartitionKey, error) {
+	switch v := value.(type) {
+	case nil:
+		return azcosmos.NullPartitionKey, nil
+	case string:
+		return azcosmos.NewPartitionKeyString(v), nil
+	case bool:
+		return azcosmos.NewPartitionKeyBool(v), nil
+	case float64:
+		return azcosmos.NewPartitionKeyNumber(v), nil
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return azcosmos.PartitionKey{}, fmt.Errorf("invalid partition key %s: %w", v, err)
+		}
+		return azcosmos.NewPartitionKeyNumber(n), nil
+	default:
+		return azcosmos.PartitionKey{}, fmt.Errorf("partition key must be a string, a number or a boolean, got %T", value)
+	}
+}
+
+// requestCharge returns the request units charged for a request.
+func requestCharge(resp *http.Response) float64 {
+	charge, _ := strconv.ParseFloat(resp.Header.Get("x-ms-request-charge"), 64)
+	return charge
+}
+
+// ErrorStatus returns the status code and the request units charged for a request that failed with err. The status
+// code is 0 if the request failed without a response.
+func ErrorStatus(err error) (int, float64) {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return 0, 0
+	}
+	if respErr.RawResponse == nil {
+		return respErr.StatusCode, 0
+	}
+	return respErr.StatusCode, requestCharge(respErr.RawResponse)
+}
+
+// IsPreconditionFailed reports whether a conditional write failed because the document has changed.
+func IsPreconditionFailed(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// IsNotFound reports whether a request failed because the document does not exist.
+func IsNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
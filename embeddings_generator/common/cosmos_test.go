@@ -0,0 +1,494 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCosmosKey = base64.StdEncoding.EncodeToString([]byte("test-account-key"))
+
+// cosmosServer is a TLS server that stores the documents of a single container in memory and implements
+// the read, upsert, replace and patch requests of the REST API, checking the signatures made with testCosmosKey.
+// It answers the request for the account properties the SDK sends first with an account of a single region.
+type cosmosServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	documents map[string]map[string]any
+	versions  int
+	requests  []*http.Request
+}
+
+func newCosmosServer(t *testing.T, documents ...map[string]any) *cosmosServer {
+	s := &cosmosServer{documents: map[string]map[string]any{}}
+	for _, doc := range documents {
+		s.store(doc)
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// store saves a document with a new etag.
+func (s *cosmosServer) store(doc map[string]any) {
+	s.versions++
+	doc["_etag"] = fmt.Sprintf(`"%d"`, s.versions)
+	s.documents[doc["id"].(string)] = doc
+}
+
+func (s *cosmosServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/" {
+		if !s.authorized(r, "", "") {
+			http.Error(w, `{"code":"Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"writableLocations":[{"name":"local","databaseAccountEndpoint":%[1]q}],"readableLocations":[{"name":"local","databaseAccountEndpoint":%[1]q}]}`, s.URL)
+		return
+	}
+	s.requests = append(s.requests, r)
+
+	link := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method == http.MethodPost {
+		link = strings.TrimSuffix(link, "/docs")
+	}
+	if !s.authorized(r, "docs", link) {
+		http.Error(w, `{"code":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost && strings.EqualFold(r.Header.Get("x-ms-cosmos-is-batch-request"), "true") {
+		s.handleBatch(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		var doc map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil || !strings.EqualFold(r.Header.Get("x-ms-documentdb-is-upsert"), "true") {
+			http.Error(w, `{"code":"BadRequest"}`, http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if _, exists := s.documents[doc["id"].(string)]; !exists {
+			status = http.StatusCreated
+		}
+		s.store(doc)
+		w.Header().Set("etag", doc["_etag"].(string))
+		w.Header().Set("x-ms-request-charge", "7")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(doc)
+		return
+	}
+
+	doc, exists := s.documents[link[strings.LastIndex(link, "/")+1:]]
+	if !exists {
+		http.Error(w, `{"code":"NotFound"}`, http.StatusNotFound)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != doc["_etag"] {
+		w.Header().Set("x-ms-request-charge", "1.24")
+		http.Error(w, `{"code":"PreconditionFailed"}`, http.StatusPreconditionFailed)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var replacement map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&replacement); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		doc = replacement
+		s.store(doc)
+	case http.MethodPatch:
+		var body struct {
+			Operations []PatchOperation `json:"operations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, op := range body.Operations {
+			path, _ := ParsePath(op.Path)
+			if err := path.Set(doc, op.Value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s.store(doc)
+	}
+
+	w.Header().Set("etag", doc["_etag"].(string))
+	w.Header().Set("x-ms-request-charge", "10.5")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// handleBatch applies the patch operations of a transactional batch, all or none of them. The documents are
+// patched in a copy that is stored only if every operation succeeds.
+func (s *cosmosServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var operations []struct {
+		OperationType string `json:"operationType"`
+		ID            string `json:"id"`
+		IfMatch       string `json:"ifMatch"`
+		ResourceBody  struct {
+			Operations []PatchOperation `json:"operations"`
+		} `json:"resourceBody"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type result struct {
+		StatusCode   int            `json:"statusCode"`
+		ETag         string         `json:"eTag,omitempty"`
+		ResourceBody map[string]any `json:"resourceBody,omitempty"`
+	}
+	results := make([]result, len(operations))
+	patched := map[string]map[string]any{}
+	versions, failed := s.versions, false
+	for i, op := range operations {
+		if failed {
+			results[i] = result{StatusCode: http.StatusFailedDependency}
+			continue
+		}
+		doc, exists := patched[op.ID]
+		if !exists {
+			if doc, exists = s.documents[op.ID]; exists {
+				doc = CloneDocument(doc)
+			}
+		}
+		switch {
+		case op.OperationType != "Patch":
+			results[i], failed = result{StatusCode: http.StatusBadRequest}, true
+		case !exists:
+			results[i], failed = result{StatusCode: http.StatusNotFound}, true
+		case op.IfMatch != "" && op.IfMatch != doc["_etag"]:
+			results[i], failed = result{StatusCode: http.StatusPreconditionFailed}, true
+		default:
+			for _, patch := range op.ResourceBody.Operations {
+				path, _ := ParsePath(patch.Path)
+				if err := path.Set(doc, patch.Value); err != nil {
+					failed = true
+				}
+			}
+			if failed {
+				results[i] = result{StatusCode: http.StatusBadRequest}
+				continue
+			}
+			versions++
+			doc["_etag"] = fmt.Sprintf(`"%d"`, versions)
+			patched[op.ID] = doc
+			results[i] = result{StatusCode: http.StatusOK, ETag: doc["_etag"].(string), ResourceBody: CloneDocument(doc)}
+		}
+	}
+
+	status := http.StatusOK
+	if failed {
+		status = http.StatusMultiStatus
+		for i := range results {
+			if results[i].StatusCode == http.StatusOK {
+				results[i] = result{StatusCode: http.StatusFailedDependency}
+			}
+		}
+	} else {
+		for id, doc := range patched {
+			s.documents[id] = doc
+		}
+		s.versions = versions
+	}
+
+	w.Header().Set("x-ms-request-charge", "21.5")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// authorized checks the master key signature of a request for the resource of type resourceType at link.
+func (s *cosmosServer) authorized(r *http.Request, resourceType, link string) bool {
+	auth, err := url.QueryUnescape(r.Header.Get("Authorization"))
+	if err != nil {
+		return false
+	}
+	key, _ := base64.StdEncoding.DecodeString(testCosmosKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(r.Method) + "\n" + resourceType + "\n" + link + "\n" + strings.ToLower(r.Header.Get("x-ms-date")) + "\n\n"))
+	return auth == "type=master&ver=1.0&sig="+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTestCosmosClient(t *testing.T, server *cosmosServer) *CosmosClient {
+	t.Helper()
+	client, err := NewCosmosClient(CosmosOptions{
+		ConnectionString: fmt.Sprintf("AccountEndpoint=%s/;AccountKey=%s;", server.URL, testCosmosKey),
+		Database:         "db",
+		Container:        "items",
+		PartitionKey:     "/category",
+		HTTPClient:       server.Client(),
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func TestCosmosOptionsValidate(t *testing.T) {
+	opts := CosmosOptions{ConnectionString: "AccountEndpoint=https://example.documents.azure.com:443/;AccountKey=" + testCosmosKey + ";"}
+	endpoint, key, err := opts.account()
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.documents.azure.com:443", endpoint, "unexpected endpoint")
+	assert.Equal(t, testCosmosKey, key, "expected the key with its padding")
+	assert.ErrorContains(t, opts.Validate(), "database and container are required", "expected the missing container to be reported")
+
+	opts = CosmosOptions{Key: "not base64!", Database: "db", Container: "items"}
+	err = opts.Validate()
+	assert.ErrorContains(t, err, "account endpoint is required", "expected the missing endpoint to be reported")
+
+	opts.Endpoint = "https://example.documents.azure.com"
+	assert.ErrorContains(t, opts.Validate(), "not base64", "expected the invalid key to be reported")
+
+	opts = CosmosOptions{Emulator: true, Database: "db", Container: "items"}
+	endpoint, key, err = opts.account()
+	require.NoError(t, err)
+	assert.Equal(t, []string{EmulatorEndpoint, EmulatorKey}, []string{endpoint, key}, "expected the emulator defaults")
+}
+
+func TestCosmosOptionsLoadEnvWithPrefix(t *testing.T) {
+	t.Setenv("COSMOS_CONTAINER_NAME", "items")
+	t.Setenv("COSMOS_TARGET_CONTAINER_NAME", "vectors")
+	t.Setenv("COSMOS_TARGET_CONNECTION__accountEndpoint", "https://example.documents.azure.com")
+
+	var source, target CosmosOptions
+	require.NoError(t, source.LoadEnv())
+	require.NoError(t, target.LoadEnvWithPrefix("COSMOS_TARGET_"))
+	assert.Equal(t, "items", source.Container, "unexpected source container")
+	assert.Equal(t, "vectors", target.Container, "expected the prefixed variable")
+	assert.Equal(t, "https://example.documents.azure.com", target.Endpoint, "expected the prefixed identity-based connection")
+	assert.True(t, target.HasAccount(), "expected the endpoint to name an account")
+	assert.False(t, source.HasAccount(), "expected no account")
+
+	source.Endpoint = "https://EXAMPLE.documents.azure.com/"
+	assert.False(t, source.SameContainer(target), "expected different containers")
+	target.Container = "items"
+	assert.True(t, source.SameContainer(target), "expected the same container of the same account")
+}
+
+func TestCosmosClientPatchItem(t *testing.T) {
+	server := newCosmosServer(t, map[string]any{"id": "doc 1", "category": "books", "text": "hello"})
+	client := newTestCosmosClient(t, server)
+	ctx := context.Background()
+
+	doc := map[string]any{"id": "doc 1", "category": "books"}
+	partitionKey, err := client.PartitionKey(doc)
+	require.NoError(t, err)
+	assert.Equal(t, "books", partitionKey, "unexpected partition key")
+
+	item, err := client.ReadItem(ctx, "doc 1", partitionKey)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", item.Document["text"], "unexpected document")
+	assert.Equal(t, 10.5, item.RequestCharge, "unexpected request charge")
+
+	operations := []PatchOperation{PatchSet(Path{"vector"}, []float32{1, 2}), PatchSet(Path{"hash"}, "h")}
+	patched, err := client.PatchItem(ctx, "doc 1", "books", operations, &ItemOptions{IfMatch: item.ETag})
+	require.NoError(t, err)
+	assert.Equal(t, []any{1.0, 2.0}, patched.Document["vector"], "expected the vector to be set")
+	assert.NotEqual(t, item.ETag, patched.ETag, "expected a new etag")
+
+	request := server.requests[len(server.requests)-1]
+	assert.Equal(t, `["books"]`, request.Header.Get("x-ms-documentdb-partitionkey"), "unexpected partition key header")
+	assert.Equal(t, http.MethodPatch, request.Method, "unexpected method")
+
+	_, err = client.PatchItem(ctx, "doc 1", "books", operations, &ItemOptions{IfMatch: item.ETag})
+	assert.True(t, IsPreconditionFailed(err), "expected the stale etag to fail the patch: %v", err)
+	status, charge := ErrorStatus(err)
+	assert.Equal(t, http.StatusPreconditionFailed, status, "unexpected status")
+	assert.Equal(t, 1.24, charge, "expected the charge of the failed request")
+
+	_, err = client.ReadItem(ctx, "missing", "books")
+	assert.True(t, IsNotFound(err), "expected the missing document not to be found: %v", err)
+
+	_, err = client.PatchItem(ctx, "doc 1", "books", make([]PatchOperation, MaxPatchOperations*maxBatchOperations+1), nil)
+	assert.ErrorContains(t, err, "at most 1000 operations", "expected the patch to be limited")
+}
+
+func TestCosmosClientPatchItemInBatch(t *testing.T) {
+	server := newCosmosServer(t, map[string]any{"id": "doc-1", "category": "books", "text": "hello"})
+	client := newTestCosmosClient(t, server)
+	ctx := context.Background()
+
+	item, err := client.ReadItem(ctx, "doc-1", "books")
+	require.NoError(t, err)
+
+	var operations []PatchOperation
+	for i := range 2*MaxPatchOperations + 1 {
+		operations = append(operations, PatchSet(Path{fmt.Sprintf("p%d", i)}, i))
+	}
+	patched, err := client.PatchItem(ctx, "doc-1", "books", operations, &ItemOptions{IfMatch: item.ETag})
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, patched.Document["p20"], "expected the last operation to be applied")
+	assert.Equal(t, patched.Document["_etag"], patched.ETag, "expected the etag of the patched document")
+	assert.Equal(t, 21.5, patched.RequestCharge, "expected the charge of the batch")
+	require.Len(t, server.requests, 2, "expected the patches to be sent in a single request")
+
+	// The last patch fails, and the document is left unchanged
+	operations[len(operations)-1] = PatchSet(Path{"text", "nested"}, "x")
+	_, err = client.PatchItem(ctx, "doc-1", "books", operations, &ItemOptions{IfMatch: patched.ETag})
+	status, charge := ErrorStatus(err)
+	assert.Equal(t, http.StatusBadRequest, status, "expected the status of the failed patch: %v", err)
+	assert.Equal(t, 21.5, charge, "expected the charge of the batch")
+
+	_, err = client.PatchItem(ctx, "doc-1", "books", operations, &ItemOptions{IfMatch: item.ETag})
+	assert.True(t, IsPreconditionFailed(err), "expected the stale etag to fail the batch: %v", err)
+
+	current, err := client.ReadItem(ctx, "doc-1", "books")
+	require.NoError(t, err)
+	assert.Equal(t, patched.ETag, current.ETag, "expected the failed batches not to change the document")
+}
+
+func TestCosmosClientAuthenticatesWithToken(t *testing.T) {
+	var auth string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ = url.QueryUnescape(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"doc-1"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	cred := &staticCredential{}
+	client, err := NewCosmosClient(CosmosOptions{Endpoint: server.URL, Database: "db", Container: "items", Credential: cred, HTTPClient: server.Client()})
+	require.NoError(t, err)
+
+	_, err = client.ReadItem(context.Background(), "doc-1", "doc-1")
+	require.NoError(t, err)
+	assert.Equal(t, "type=aad&ver=1.0&sig=test-token", auth, "expected the token to authorize the request")
+}
+
+func TestCosmosClientReplaceItem(t *testing.T) {
+	server := newCosmosServer(t, map[string]any{"id": "doc-1", "category": "books", "text": "hello"})
+	client := newTestCosmosClient(t, server)
+	ctx := context.Background()
+
+	item, err := client.ReadItem(ctx, "doc-1", "books")
+	require.NoError(t, err)
+
+	doc := map[string]any{"id": "doc-1", "category": "books", "text": "hello", "vector": []float32{1}}
+	replaced, err := client.ReplaceItem(ctx, "doc-1", "books", doc, &ItemOptions{IfMatch: item.ETag})
+	require.NoError(t, err)
+	assert.Equal(t, []any{1.0}, replaced.Document["vector"], "expected the document to be replaced")
+	assert.Equal(t, http.MethodPut, server.requests[len(server.requests)-1].Method, "unexpected method")
+
+	_, err = client.ReplaceItem(ctx, "doc-1", "books", doc, &ItemOptions{IfMatch: item.ETag})
+	assert.True(t, IsPreconditionFailed(err), "expected the stale etag to fail the replace: %v", err)
+}
+
+func TestCosmosClientUpsertItem(t *testing.T) {
+	server := newCosmosServer(t)
+	client := newTestCosmosClient(t, server)
+	ctx := context.Background()
+
+	doc := map[string]any{"id": "docs", "category": "books", "text": "hello"}
+	created, err := client.UpsertItem(ctx, "books", doc, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, created.StatusCode, "expected the document to be created")
+	assert.Equal(t, 7.0, created.RequestCharge, "unexpected request charge")
+
+	doc["text"] = "hello again"
+	replaced, err := client.UpsertItem(ctx, "books", doc, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, replaced.StatusCode, "expected the document to be replaced")
+
+	// A document whose id is a resource type is addressed as a document, not as a feed
+	item, err := client.ReadItem(ctx, "docs", "books")
+	require.NoError(t, err)
+	assert.Equal(t, "hello again", item.Document["text"], "unexpected document")
+}
+
+// TestCosmosClientWithEmulator runs against the Cosmos DB emulator at COSMOS_EMULATOR_ENDPOINT (e.g.
+// https://localhost:8081), if it is set. It creates the database and the container it uses if they do not exist.
+func TestCosmosClientWithEmulator(t *testing.T) {
+	endpoint := os.Getenv("COSMOS_EMULATOR_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("COSMOS_EMULATOR_ENDPOINT is not set")
+	}
+
+	opts := CosmosOptions{Endpoint: endpoint, Emulator: true, Database: "embeddings-test", Container: "items"}
+	account, err := newAccountClient(opts)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = account.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: opts.Database}, nil)
+	if status, _ := ErrorStatus(err); status != http.StatusConflict {
+		require.NoError(t, err, "failed to create the database")
+	}
+	database, err := account.NewDatabase(opts.Database)
+	require.NoError(t, err)
+	container := azcosmos.ContainerProperties{ID: opts.Container, PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{Paths: []string{"/id"}}}
+	_, err = database.CreateContainer(ctx, container, nil)
+	if status, _ := ErrorStatus(err); status != http.StatusConflict {
+		require.NoError(t, err, "failed to create the container")
+	}
+
+	client, err := NewCosmosClient(opts)
+	require.NoError(t, err)
+
+	id := fmt.Sprintf("doc-%d", time.Now().UnixNano())
+	upserted, err := client.UpsertItem(ctx, id, map[string]any{"id": id, "text": "hello"}, nil)
+	require.NoError(t, err)
+	assert.Positive(t, upserted.RequestCharge, "expected the request charge to be reported")
+
+	patched, err := client.PatchItem(ctx, id, id, []PatchOperation{PatchSet(Path{"vector"}, []float32{1, 2})}, &ItemOptions{IfMatch: upserted.ETag})
+	require.NoError(t, err)
+	assert.Equal(t, []any{1.0, 2.0}, patched.Document["vector"], "expected the vector to be set")
+
+	_, err = client.ReplaceItem(ctx, id, id, map[string]any{"id": id, "text": "stale"}, &ItemOptions{IfMatch: upserted.ETag})
+	assert.True(t, IsPreconditionFailed(err), "expected the stale etag to fail the replace: %v", err)
+}
+
+func TestCosmosPartitionKey(t *testing.T) {
+	tests := map[string]struct {
+		value    any
+		expected azcosmos.PartitionKey
+	}{
+		"string": {value: "books", expected: azcosmos.NewPartitionKeyString("books")},
+		"number": {value: 42.0, expected: azcosmos.NewPartitionKeyNumber(42)},
+		"bool":   {value: true, expected: azcosmos.NewPartitionKeyBool(true)},
+		"none":   {value: nil, expected: azcosmos.NullPartitionKey},
+	}
+	for name, tt := range tests {
+		pk, err := cosmosPartitionKey(tt.value)
+		require.NoError(t, err, "unexpected error for %s", name)
+		assert.Equal(t, tt.expected, pk, "unexpected partition key for %s", name)
+	}
+
+	_, err := cosmosPartitionKey(map[string]any{"a": 1})
+	assert.ErrorContains(t, err, "must be a string, a number or a boolean", "expected an object to be rejected")
+
+	// A null partition key is addressed as null, but a missing one is undefined, which differs from null
+	client := &CosmosClient{partitionKey: Path{"category"}}
+	value, err := client.PartitionKey(map[string]any{"id": "doc-1", "category": nil})
+	require.NoError(t, err)
+	assert.Nil(t, value, "expected the null partition key")
+	_, err = client.PartitionKey(map[string]any{"id": "doc-1"})
+	assert.ErrorContains(t, err, "document has no partition key /category", "expected the missing partition key to be rejected")
+}
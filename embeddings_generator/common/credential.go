@@ -0,0 +1,222 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Authentication methods for Azure OpenAI.
+const (
+	// AuthAPIKey authenticates with the API key of the Azure OpenAI resource.
+	AuthAPIKey = "api-key"
+	// AuthManagedIdentity authenticates with the system-assigned, or a user-assigned, managed identity.
+	AuthManagedIdentity = "managed-identity"
+	// AuthWorkloadIdentity authenticates with a Kubernetes workload identity (federated service account token).
+	AuthWorkloadIdentity = "workload-identity"
+	// AuthEnvironment authenticates with a service principal configured by AZURE_* environment variables.
+	AuthEnvironment = "environment"
+	// AuthAzureCLI authenticates as the user signed in to the Azure CLI.
+	AuthAzureCLI = "azure-cli"
+	// AuthDefault authenticates with DefaultAzureCredential, which tries several methods itself.
+	// It selects a user-assigned managed identity with AZURE_CLIENT_ID, not ManagedIdentityClientID.
+	AuthDefault = "default"
+)
+
+var authMethods = []string{AuthAPIKey, AuthManagedIdentity, AuthWorkloadIdentity, AuthEnvironment, AuthAzureCLI, AuthDefault}
+
+// AuthOptions selects how requests to Azure OpenAI are authenticated.
+type AuthOptions struct {
+	// Methods are tried in order until one of them acquires a token; the first that succeeds is used from then on.
+	// AuthAPIKey cannot be combined with other methods. Without methods, AuthAPIKey is used if an API key is
+	// configured, and AuthDefault otherwise.
+	Methods []string `json:"methods,omitempty"`
+	// ManagedIdentityClientID selects a user-assigned managed identity. The system-assigned identity is used if it is empty.
+	ManagedIdentityClientID string `json:"managedIdentityClientId,omitempty"`
+	// TenantID, ClientID and TokenFile configure workload identity, so that the embedder can use another identity
+	// than the Cosmos DB client. Unset values are read from the AZURE_TENANT_ID, AZURE_CLIENT_ID and
+	// AZURE_FEDERATED_TOKEN_FILE variables set by the workload identity webhook.
+	TenantID  string `json:"tenantId,omitempty"`
+	ClientID  string `json:"clientId,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// LoadEnv overrides the options with the EMBEDDING_AUTH (a comma separated list of methods),
+// EMBEDDING_MANAGED_IDENTITY_CLIENT_ID, EMBEDDING_WORKLOAD_IDENTITY_TENANT_ID, EMBEDDING_WORKLOAD_IDENTITY_CLIENT_ID
+// and EMBEDDING_WORKLOAD_IDENTITY_TOKEN_FILE environment variables that are set.
+func (o *AuthOptions) LoadEnv() error {
+	if value := StringFromEnv("EMBEDDING_AUTH", ""); value != "" {
+		o.Methods = nil
+		for _, method := range strings.Split(value, ",") {
+			if method = strings.ToLower(strings.TrimSpace(method)); method != "" {
+				o.Methods = append(o.Methods, method)
+			}
+		}
+	}
+	o.ManagedIdentityClientID = StringFromEnv("EMBEDDING_MANAGED_IDENTITY_CLIENT_ID", o.ManagedIdentityClientID)
+	o.TenantID = StringFromEnv("EMBEDDING_WORKLOAD_IDENTITY_TENANT_ID", o.TenantID)
+	o.ClientID = StringFromEnv("EMBEDDING_WORKLOAD_IDENTITY_CLIENT_ID", o.ClientID)
+	o.TokenFile = StringFromEnv("EMBEDDING_WORKLOAD_IDENTITY_TOKEN_FILE", o.TokenFile)
+	return nil
+}
+
+// ResolveMethods returns the authentication methods that are used, given the configured API key.
+func (o AuthOptions) ResolveMethods(apiKey string) ([]string, error) {
+	methods := o.Methods
+	if len(methods) == 0 {
+		if apiKey != "" {
+			return []string{AuthAPIKey}, nil
+		}
+		return []string{AuthDefault}, nil
+	}
+
+	for _, method := range methods {
+		if !slices.Contains(authMethods, method) {
+			return nil, fmt.Errorf("unknown authentication method %q: expected one of %s", method, strings.Join(authMethods, ", "))
+		}
+	}
+
+	if slices.Contains(methods, AuthAPIKey) {
+		if len(methods) > 1 {
+			return nil, fmt.Errorf("authentication method %s cannot be combined with other methods", AuthAPIKey)
+		}
+		if apiKey == "" {
+			return nil, fmt.Errorf("authentication method %s requires an API key", AuthAPIKey)
+		}
+	}
+
+	return methods, nil
+}
+
+// Describe returns a description of the authentication methods for diagnostics, without secrets.
+func (o AuthOptions) Describe(apiKey string) string {
+	methods, err := o.ResolveMethods(apiKey)
+	if err != nil {
+		return fmt.Sprintf("invalid authentication options: %v", err)
+	}
+
+	descriptions := make([]string, len(methods))
+	for i, method := range methods {
+		descriptions[i] = o.describe(method)
+	}
+	return strings.Join(descriptions, ", then ")
+}
+
+// describe returns a description of one authentication method.
+func (o AuthOptions) describe(method string) string {
+	switch {
+	case method == AuthManagedIdentity && o.ManagedIdentityClientID != "":
+		return fmt.Sprintf("%s (client ID %s)", method, o.ManagedIdentityClientID)
+	case method == AuthManagedIdentity:
+		return fmt.Sprintf("%s (system-assigned)", method)
+	case method == AuthWorkloadIdentity && o.ClientID != "":
+		return fmt.Sprintf("%s (client ID %s)", method, o.ClientID)
+	default:
+		return method
+	}
+}
+
+// NewCredential creates the credential for the authentication methods other than AuthAPIKey.
+// When the credential acquires its first token, the method that succeeded is logged, along with the
+// reasons the methods tried before it failed.
+func NewCredential(opts AuthOptions) (azcore.TokenCredential, error) {
+	methods, err := opts.ResolveMethods("")
+	if err != nil {
+		return nil, err
+	}
+
+	chain := &credentialChain{}
+	for _, method := range methods {
+		var cred azcore.TokenCredential
+		var err error
+
+		switch method {
+		case AuthManagedIdentity:
+			var id azidentity.ManagedIDKind
+			if opts.ManagedIdentityClientID != "" {
+				id = azidentity.ClientID(opts.ManagedIdentityClientID)
+			}
+			cred, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{ID: id})
+		case AuthWorkloadIdentity:
+			cred, err = azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+				TenantID:      opts.TenantID,
+				ClientID:      opts.ClientID,
+				TokenFilePath: opts.TokenFile,
+			})
+		case AuthEnvironment:
+			cred, err = azidentity.NewEnvironmentCredential(nil)
+		case AuthAzureCLI:
+			cred, err = azidentity.NewAzureCLICredential(nil)
+		case AuthDefault:
+			cred, err = azidentity.NewDefaultAzureCredential(nil)
+		default:
+			err = fmt.Errorf("authentication method %s does not use a token credential", method)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s credential: %w", method, err)
+		}
+		chain.sources = append(chain.sources, credentialSource{name: opts.describe(method), cred: cred})
+	}
+
+	return chain, nil
+}
+
+// credentialSource is a credential of a credentialChain, along with its description.
+type credentialSource struct {
+	name string
+	cred azcore.TokenCredential
+}
+
+// credentialChain tries its credentials in order, and keeps using the first one that acquires a token.
+// Unlike azidentity.ChainedTokenCredential, it reports which credential was selected.
+type credentialChain struct {
+	sources []credentialSource
+
+	mu       sync.Mutex
+	selected *credentialSource
+}
+
+// GetToken acquires a token from the selected credential, or selects the first credential that acquires a token.
+func (c *credentialChain) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	selected := c.selected
+	c.mu.Unlock()
+
+	if selected != nil {
+		return selected.cred.GetToken(ctx, options)
+	}
+
+	var errs []error
+	for i := range c.sources {
+		source := &c.sources[i]
+		token, err := source.cred.GetToken(ctx, options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+			continue
+		}
+
+		c.mu.Lock()
+		if c.selected == nil {
+			c.selected = source
+			if len(errs) > 0 {
+				log.Printf("Authenticated to Azure OpenAI with %s, after other methods failed: %v", source.name, errors.Join(errs...))
+			} else {
+				log.Printf("Authenticated to Azure OpenAI with %s", source.name)
+			}
+		}
+		c.mu.Unlock()
+
+		return token, nil
+	}
+
+	return azcore.AccessToken{}, fmt.Errorf("no authentication method could acquire a token for Azure OpenAI: %w", errors.Join(errs...))
+}
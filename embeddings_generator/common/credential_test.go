@@ -0,0 +1,121 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingCredential is a token credential that never acquires a token.
+type failingCredential struct {
+	calls int
+}
+
+func (c *failingCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	return azcore.AccessToken{}, errors.New("no identity available")
+}
+
+func TestResolveAuthMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		apiKey  string
+		want    []string
+		wantErr string
+	}{
+		{name: "default without key", want: []string{AuthDefault}},
+		{name: "api key when key is set", apiKey: "key", want: []string{AuthAPIKey}},
+		{name: "chain", methods: []string{AuthWorkloadIdentity, AuthManagedIdentity}, want: []string{AuthWorkloadIdentity, AuthManagedIdentity}},
+		{name: "chain ignores key", methods: []string{AuthManagedIdentity}, apiKey: "key", want: []string{AuthManagedIdentity}},
+		{name: "unknown method", methods: []string{"password"}, wantErr: "unknown authentication method"},
+		{name: "api key without key", methods: []string{AuthAPIKey}, wantErr: "requires an API key"},
+		{name: "api key in chain", methods: []string{AuthAPIKey, AuthDefault}, apiKey: "key", wantErr: "cannot be combined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods, err := AuthOptions{Methods: tt.methods}.ResolveMethods(tt.apiKey)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr, "expected an error")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, methods, "unexpected methods")
+		})
+	}
+}
+
+func TestAuthOptionsLoadEnv(t *testing.T) {
+	t.Setenv("EMBEDDING_AUTH", " Managed-Identity, azure-cli ,")
+	t.Setenv("EMBEDDING_MANAGED_IDENTITY_CLIENT_ID", "client-id")
+	t.Setenv("EMBEDDING_WORKLOAD_IDENTITY_TENANT_ID", "embedder-tenant")
+	t.Setenv("EMBEDDING_WORKLOAD_IDENTITY_CLIENT_ID", "embedder-client")
+	t.Setenv("EMBEDDING_WORKLOAD_IDENTITY_TOKEN_FILE", "/var/run/secrets/embedder/token")
+	t.Setenv("AZURE_CLIENT_ID", "cosmos-client")
+
+	opts := AuthOptions{Methods: []string{AuthDefault}, TenantID: "configured-tenant"}
+	require.NoError(t, opts.LoadEnv())
+
+	assert.Equal(t, []string{AuthManagedIdentity, AuthAzureCLI}, opts.Methods, "unexpected methods")
+	assert.Equal(t, "managed-identity (client ID client-id), then azure-cli", opts.Describe(""), "unexpected description")
+	assert.Equal(t, AuthOptions{
+		Methods:                 []string{AuthManagedIdentity, AuthAzureCLI},
+		ManagedIdentityClientID: "client-id",
+		TenantID:                "embedder-tenant",
+		ClientID:                "embedder-client",
+		TokenFile:               "/var/run/secrets/embedder/token",
+	}, opts, "expected the workload identity of the embedder rather than the AZURE_* variables")
+
+	opts.Methods = []string{AuthWorkloadIdentity}
+	assert.Equal(t, "workload-identity (client ID embedder-client)", opts.Describe(""), "unexpected description")
+}
+
+func TestCredentialChainSelectsFirstWorkingCredential(t *testing.T) {
+	failing := &failingCredential{}
+	working := &staticCredential{}
+	chain := &credentialChain{sources: []credentialSource{{name: "failing", cred: failing}, {name: "working", cred: working}}}
+
+	for range 3 {
+		token, err := chain.GetToken(context.Background(), policy.TokenRequestOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "test-token", token.Token, "unexpected token")
+	}
+
+	assert.Equal(t, 1, failing.calls, "expected the failing credential to be tried once")
+	assert.Equal(t, int32(3), working.calls.Load(), "expected the working credential to be kept")
+}
+
+func TestCredentialChainReportsAllFailures(t *testing.T) {
+	chain := &credentialChain{sources: []credentialSource{{name: "first", cred: &failingCredential{}}, {name: "second", cred: &failingCredential{}}}}
+
+	_, err := chain.GetToken(context.Background(), policy.TokenRequestOptions{})
+	assert.ErrorContains(t, err, "first: no identity available", "expected the error of the first credential")
+	assert.ErrorContains(t, err, "second: no identity available", "expected the error of the second credential")
+}
+
+func TestAzureOpenAIEmbedderWithAPIKey(t *testing.T) {
+	var requests []*http.Request
+	server := embeddingsServer(t, 0, &requests)
+
+	embedder, err := NewAzureOpenAIEmbedder(AzureOpenAIOptions{
+		Endpoint:   server.URL,
+		Deployment: "embeddings",
+		APIKey:     "secret",
+		HTTPClient: server.Client(),
+	})
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(context.Background(), "text")
+	require.NoError(t, err)
+
+	require.Len(t, requests, 1, "unexpected number of requests")
+	assert.Equal(t, "secret", requests[0].Header.Get("api-key"), "expected the API key header")
+	assert.Empty(t, requests[0].Header.Get("Authorization"), "expected no bearer token")
+}
@@ -5,63 +5,223 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
 )
 
-var client *azopenai.Client
+// Embedder generates vector embeddings for text.
+type Embedder interface {
+	// Embed generates the embedding for a single input text.
+	Embed(ctx context.Context, input string) ([]float32, error)
+	// EmbedBatch generates the embeddings for several input texts in a single request.
+	// The embeddings are returned in the same order as the inputs.
+	EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error)
+	// Model returns the name of the model (or Azure OpenAI deployment) that generates the embeddings.
+	Model() string
+	// Dimensions returns the number of dimensions of the embeddings, or 0 if it is not known.
+	Dimensions() int
+}
+
+// Supported embedding providers.
+const (
+	ProviderAzureOpenAI = "azure-openai"
+	ProviderOpenAI      = "openai"
+	ProviderOllama      = "ollama"
+	ProviderFake        = "fake"
+)
+
+// EmbedderOptions selects and configures the embedding provider.
+type EmbedderOptions struct {
+	// Provider is one of ProviderAzureOpenAI (default), ProviderOpenAI, ProviderOllama or ProviderFake.
+	Provider string `json:"provider"`
+	// Model is the model name, or the deployment name for Azure OpenAI.
+	Model string `json:"model,omitempty"`
+	// Dimensions is the number of dimensions requested from models that support it. Zero uses the model default.
+	Dimensions int `json:"dimensions,omitempty"`
+	// Endpoint is the base URL of the provider.
+	Endpoint string `json:"endpoint,omitempty"`
+	// APIKey authenticates requests to the public OpenAI API, and to Azure OpenAI with AuthAPIKey.
+	APIKey string `json:"apiKey,omitempty"`
+	// Auth selects how requests to Azure OpenAI are authenticated.
+	Auth AuthOptions `json:"auth,omitempty"`
+	// Timeout limits the duration of each embedding request. Zero leaves it to the invocation deadline.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Credential authenticates requests to Azure OpenAI. It takes precedence over Auth.
+	Credential azcore.TokenCredential `json:"-"`
+	// HTTPClient sends the requests of the Azure OpenAI, OpenAI and Ollama embedders. A default client is used if it is nil.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// LoadEnv overrides the options with the EMBEDDING_PROVIDER, EMBEDDING_MODEL, EMBEDDING_DIMENSIONS,
+// EMBEDDING_ENDPOINT, EMBEDDING_API_KEY and EMBEDDING_TIMEOUT environment variables, and the
+// authentication variables described at AuthOptions.LoadEnv, that are set. For Azure OpenAI,
+// OPENAI_ENDPOINT and OPENAI_DEPLOYMENT_NAME are used when neither the generic variables nor the options are set.
+func (o *EmbedderOptions) LoadEnv() error {
+	o.Provider = strings.ToLower(StringFromEnv("EMBEDDING_PROVIDER", o.Provider))
+	o.Model = StringFromEnv("EMBEDDING_MODEL", o.Model)
+	o.Endpoint = StringFromEnv("EMBEDDING_ENDPOINT", o.Endpoint)
+	o.APIKey = StringFromEnv("EMBEDDING_API_KEY", o.APIKey)
+
+	if o.Provider == "" {
+		o.Provider = ProviderAzureOpenAI
+	}
+
+	if o.Provider == ProviderAzureOpenAI {
+		if o.Model == "" {
+			o.Model = os.Getenv("OPENAI_DEPLOYMENT_NAME")
+		}
+		if o.Endpoint == "" {
+			o.Endpoint = os.Getenv("OPENAI_ENDPOINT")
+		}
+	}
+
+	if err := o.Auth.LoadEnv(); err != nil {
+		return err
+	}
 
-func init() {
 	var err error
-	client, err = getOpenAIClient()
-	if err != nil {
-		log.Fatalf("Failed to create OpenAI client: %v", err)
+	if o.Dimensions, err = IntFromEnv("EMBEDDING_DIMENSIONS", o.Dimensions); err != nil {
+		return err
 	}
+	timeout, err := DurationFromEnv("EMBEDDING_TIMEOUT", time.Duration(o.Timeout))
+	o.Timeout = Duration(timeout)
+	return err
+}
+
+// NewEmbedder creates the Embedder for the configured provider.
+func NewEmbedder(opts EmbedderOptions) (Embedder, error) {
+	switch opts.Provider {
+	case "", ProviderAzureOpenAI:
+		return newAzureOpenAIEmbedder(opts)
+	case ProviderOpenAI:
+		return newOpenAIEmbedder(opts)
+	case ProviderOllama:
+		return newOllamaEmbedder(opts)
+	case ProviderFake:
+		return NewFakeEmbedder(opts.Model, opts.Dimensions), nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", opts.Provider)
+	}
+}
+
+// knownDimensions holds the default number of dimensions of well known embedding models.
+var knownDimensions = map[string]int{
+	"text-embedding-ada-002": 1536,
+	"text-embedding-3-small": 1536,
+	"text-embedding-3-large": 3072,
+	"nomic-embed-text":       768,
+	"mxbai-embed-large":      1024,
+	"all-minilm":             384,
 }
 
-// CreateEmbedding generates an embedding for the given input text using Azure OpenAI.
-func CreateEmbedding(input string) ([]float32, error) {
-	modelDeploymentID := os.Getenv("OPENAI_DEPLOYMENT_NAME")
-	if modelDeploymentID == "" {
-		return nil, errors.New("OPENAI_DEPLOYMENT_NAME environment variable not set")
+// dimensionsFor returns the configured dimensions, or the default dimensions of a well known model.
+func dimensionsFor(model string, configured int) int {
+	if configured > 0 {
+		return configured
 	}
+	return knownDimensions[model]
+}
+
+// EmbeddingResult holds the embedding generated for one input of a batch, or the error that prevented it.
+type EmbeddingResult struct {
+	Embedding []float32
+	Err       error
+}
+
+// EmbedAll generates embeddings for the given input texts with the embedder.
+// The inputs are grouped into as few requests as the batch options allow, and the results are
+// returned in the same order as the inputs. If a request is rejected as invalid, its inputs are
+// sent again one at a time, so that a single bad input does not fail the other inputs of the request.
+// Up to opts.Concurrency requests are sent at the same time; the lines they log to the invocation logger
+// are kept together per request, in request order. Each request, including its retries, is limited by
+// the batch timeout. Once ctx is done, the inputs that have not been sent yet fail with the error of the context.
+func EmbedAll(ctx context.Context, embedder Embedder, inputs []string, opts BatchOptions) []EmbeddingResult {
+	results := make([]EmbeddingResult, len(inputs))
 
-	resp, err := client.GetEmbeddings(context.Background(), azopenai.EmbeddingsOptions{
-		Input:          []string{input},
-		DeploymentName: &modelDeploymentID,
-	}, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	batches := opts.split(inputs)
+	logger := customhandler.LoggerFromContext(ctx)
+	loggers := make([]*customhandler.Logger, len(batches))
+	for i := range loggers {
+		loggers[i] = logger.Child()
 	}
 
-	if len(resp.Data) == 0 {
-		return nil, errors.New("no embedding data received from OpenAI")
+	ForEach(len(batches), opts.Concurrency, func(i int) {
+		if err := ctx.Err(); err != nil {
+			for _, index := range batches[i] {
+				results[index] = EmbeddingResult{Err: fmt.Errorf("embedding request not sent: %w", context.Cause(ctx))}
+			}
+			return
+		}
+
+		embedBatch(customhandler.WithLogger(ctx, loggers[i]), embedder, inputs, batches[i], opts, results)
+	})
+
+	for _, child := range loggers {
+		logger.Flush(child)
 	}
 
-	return resp.Data[0].Embedding, nil
+	return results
 }
 
-// getOpenAIClient creates and returns an Azure OpenAI client using default Azure credentials.
-func getOpenAIClient() (*azopenai.Client, error) {
-	azureOpenAIEndpoint := os.Getenv("OPENAI_ENDPOINT")
-	modelDeploymentID := os.Getenv("OPENAI_DEPLOYMENT_NAME")
+// embedBatch generates the embeddings of the inputs of one batch and stores them in results.
+func embedBatch(ctx context.Context, embedder Embedder, inputs []string, batch []int, opts BatchOptions, results []EmbeddingResult) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.Timeout))
+		defer cancel()
+	}
 
-	if modelDeploymentID == "" || azureOpenAIEndpoint == "" {
-		return nil, errors.New("required environment variables OPENAI_ENDPOINT and OPENAI_DEPLOYMENT_NAME must be set")
+	batchInputs := make([]string, len(batch))
+	for i, index := range batch {
+		batchInputs[i] = inputs[index]
 	}
 
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create default Azure credential: %w", err)
+	embeddings, err := embedder.EmbedBatch(ctx, batchInputs)
+	if err == nil && len(embeddings) != len(batch) {
+		err = fmt.Errorf("received %d embeddings for %d inputs", len(embeddings), len(batch))
 	}
 
-	client, err := azopenai.NewClient(azureOpenAIEndpoint, cred, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OpenAI client: %w", err)
+	if err != nil && len(batch) > 1 && isBadRequest(err) {
+		for _, index := range batch {
+			embedding, err := embedder.Embed(ctx, inputs[index])
+			results[index] = EmbeddingResult{Embedding: embedding, Err: err}
+		}
+		return
+	}
+
+	for i, index := range batch {
+		if err != nil {
+			results[index] = EmbeddingResult{Err: err}
+			continue
+		}
+		results[index] = EmbeddingResult{Embedding: embeddings[i]}
+	}
+}
+
+// HTTPError is returned by the embedders that call a plain HTTP API when the response has an error status.
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// isBadRequest reports whether err was caused by the service rejecting the request as invalid.
+func isBadRequest(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusBadRequest
 	}
 
-	return client, nil
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusBadRequest
 }
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubEmbedder records the requests it receives and embeds each input as its length.
+// Inputs containing "bad" make a batch request fail with 400, and inputs containing "slow" block until the context is done.
+type stubEmbedder struct {
+	requests [][]string
+}
+
+func (e *stubEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+func (e *stubEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.requests = append(e.requests, inputs)
+
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		switch {
+		case strings.Contains(input, "slow"):
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case strings.Contains(input, "bad"):
+			return nil, &HTTPError{StatusCode: http.StatusBadRequest, Body: "invalid input"}
+		}
+		embeddings[i] = []float32{float32(len(input))}
+	}
+	return embeddings, nil
+}
+
+func (e *stubEmbedder) Model() string   { return "stub" }
+func (e *stubEmbedder) Dimensions() int { return 1 }
+
+func TestEmbedAllSplitsIntoBatches(t *testing.T) {
+	embedder := &stubEmbedder{}
+	inputs := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+
+	results := EmbedAll(context.Background(), embedder, inputs, BatchOptions{MaxInputs: 2})
+
+	assert.Equal(t, [][]string{{"a", "bb"}, {"ccc", "dddd"}, {"eeeee"}}, embedder.requests, "unexpected requests")
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		assert.Equal(t, []float32{float32(len(inputs[i]))}, result.Embedding, "unexpected embedding for input %d", i)
+	}
+}
+
+func TestEmbedAllRetriesInvalidBatchOneByOne(t *testing.T) {
+	embedder := &stubEmbedder{}
+
+	results := EmbedAll(context.Background(), embedder, []string{"good", "bad", "fine"}, DefaultBatchOptions())
+
+	assert.Len(t, embedder.requests, 4, "expected the batch and one request per input")
+	assert.NoError(t, results[0].Err, "expected the first input to succeed")
+	assert.True(t, isBadRequest(results[1].Err), "expected the bad input to fail")
+	assert.NoError(t, results[2].Err, "expected the last input to succeed")
+}
+
+func TestEmbedAllBatchTimeout(t *testing.T) {
+	embedder := &stubEmbedder{}
+	opts := BatchOptions{MaxInputs: 1, Timeout: Duration(20 * time.Millisecond)}
+
+	results := EmbedAll(context.Background(), embedder, []string{"slow", "fast"}, opts)
+
+	assert.ErrorIs(t, results[0].Err, context.DeadlineExceeded, "expected the slow batch to time out")
+	assert.NoError(t, results[1].Err, "expected the next batch to get its own deadline")
+}
+
+func TestEmbedAllStopsWhenContextIsDone(t *testing.T) {
+	embedder := &stubEmbedder{}
+	cause := errors.New("invocation deadline exceeded")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+
+	results := EmbedAll(ctx, embedder, []string{"a", "b"}, BatchOptions{MaxInputs: 1})
+
+	assert.Empty(t, embedder.requests, "expected no requests")
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, cause, "expected the cause of the context")
+	}
+}
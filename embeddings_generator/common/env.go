@@ -0,0 +1,87 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// StringFromEnv returns the value of the environment variable, or def if it is not set.
+func StringFromEnv(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// IntFromEnv returns the integer value of the environment variable, or def if it is not set.
+func IntFromEnv(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return def, fmt.Errorf("invalid value %q for %s: must be a non-negative integer", value, name)
+	}
+
+	return n, nil
+}
+
+// DurationFromEnv returns the duration value (e.g. "500ms", "2s") of the environment variable, or def if it is not set.
+func DurationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return def, fmt.Errorf("invalid value %q for %s: must be a non-negative duration such as 500ms or 2s", value, name)
+	}
+
+	return d, nil
+}
+
+// BoolFromEnv returns the boolean value (e.g. "true", "false", "1" or "0") of the environment variable, or def if
+// it is not set.
+func BoolFromEnv(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid value %q for %s: must be true or false", value, name)
+	}
+
+	return b, nil
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string such as "500ms" or "2s".
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string such as "500ms" or "2s".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid duration %q: must be a non-negative duration such as 500ms or 2s", value)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
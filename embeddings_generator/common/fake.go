@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	defaultFakeModel      = "fake"
+	defaultFakeDimensions = 1536
+)
+
+// FakeEmbedder is a deterministic Embedder that derives unit length vectors from the SHA-256 hash of the input.
+// It does not call any service, which makes it useful for local development and tests.
+type FakeEmbedder struct {
+	model      string
+	dimensions int
+}
+
+// NewFakeEmbedder creates a FakeEmbedder. Empty or zero values select the defaults.
+func NewFakeEmbedder(model string, dimensions int) *FakeEmbedder {
+	if model == "" {
+		model = defaultFakeModel
+	}
+	if dimensions <= 0 {
+		dimensions = defaultFakeDimensions
+	}
+
+	return &FakeEmbedder{model: model, dimensions: dimensions}
+}
+
+// Embed returns the embedding for the input. The same input always results in the same embedding.
+func (e *FakeEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	embedding := make([]float32, e.dimensions)
+	seed := sha256.Sum256([]byte(e.model + "\x00" + input))
+
+	var norm float64
+	for i := range embedding {
+		// Each block of the vector is derived from the hash of the seed and the block number
+		if i%8 == 0 {
+			var block [4]byte
+			binary.BigEndian.PutUint32(block[:], uint32(i/8))
+			seed = sha256.Sum256(append(seed[:], block[:]...))
+		}
+
+		value := float64(binary.BigEndian.Uint32(seed[(i%8)*4:]))/math.MaxUint32*2 - 1
+		embedding[i] = float32(value)
+		norm += value * value
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range embedding {
+		embedding[i] = float32(float64(embedding[i]) / norm)
+	}
+
+	return embedding, nil
+}
+
+// EmbedBatch returns the embeddings for the inputs in input order.
+func (e *FakeEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embedding, err := e.Embed(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[i] = embedding
+	}
+
+	return embeddings, nil
+}
+
+// Model returns the model name the fake embedder was created with.
+func (e *FakeEmbedder) Model() string {
+	return e.model
+}
+
+// Dimensions returns the number of dimensions of the generated embeddings.
+func (e *FakeEmbedder) Dimensions() int {
+	return e.dimensions
+}
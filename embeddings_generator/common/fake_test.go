@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeEmbedder(t *testing.T) {
+	embedder := NewFakeEmbedder("", 0)
+	assert.Equal(t, defaultFakeModel, embedder.Model(), "expected the default model")
+	assert.Equal(t, defaultFakeDimensions, embedder.Dimensions(), "expected the default dimensions")
+
+	embedder = NewFakeEmbedder("other", 12)
+	embeddings, err := embedder.EmbedBatch(context.Background(), []string{"first", "second", "first"})
+	require.NoError(t, err)
+	require.Len(t, embeddings, 3, "expected an embedding per input")
+
+	for _, embedding := range embeddings {
+		require.Len(t, embedding, 12, "unexpected dimensions")
+		var norm float64
+		for _, value := range embedding {
+			norm += float64(value) * float64(value)
+		}
+		assert.InDelta(t, 1, math.Sqrt(norm), 1e-6, "expected a unit length vector")
+	}
+	assert.Equal(t, embeddings[0], embeddings[2], "expected the same embedding for the same input")
+	assert.NotEqual(t, embeddings[0], embeddings[1], "expected different embeddings for different inputs")
+
+	embedding, err := NewFakeEmbedder("fake", 12).Embed(context.Background(), "first")
+	require.NoError(t, err)
+	assert.NotEqual(t, embeddings[0], embedding, "expected the embedding to depend on the model")
+}
+
+func TestFakeEmbedderStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewFakeEmbedder("", 4).EmbedBatch(ctx, []string{"text"})
+	assert.ErrorIs(t, err, context.Canceled, "expected the cancellation to be reported")
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOllamaEndpoint = "http://localhost:11434"
+	defaultOllamaModel    = "nomic-embed-text"
+)
+
+// ollamaEmbedder generates embeddings with the /api/embed endpoint of an Ollama (or compatible) server.
+type ollamaEmbedder struct {
+	httpClient *http.Client
+	endpoint   string
+	model      string
+	dimensions int
+	timeout    time.Duration
+}
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// newOllamaEmbedder creates an Embedder that calls a local Ollama-style HTTP endpoint.
+func newOllamaEmbedder(opts EmbedderOptions) (Embedder, error) {
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultOllamaEndpoint
+	}
+	if opts.Model == "" {
+		opts.Model = defaultOllamaModel
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &ollamaEmbedder{
+		httpClient: httpClient,
+		endpoint:   strings.TrimSuffix(opts.Endpoint, "/"),
+		model:      opts.Model,
+		dimensions: opts.Dimensions,
+		timeout:    time.Duration(opts.Timeout),
+	}, nil
+}
+
+// Embed generates an embedding for the given input text.
+func (e *ollamaEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings[0], nil
+}
+
+// EmbedBatch sends a single embed request for the inputs and returns the embeddings in input order.
+func (e *ollamaEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	body, err := json.Marshal(ollamaEmbedRequest{Model: e.model, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
+	}
+
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+"/api/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embed request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embed response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to generate embedding: %w", &HTTPError{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(respBody)})
+	}
+
+	var embedResp ollamaEmbedResponse
+	if err := json.Unmarshal(respBody, &embedResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal embed response: %w", err)
+	}
+
+	if len(embedResp.Embeddings) != len(inputs) {
+		return nil, errors.New("number of embeddings received from Ollama does not match the number of inputs")
+	}
+	// Ollama has no dimensions parameter, so the embeddings must already have the dimensions reported to the callers
+	if dimensions := e.Dimensions(); dimensions > 0 {
+		for i, embedding := range embedResp.Embeddings {
+			if len(embedding) != dimensions {
+				return nil, fmt.Errorf("embedding %d received from Ollama has %d dimensions instead of %d: set the dimensions of model %s to %d",
+					i, len(embedding), dimensions, e.model, len(embedding))
+			}
+		}
+	}
+
+	return embedResp.Embeddings, nil
+}
+
+// Model returns the Ollama model name.
+func (e *ollamaEmbedder) Model() string {
+	return e.model
+}
+
+// Dimensions returns the configured dimensions, or the default dimensions of well known models. They are not sent
+// to Ollama, but the embeddings it returns are checked against them.
+func (e *ollamaEmbedder) Dimensions() int {
+	return dimensionsFor(e.model, e.dimensions)
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ollamaServer returns a server that records the embed requests and answers them with handler.
+func ollamaServer(t *testing.T, requests *[]ollamaEmbedRequest, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/embed" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+
+		var body ollamaEmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, body)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOllamaEmbedder(t *testing.T) {
+	var requests []ollamaEmbedRequest
+	server := ollamaServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"model": "nomic-embed-text", "embeddings": [][]float32{{1, 2}, {3, 4}}})
+	})
+
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL + "/"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultOllamaModel, embedder.Model(), "expected the default model")
+	assert.Equal(t, 768, embedder.Dimensions(), "expected the dimensions of the default model")
+
+	embedder, err = NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL + "/", Dimensions: 2})
+	require.NoError(t, err)
+
+	embeddings, err := embedder.EmbedBatch(context.Background(), []string{"first", "second"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 2}, {3, 4}}, embeddings, "unexpected embeddings")
+	require.Len(t, requests, 1, "expected a single request")
+	assert.Equal(t, ollamaEmbedRequest{Model: defaultOllamaModel, Input: []string{"first", "second"}}, requests[0], "unexpected request")
+}
+
+func TestOllamaEmbedderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+		class   ErrorClass
+	}{
+		{
+			name: "throttled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "2")
+				http.Error(w, `{"error":"busy"}`, http.StatusTooManyRequests)
+			},
+			wantErr: "status 429",
+			class:   ErrorThrottled,
+		},
+		{
+			name: "unknown model",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":"model \"other\" not found"}`, http.StatusNotFound)
+			},
+			wantErr: "not found",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "invalid response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"embeddings":`))
+			},
+			wantErr: "failed to unmarshal embed response",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "missing embeddings",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]any{"embeddings": [][]float32{{1, 2}}})
+			},
+			wantErr: "does not match the number of inputs",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "other dimensions",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]any{"embeddings": [][]float32{{1, 2}, {1, 2, 3}}})
+			},
+			wantErr: "embedding 1 received from Ollama has 3 dimensions instead of 2",
+			class:   ErrorPermanent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []ollamaEmbedRequest
+			server := ollamaServer(t, &requests, tt.handler)
+
+			embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL, Model: "other", Dimensions: 2})
+			require.NoError(t, err)
+
+			_, err = embedder.EmbedBatch(context.Background(), []string{"first", "second"})
+			assert.ErrorContains(t, err, tt.wantErr, "unexpected error")
+			assert.Equal(t, tt.class, ClassifyError(err), "unexpected error class")
+		})
+	}
+}
+
+func TestOllamaEmbedderReportsResponse(t *testing.T) {
+	var requests []ollamaEmbedRequest
+	server := ollamaServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL})
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(context.Background(), "text")
+	var httpErr *HTTPError
+	require.True(t, errors.As(err, &httpErr), "expected an HTTP error, got %v", err)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode, "unexpected status")
+	assert.Equal(t, "busy\n", httpErr.Body, "expected the response body")
+	delay, ok := retryAfter(err)
+	assert.True(t, ok, "expected the Retry-After header to be kept")
+	assert.Equal(t, 2*time.Second, delay, "unexpected delay")
+}
+
+func TestOllamaEmbedderTimeout(t *testing.T) {
+	var requests []ollamaEmbedRequest
+	server := ollamaServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL, Timeout: Duration(20 * time.Millisecond)})
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(context.Background(), "slow")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected the request to time out")
+}
+
+func TestOllamaEmbedderChecksDimensionsOfDefaultModel(t *testing.T) {
+	var requests []ollamaEmbedRequest
+	server := ollamaServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"embeddings": [][]float32{{1, 2}}})
+	})
+
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOllama, Endpoint: server.URL})
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(context.Background(), "text")
+	assert.ErrorContains(t, err, "has 2 dimensions instead of 768", "expected the embedding to be checked against the dimensions of the default model")
+}
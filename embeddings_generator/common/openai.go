@@ -0,0 +1,218 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const defaultOpenAIEndpoint = "https://api.openai.com/v1"
+
+// AzureOpenAIOptions configures an Embedder that uses an Azure OpenAI deployment.
+type AzureOpenAIOptions struct {
+	// Endpoint is the URL of the Azure OpenAI resource, e.g. https://<resource>.openai.azure.com.
+	Endpoint string
+	// Deployment is the name of the embedding model deployment.
+	Deployment string
+	// Dimensions is the number of dimensions requested from models that support it. Zero uses the model default.
+	Dimensions int
+	// APIKey authenticates the requests with the key of the resource when Auth selects AuthAPIKey.
+	APIKey string
+	// Auth selects the credential that authenticates the requests, unless Credential is set.
+	Auth AuthOptions
+	// Credential authenticates the requests. It takes precedence over Auth.
+	Credential azcore.TokenCredential
+	// HTTPClient sends the requests. The default transport of the Azure SDK is used if it is nil.
+	HTTPClient *http.Client
+	// Timeout limits the duration of each request. Zero leaves it to the context.
+	Timeout time.Duration
+}
+
+// openAIEmbedder generates embeddings with the azopenai client, either against Azure OpenAI or the public OpenAI API.
+// The client is created on first use, so that constructing the Embedder does not need credentials or network access.
+type openAIEmbedder struct {
+	model      string
+	dimensions int
+	timeout    time.Duration
+
+	newClient func() (*azopenai.Client, error)
+	once      sync.Once
+	client    *azopenai.Client
+	clientErr error
+}
+
+// NewAzureOpenAIEmbedder creates an Embedder that uses an Azure OpenAI deployment.
+// The credential is created up front, so that invalid authentication options are reported immediately,
+// but the client is only created, and tokens only acquired, when the first embedding is requested.
+func NewAzureOpenAIEmbedder(opts AzureOpenAIOptions) (Embedder, error) {
+	if opts.Endpoint == "" {
+		return nil, errors.New("an endpoint is required for Azure OpenAI")
+	}
+	if opts.Deployment == "" {
+		return nil, errors.New("a deployment name is required for Azure OpenAI")
+	}
+
+	cred := opts.Credential
+	if cred == nil {
+		methods, err := opts.Auth.ResolveMethods(opts.APIKey)
+		if err != nil {
+			return nil, err
+		}
+		if methods[0] != AuthAPIKey {
+			if cred, err = NewCredential(opts.Auth); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	newClient := func() (*azopenai.Client, error) {
+		var client *azopenai.Client
+		var err error
+		if cred != nil {
+			client, err = azopenai.NewClient(opts.Endpoint, cred, clientOptions(opts.HTTPClient))
+		} else {
+			client, err = azopenai.NewClientWithKeyCredential(opts.Endpoint, azcore.NewKeyCredential(opts.APIKey), clientOptions(opts.HTTPClient))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure OpenAI client: %w", err)
+		}
+		return client, nil
+	}
+
+	return &openAIEmbedder{model: opts.Deployment, dimensions: opts.Dimensions, timeout: opts.Timeout, newClient: newClient}, nil
+}
+
+// newAzureOpenAIEmbedder creates an Embedder that uses the Azure OpenAI deployment named by opts.Model.
+func newAzureOpenAIEmbedder(opts EmbedderOptions) (Embedder, error) {
+	return NewAzureOpenAIEmbedder(AzureOpenAIOptions{
+		Endpoint:   opts.Endpoint,
+		Deployment: opts.Model,
+		Dimensions: opts.Dimensions,
+		APIKey:     opts.APIKey,
+		Auth:       opts.Auth,
+		Credential: opts.Credential,
+		HTTPClient: opts.HTTPClient,
+		Timeout:    time.Duration(opts.Timeout),
+	})
+}
+
+// newOpenAIEmbedder creates an Embedder that uses the public OpenAI API with an API key.
+func newOpenAIEmbedder(opts EmbedderOptions) (Embedder, error) {
+	if opts.APIKey == "" {
+		return nil, errors.New("an API key is required for the OpenAI provider")
+	}
+	if opts.Model == "" {
+		opts.Model = "text-embedding-3-small"
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultOpenAIEndpoint
+	}
+
+	newClient := func() (*azopenai.Client, error) {
+		client, err := azopenai.NewClientForOpenAI(opts.Endpoint, azcore.NewKeyCredential(opts.APIKey), clientOptions(opts.HTTPClient))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OpenAI client: %w", err)
+		}
+		return client, nil
+	}
+
+	return &openAIEmbedder{model: opts.Model, dimensions: opts.Dimensions, timeout: time.Duration(opts.Timeout), newClient: newClient}, nil
+}
+
+// getClient returns the client, creating it on first use.
+func (e *openAIEmbedder) getClient() (*azopenai.Client, error) {
+	e.once.Do(func() {
+		e.client, e.clientErr = e.newClient()
+	})
+	return e.client, e.clientErr
+}
+
+// Embed generates an embedding for the given input text.
+func (e *openAIEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings[0], nil
+}
+
+// EmbedBatch sends a single embeddings request for the inputs and returns the embeddings in input order.
+func (e *openAIEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	options := azopenai.EmbeddingsOptions{
+		Input:          inputs,
+		DeploymentName: &e.model,
+	}
+	if e.dimensions > 0 {
+		dimensions := int32(e.dimensions)
+		options.Dimensions = &dimensions
+	}
+
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	resp, err := client.GetEmbeddings(ctx, options, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+
+	if len(resp.Data) == 0 {
+		return nil, errors.New("no embedding data received from OpenAI")
+	}
+
+	// The response items are not guaranteed to be in input order, so they are mapped back by index
+	embeddings := make([][]float32, len(inputs))
+	for _, item := range resp.Data {
+		if item.Index == nil || int(*item.Index) < 0 || int(*item.Index) >= len(inputs) {
+			return nil, errors.New("embedding data received from OpenAI has an invalid index")
+		}
+		embeddings[*item.Index] = item.Embedding
+	}
+
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			return nil, fmt.Errorf("no embedding data received from OpenAI for input %d", i)
+		}
+	}
+
+	return embeddings, nil
+}
+
+// Model returns the deployment (Azure OpenAI) or model (OpenAI) name.
+func (e *openAIEmbedder) Model() string {
+	return e.model
+}
+
+// Dimensions returns the configured dimensions, or the default dimensions of well known models.
+func (e *openAIEmbedder) Dimensions() int {
+	return dimensionsFor(e.model, e.dimensions)
+}
+
+// clientOptions returns the azopenai client options, sending requests with httpClient if it is not nil.
+// The SDK retry policy is disabled, because failed requests are retried by the Embedder returned from WithRetry.
+func clientOptions(httpClient *http.Client) *azopenai.ClientOptions {
+	opts := &azopenai.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	}
+	if httpClient != nil {
+		opts.Transport = httpClient
+	}
+	return opts
+}
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticCredential is a token credential that counts how often a token is requested.
+type staticCredential struct {
+	calls atomic.Int32
+}
+
+func (c *staticCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls.Add(1)
+	return azcore.AccessToken{Token: "test-token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// embeddingsServer returns a TLS server that answers embeddings requests with one embedding per input,
+// in reverse order, where the embedding of input i is [i, i].
+func embeddingsServer(t *testing.T, delay time.Duration, requests *[]*http.Request) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		time.Sleep(delay)
+
+		var body struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var data []map[string]any
+		for i := len(body.Input) - 1; i >= 0; i-- {
+			data = append(data, map[string]any{"object": "embedding", "index": i, "embedding": []float32{float32(i), float32(i)}})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data, "model": "test",
+			"usage": map[string]any{"prompt_tokens": 1, "total_tokens": 1}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewAzureOpenAIEmbedderRequiresEndpointAndDeployment(t *testing.T) {
+	_, err := NewAzureOpenAIEmbedder(AzureOpenAIOptions{Deployment: "embeddings"})
+	assert.ErrorContains(t, err, "endpoint", "expected an error for the missing endpoint")
+
+	_, err = NewAzureOpenAIEmbedder(AzureOpenAIOptions{Endpoint: "https://example.openai.azure.com"})
+	assert.ErrorContains(t, err, "deployment", "expected an error for the missing deployment")
+}
+
+func TestAzureOpenAIEmbedderCreatesClientOnFirstUse(t *testing.T) {
+	var requests []*http.Request
+	server := embeddingsServer(t, 0, &requests)
+	cred := &staticCredential{}
+
+	embedder, err := NewAzureOpenAIEmbedder(AzureOpenAIOptions{
+		Endpoint:   server.URL,
+		Deployment: "embeddings",
+		Credential: cred,
+		HTTPClient: server.Client(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "embeddings", embedder.Model(), "unexpected model")
+	assert.Zero(t, cred.calls.Load(), "expected no token to be requested before the first embedding")
+
+	embeddings, err := embedder.EmbedBatch(context.Background(), []string{"first", "second", "third"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{0, 0}, {1, 1}, {2, 2}}, embeddings, "expected embeddings in input order")
+
+	_, err = embedder.Embed(context.Background(), "fourth")
+	require.NoError(t, err)
+
+	require.Len(t, requests, 2, "unexpected number of requests")
+	assert.True(t, strings.Contains(requests[0].URL.Path, "/deployments/embeddings/embeddings"), "unexpected path %s", requests[0].URL.Path)
+	assert.Equal(t, "Bearer test-token", requests[0].Header.Get("Authorization"), "expected the injected credential to be used")
+	assert.Equal(t, int32(1), cred.calls.Load(), "expected the token to be reused")
+}
+
+func TestAzureOpenAIEmbedderTimeout(t *testing.T) {
+	var requests []*http.Request
+	server := embeddingsServer(t, 200*time.Millisecond, &requests)
+
+	embedder, err := NewAzureOpenAIEmbedder(AzureOpenAIOptions{
+		Endpoint:   server.URL,
+		Deployment: "embeddings",
+		Credential: &staticCredential{},
+		HTTPClient: server.Client(),
+		Timeout:    20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(context.Background(), "slow")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected the request to time out")
+}
+
+func TestNewEmbedderWithoutAzureConfiguration(t *testing.T) {
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderFake, Dimensions: 4})
+	require.NoError(t, err)
+
+	embedding, err := embedder.Embed(context.Background(), "text")
+	require.NoError(t, err)
+	assert.Len(t, embedding, 4, "unexpected dimensions")
+}
+
+// openAIServer returns a TLS server that records the embeddings requests, with their decoded bodies,
+// and answers them with handler.
+func openAIServer(t *testing.T, requests *[]*http.Request, bodies *[]map[string]any, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, r)
+		*bodies = append(*bodies, body)
+
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewOpenAIEmbedderRequiresAPIKey(t *testing.T) {
+	_, err := NewEmbedder(EmbedderOptions{Provider: ProviderOpenAI})
+	assert.ErrorContains(t, err, "API key is required", "expected an error for the missing API key")
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	var requests []*http.Request
+	var bodies []map[string]any
+	server := openAIServer(t, &requests, &bodies, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"object": "list", "model": "text-embedding-3-small", "data": [
+			{"object": "embedding", "index": 1, "embedding": [3, 4]},
+			{"object": "embedding", "index": 0, "embedding": [1, 2]}
+		], "usage": {"prompt_tokens": 2, "total_tokens": 2}}`))
+	})
+
+	embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOpenAI, APIKey: "secret", Endpoint: server.URL + "/v1", Dimensions: 2, HTTPClient: server.Client()})
+	require.NoError(t, err)
+	assert.Equal(t, "text-embedding-3-small", embedder.Model(), "expected the default model")
+	assert.Equal(t, 2, embedder.Dimensions(), "expected the configured dimensions")
+
+	embeddings, err := embedder.EmbedBatch(context.Background(), []string{"first", "second"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 2}, {3, 4}}, embeddings, "expected embeddings in input order")
+
+	require.Len(t, requests, 1, "expected a single request")
+	assert.Equal(t, http.MethodPost, requests[0].Method, "unexpected method")
+	assert.Equal(t, "/v1/embeddings", requests[0].URL.Path, "unexpected path")
+	assert.Equal(t, "Bearer secret", requests[0].Header.Get("Authorization"), "expected the API key to be sent")
+	assert.Equal(t, "text-embedding-3-small", bodies[0]["model"], "expected the model in the body")
+	assert.Equal(t, []any{"first", "second"}, bodies[0]["input"], "expected the inputs in the body")
+	assert.Equal(t, float64(2), bodies[0]["dimensions"], "expected the dimensions in the body")
+}
+
+func TestOpenAIEmbedderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+		class   ErrorClass
+	}{
+		{
+			name: "throttled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"error": {"code": "rate_limit_exceeded", "message": "slow down"}}`))
+			},
+			wantErr: "rate_limit_exceeded",
+			class:   ErrorThrottled,
+		},
+		{
+			name: "unauthorized",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": {"code": "invalid_api_key", "message": "Incorrect API key"}}`))
+			},
+			wantErr: "invalid_api_key",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			wantErr: "502",
+			class:   ErrorTransient,
+		},
+		{
+			name: "no data",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"object": "list", "data": [], "usage": {"prompt_tokens": 0, "total_tokens": 0}}`))
+			},
+			wantErr: "no embedding data received",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "invalid index",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 2, "embedding": [1]}], "usage": {"prompt_tokens": 1, "total_tokens": 1}}`))
+			},
+			wantErr: "invalid index",
+			class:   ErrorPermanent,
+		},
+		{
+			name: "missing input",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [1]}], "usage": {"prompt_tokens": 1, "total_tokens": 1}}`))
+			},
+			wantErr: "for input 1",
+			class:   ErrorPermanent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []*http.Request
+			var bodies []map[string]any
+			server := openAIServer(t, &requests, &bodies, tt.handler)
+
+			embedder, err := NewEmbedder(EmbedderOptions{Provider: ProviderOpenAI, APIKey: "secret", Endpoint: server.URL, HTTPClient: server.Client()})
+			require.NoError(t, err)
+
+			_, err = embedder.EmbedBatch(context.Background(), []string{"first", "second"})
+			assert.ErrorContains(t, err, tt.wantErr, "unexpected error")
+			assert.Equal(t, tt.class, ClassifyError(err), "unexpected error class")
+			assert.Len(t, requests, 1, "expected the request not to be retried by the SDK")
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path addresses a (possibly nested) property of a document. Each segment is an object key or an array index.
+type Path []string
+
+// ParsePath parses a JSON pointer (e.g. "/review/body" or "/tags/0") or a dotted path with optional
+// array indices (e.g. "review.body", "tags[0]" or "reviews.0.body"). A plain property name is a path
+// to a top-level property.
+func ParsePath(value string) (Path, error) {
+	if value == "" {
+		return nil, errors.New("empty property path")
+	}
+
+	if strings.HasPrefix(value, "/") {
+		segments := strings.Split(value[1:], "/")
+		for i, segment := range segments {
+			segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+		}
+		return Path(segments), nil
+	}
+
+	var path Path
+	for _, part := range strings.Split(value, ".") {
+		name, indices, bracketed := strings.Cut(part, "[")
+		if strings.Contains(name, "]") {
+			return nil, fmt.Errorf("invalid property path %q: unmatched ]", value)
+		}
+		if name != "" {
+			path = append(path, name)
+		}
+		if !bracketed {
+			if name == "" {
+				return nil, fmt.Errorf("invalid property path %q: empty segment", value)
+			}
+			continue
+		}
+		if !strings.HasSuffix(indices, "]") {
+			if strings.LastIndex(indices, "[") >= strings.LastIndex(indices, "]") {
+				return nil, fmt.Errorf("invalid property path %q: unterminated [", value)
+			}
+			return nil, fmt.Errorf("invalid property path %q: unexpected text after ]", value)
+		}
+
+		for _, index := range strings.Split(strings.TrimSuffix(indices, "]"), "][") {
+			if n, err := strconv.Atoi(index); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid property path %q: %q is not an array index", value, index)
+			}
+			path = append(path, index)
+		}
+	}
+
+	return path, nil
+}
+
+// String returns the path as a JSON pointer.
+func (p Path) String() string {
+	var builder strings.Builder
+	for _, segment := range p {
+		builder.WriteString("/")
+		builder.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(segment))
+	}
+	return builder.String()
+}
+
+// Get returns the value at the path, and whether it exists.
+func (p Path) Get(doc map[string]any) (any, bool) {
+	var current any = doc
+	for _, segment := range p {
+		switch container := current.(type) {
+		case map[string]any:
+			value, exists := container[segment]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil, false
+			}
+			current = container[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, len(p) > 0
+}
+
+// Set sets the value at the path, creating missing intermediate objects.
+// Array elements can be replaced, but arrays are not extended.
+func (p Path) Set(doc map[string]any, value any) error {
+	if len(p) == 0 {
+		return errors.New("cannot set the value of an empty property path")
+	}
+
+	var current any = doc
+	for i, segment := range p {
+		last := i == len(p)-1
+
+		switch container := current.(type) {
+		case map[string]any:
+			if last {
+				container[segment] = value
+				return nil
+			}
+			next, exists := container[segment]
+			if !exists || next == nil {
+				next = map[string]any{}
+				container[segment] = next
+			}
+			current = next
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(container) {
+				return fmt.Errorf("array index %q of property path %s is out of range", segment, p)
+			}
+			if last {
+				container[index] = value
+				return nil
+			}
+			current = container[index]
+		default:
+			return fmt.Errorf("property path %s does not address an object or array at %s", p, p[:i])
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the object property at the path. It reports whether the property existed.
+func (p Path) Delete(doc map[string]any) bool {
+	if len(p) == 0 {
+		return false
+	}
+
+	var parent any = doc
+	if len(p) > 1 {
+		var exists bool
+		if parent, exists = p[:len(p)-1].Get(doc); !exists {
+			return false
+		}
+	}
+
+	container, ok := parent.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	_, exists := container[p[len(p)-1]]
+	delete(container, p[len(p)-1])
+	return exists
+}
+
+// CloneDocument returns a deep copy of a document, so that nested properties can be changed without
+// affecting the original.
+func CloneDocument(doc map[string]any) map[string]any {
+	return cloneValue(doc).(map[string]any)
+}
+
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		clone := make(map[string]any, len(v))
+		for key, item := range v {
+			clone[key] = cloneValue(item)
+		}
+		return clone
+	case []any:
+		clone := make([]any, len(v))
+		for i, item := range v {
+			clone[i] = cloneValue(item)
+		}
+		return clone
+	default:
+		return v
+	}
+}
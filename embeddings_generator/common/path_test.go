@@ -0,0 +1,150 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := map[string]Path{
+		"title":          {"title"},
+		"review.body":    {"review", "body"},
+		"reviews.0.body": {"reviews", "0", "body"},
+		"tags[0]":        {"tags", "0"},
+		"matrix[1][2].x": {"matrix", "1", "2", "x"},
+		"/review/body":   {"review", "body"},
+		"/tags/0":        {"tags", "0"},
+		"/a~1b/c~0d/~01": {"a/b", "c~d", "~1"},
+		"/":              {""},
+		"/with.dot/[0]":  {"with.dot", "[0]"},
+	}
+
+	for value, expected := range tests {
+		path, err := ParsePath(value)
+		require.NoError(t, err, "failed to parse %q", value)
+		assert.Equal(t, expected, path, "unexpected path for %q", value)
+	}
+}
+
+func TestParsePathRejectsInvalidPaths(t *testing.T) {
+	tests := map[string]string{
+		"":       "empty property path",
+		"a..b":   "empty segment",
+		"a.":     "empty segment",
+		".a":     "empty segment",
+		"a[":     "unterminated [",
+		"a[0":    "unterminated [",
+		"a[0][1": "unterminated [",
+		"a]":     "unmatched ]",
+		"a[0]]":  "is not an array index",
+		"a[]":    "is not an array index",
+		"a[x]":   "is not an array index",
+		"a[-1]":  "is not an array index",
+		"a[0]b":  "unexpected text after ]",
+	}
+
+	for value, message := range tests {
+		_, err := ParsePath(value)
+		assert.ErrorContains(t, err, message, "expected %q to be rejected", value)
+	}
+}
+
+func TestPathString(t *testing.T) {
+	path := Path{"a/b", "c~d", "0"}
+	assert.Equal(t, "/a~1b/c~0d/0", path.String(), "expected an escaped JSON pointer")
+
+	parsed, err := ParsePath(path.String())
+	require.NoError(t, err)
+	assert.Equal(t, path, parsed, "expected the JSON pointer to parse to the same path")
+}
+
+// pathDocument returns a document with nested objects and arrays.
+func pathDocument() map[string]any {
+	return map[string]any{
+		"title": "t",
+		"review": map[string]any{
+			"body": "b",
+		},
+		"tags": []any{"x", "y"},
+		"reviews": []any{
+			map[string]any{"body": "first"},
+		},
+	}
+}
+
+func TestPathGet(t *testing.T) {
+	tests := []struct {
+		path     Path
+		expected any
+		exists   bool
+	}{
+		{path: Path{"title"}, expected: "t", exists: true},
+		{path: Path{"review", "body"}, expected: "b", exists: true},
+		{path: Path{"tags", "1"}, expected: "y", exists: true},
+		{path: Path{"reviews", "0", "body"}, expected: "first", exists: true},
+		{path: Path{"tags", "2"}, exists: false},
+		{path: Path{"tags", "-1"}, exists: false},
+		{path: Path{"tags", "first"}, exists: false},
+		{path: Path{"title", "length"}, exists: false},
+		{path: Path{"missing", "body"}, exists: false},
+	}
+
+	doc := pathDocument()
+	for _, tt := range tests {
+		value, exists := tt.path.Get(doc)
+		assert.Equal(t, tt.exists, exists, "unexpected existence of %s", tt.path)
+		assert.Equal(t, tt.expected, value, "unexpected value of %s", tt.path)
+	}
+
+	_, exists := Path{}.Get(doc)
+	assert.False(t, exists, "expected an empty path not to exist")
+}
+
+func TestPathSet(t *testing.T) {
+	doc := pathDocument()
+
+	require.NoError(t, Path{"review", "body"}.Set(doc, "new"))
+	assert.Equal(t, "new", doc["review"].(map[string]any)["body"], "expected the nested property to be replaced")
+
+	require.NoError(t, Path{"embeddings", "title"}.Set(doc, []float32{1}))
+	assert.Equal(t, map[string]any{"title": []float32{1}}, doc["embeddings"], "expected the missing parent to be created")
+
+	require.NoError(t, Path{"tags", "1"}.Set(doc, "z"))
+	assert.Equal(t, []any{"x", "z"}, doc["tags"], "expected the array element to be replaced")
+
+	require.NoError(t, Path{"reviews", "0", "vector"}.Set(doc, "v"))
+	assert.Equal(t, "v", doc["reviews"].([]any)[0].(map[string]any)["vector"], "expected the property of the array element to be set")
+
+	assert.ErrorContains(t, Path{"tags", "2"}.Set(doc, "w"), "out of range", "expected arrays not to be extended")
+	assert.ErrorContains(t, Path{"tags", "-1"}.Set(doc, "w"), "out of range", "expected a negative index to be rejected")
+	assert.ErrorContains(t, Path{"tags", "last"}.Set(doc, "w"), "out of range", "expected a key of an array to be rejected")
+	assert.ErrorContains(t, Path{"title", "length"}.Set(doc, 1), "does not address an object or array at /title", "expected a scalar parent to be rejected")
+	assert.Error(t, Path{}.Set(doc, 1), "expected an empty path to be rejected")
+	assert.Equal(t, []any{"x", "z"}, doc["tags"], "expected the array to be unchanged")
+}
+
+func TestPathDelete(t *testing.T) {
+	doc := pathDocument()
+
+	assert.True(t, Path{"review", "body"}.Delete(doc), "expected the nested property to be deleted")
+	assert.Equal(t, map[string]any{}, doc["review"], "expected the parent to be kept")
+	assert.False(t, Path{"review", "body"}.Delete(doc), "expected a deleted property not to exist")
+	assert.True(t, Path{"reviews", "0", "body"}.Delete(doc), "expected the property of the array element to be deleted")
+	assert.False(t, Path{"tags", "0"}.Delete(doc), "expected array elements not to be deleted")
+	assert.False(t, Path{"tags", "5"}.Delete(doc), "expected an out-of-range index to be ignored")
+	assert.False(t, Path{"missing", "body"}.Delete(doc), "expected a missing parent to be ignored")
+	assert.False(t, Path{}.Delete(doc), "expected an empty path to be ignored")
+	assert.Equal(t, []any{"x", "y"}, doc["tags"], "expected the array to be unchanged")
+}
+
+func TestCloneDocument(t *testing.T) {
+	doc := pathDocument()
+	clone := CloneDocument(doc)
+	require.Equal(t, doc, clone, "expected an equal document")
+
+	require.NoError(t, Path{"reviews", "0", "body"}.Set(clone, "changed"))
+	require.NoError(t, Path{"tags", "0"}.Set(clone, "changed"))
+	assert.Equal(t, pathDocument(), doc, "expected the original to be unchanged")
+}
@@ -1,20 +0,0 @@
-// Package common provides shared functionality for processing Cosmos DB documents.
-package common
-
-// Data represents the data field in the Cosmos DB trigger payload.
-type Data struct {
-	Documents string `json:"documents"`
-}
-
-// CosmosDBTriggerPayload represents the structure of the Cosmos DB trigger payload.
-type CosmosDBTriggerPayload struct {
-	Data Data `json:"Data"`
-	//Metadata Metadata `json:"Metadata"`
-}
-
-// InvokeResponse represents the structure of the response returned by the handler.
-type InvokeResponse struct {
-	Outputs     map[string]any `json:"outputs"`
-	Logs        []string       `json:"logs"`
-	ReturnValue any            `json:"returnValue,omitempty"`
-}
@@ -0,0 +1,32 @@
+package common
+
+import "sync"
+
+// ForEach calls fn for each index from 0 to n-1, with at most parallelism calls running at the same time,
+// and returns when all calls have returned. A parallelism below 2 calls fn sequentially, in index order.
+func ForEach(n, parallelism int, fn func(i int)) {
+	if parallelism < 2 || n < 2 {
+		for i := range n {
+			fn(i)
+		}
+		return
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(parallelism, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := range n {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
@@ -0,0 +1,201 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+)
+
+// rateLimitBurst is the period whose share of the per-minute budgets can be used at once.
+// Azure OpenAI evaluates its quotas over short periods, so the whole minute's budget must not be sent in a burst.
+const rateLimitBurst = 10 * time.Second
+
+// RateLimitOptions configures the client-side rate limits of the embedding requests, typically set to the
+// tokens-per-minute and requests-per-minute quotas of the deployment. A zero limit is not enforced.
+type RateLimitOptions struct {
+	TokensPerMinute   int `json:"tokensPerMinute,omitempty"`
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+	// Tokenizer counts the tokens of the requests. ApproximateTokenizer is used if it is nil.
+	Tokenizer Tokenizer `json:"-"`
+}
+
+// LoadEnv overrides the options with the EMBEDDING_TOKENS_PER_MINUTE and EMBEDDING_REQUESTS_PER_MINUTE
+// environment variables that are set.
+func (o *RateLimitOptions) LoadEnv() error {
+	var err error
+	if o.TokensPerMinute, err = IntFromEnv("EMBEDDING_TOKENS_PER_MINUTE", o.TokensPerMinute); err != nil {
+		return err
+	}
+	if o.RequestsPerMinute, err = IntFromEnv("EMBEDDING_REQUESTS_PER_MINUTE", o.RequestsPerMinute); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Enabled reports whether any limit is set.
+func (o RateLimitOptions) Enabled() bool {
+	return o.TokensPerMinute > 0 || o.RequestsPerMinute > 0
+}
+
+// tokenBucket is a token bucket that holds up to capacity tokens and refills at rate tokens per second.
+// Its level goes below zero when capacity is reserved ahead of time for waiting requests, or when a request
+// costs more than the capacity: the debt is paid off at the refill rate before the next request is sent.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	level    float64
+}
+
+// newTokenBucket creates a full bucket for a per-minute budget, or nil if the budget is not limited. The bucket
+// holds at least one token, so that a budget below one request per burst period does not delay the first request.
+func newTokenBucket(perMinute int) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	rate := float64(perMinute) / time.Minute.Seconds()
+	capacity := max(rate*rateLimitBurst.Seconds(), 1)
+	return &tokenBucket{capacity: capacity, rate: rate, level: capacity}
+}
+
+// refill adds the tokens accumulated during elapsed.
+func (b *tokenBucket) refill(elapsed time.Duration) {
+	b.level = min(b.capacity, b.level+elapsed.Seconds()*b.rate)
+}
+
+// take removes cost tokens and returns how long it takes until the bucket is no longer in debt. The full cost
+// is charged, even above the capacity, so that the tokens sent never exceed the capacity plus the refills.
+func (b *tokenBucket) take(cost float64) time.Duration {
+	b.level -= cost
+	if b.level >= 0 {
+		return 0
+	}
+	return time.Duration(-b.level / b.rate * float64(time.Second))
+}
+
+// rateLimiter reserves capacity from the token and request buckets, whichever makes the request wait longest.
+type rateLimiter struct {
+	mu       sync.Mutex
+	tokens   *tokenBucket
+	requests *tokenBucket
+	last     time.Time
+	now      func() time.Time
+}
+
+// reserve takes the capacity for a request of the given number of tokens, and returns how long the request
+// must wait before it is sent.
+func (l *rateLimiter) reserve(tokens int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	elapsed := now.Sub(l.last)
+	l.last = now
+
+	var wait time.Duration
+	if l.tokens != nil {
+		l.tokens.refill(elapsed)
+		wait = max(wait, l.tokens.take(float64(tokens)))
+	}
+	if l.requests != nil {
+		l.requests.refill(elapsed)
+		wait = max(wait, l.requests.take(1))
+	}
+	return wait
+}
+
+// cancel returns the capacity reserved for a request that is not sent.
+func (l *rateLimiter) cancel(tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tokens != nil {
+		l.tokens.level = min(l.tokens.capacity, l.tokens.level+float64(tokens))
+	}
+	if l.requests != nil {
+		l.requests.level = min(l.requests.capacity, l.requests.level+1)
+	}
+}
+
+// rateLimitEmbedder delays the requests of the Embedder it wraps, so that they stay within the rate limits.
+type rateLimitEmbedder struct {
+	Embedder
+	limiter   *rateLimiter
+	tokenizer Tokenizer
+}
+
+// WithRateLimit wraps an Embedder so that its requests are queued until they fit into the tokens-per-minute and
+// requests-per-minute budgets. The tokens of a request are counted with the tokenizer of the options. The limits are shared by all
+// the requests of the returned Embedder, across invocations. The time a request was queued is logged to the
+// invocation logs.
+func WithRateLimit(embedder Embedder, opts RateLimitOptions) Embedder {
+	if !opts.Enabled() {
+		return embedder
+	}
+
+	limiter := &rateLimiter{
+		tokens:   newTokenBucket(opts.TokensPerMinute),
+		requests: newTokenBucket(opts.RequestsPerMinute),
+		now:      time.Now,
+	}
+	limiter.last = limiter.now()
+
+	tokenizer := opts.Tokenizer
+	if tokenizer == nil {
+		tokenizer = ApproximateTokenizer()
+	}
+	return &rateLimitEmbedder{Embedder: embedder, limiter: limiter, tokenizer: tokenizer}
+}
+
+// Embed generates an embedding for the input once the rate limits allow it.
+func (e *rateLimitEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	if err := e.wait(ctx, []string{input}); err != nil {
+		return nil, err
+	}
+	return e.Embedder.Embed(ctx, input)
+}
+
+// EmbedBatch generates embeddings for the inputs once the rate limits allow it.
+func (e *rateLimitEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	if err := e.wait(ctx, inputs); err != nil {
+		return nil, err
+	}
+	return e.Embedder.EmbedBatch(ctx, inputs)
+}
+
+// wait blocks until the request for the inputs may be sent, or ctx is done.
+func (e *rateLimitEmbedder) wait(ctx context.Context, inputs []string) error {
+	tokens := 0
+	for _, input := range inputs {
+		tokens += e.tokenizer.Count(input)
+	}
+
+	delay := e.limiter.reserve(tokens)
+	if delay <= 0 {
+		return nil
+	}
+
+	logger := customhandler.LoggerFromContext(ctx)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		e.limiter.cancel(tokens)
+		logger.Errorf("Embedding request of %d inputs (~%d tokens) would be queued for %s by the rate limiter, beyond the deadline",
+			len(inputs), tokens, delay.Round(time.Millisecond))
+		return fmt.Errorf("rate limit: request would be queued for %s, beyond the deadline: %w", delay.Round(time.Millisecond), context.DeadlineExceeded)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		e.limiter.cancel(tokens)
+		return fmt.Errorf("rate limit: request cancelled while queued: %w", context.Cause(ctx))
+	case <-timer.C:
+		logger.Infof("Embedding request of %d inputs (~%d tokens) was queued for %s by the rate limiter", len(inputs), tokens, delay.Round(time.Millisecond))
+		return nil
+	}
+}
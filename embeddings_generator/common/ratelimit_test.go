@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLimiter returns a rate limiter whose clock is advanced by the returned function.
+func testLimiter(opts RateLimitOptions) (*rateLimiter, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := &rateLimiter{
+		tokens:   newTokenBucket(opts.TokensPerMinute),
+		requests: newTokenBucket(opts.RequestsPerMinute),
+		now:      func() time.Time { return now },
+		last:     now,
+	}
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	limiter, advance := testLimiter(RateLimitOptions{RequestsPerMinute: 60})
+
+	// 60 requests per minute allow a burst of 10 requests, then one request per second
+	for i := range 10 {
+		assert.Zero(t, limiter.reserve(1), "expected request %d of the burst not to wait", i)
+	}
+	assert.Equal(t, time.Second, limiter.reserve(1), "expected the next request to wait for a refill")
+	assert.Equal(t, 2*time.Second, limiter.reserve(1), "expected requests to queue behind each other")
+
+	advance(5 * time.Second)
+	assert.Zero(t, limiter.reserve(1), "expected the refilled bucket to admit a request")
+}
+
+func TestRateLimiterTokensPerMinute(t *testing.T) {
+	limiter, advance := testLimiter(RateLimitOptions{TokensPerMinute: 6000, RequestsPerMinute: 6000})
+
+	// 6000 tokens per minute allow a burst of 1000 tokens, refilled at 100 tokens per second
+	assert.Zero(t, limiter.reserve(800), "expected the first request to fit")
+	assert.Equal(t, 3*time.Second, limiter.reserve(500), "expected the request to wait for 300 tokens")
+
+	advance(3 * time.Second)
+	assert.Equal(t, 50*time.Second, limiter.reserve(5000), "expected a request larger than the burst to wait for its full cost")
+
+	limiter.cancel(5000)
+	assert.Zero(t, limiter.reserve(0), "expected a cancelled request to return its capacity")
+
+	limiter.cancel(5000)
+	assert.Equal(t, 1000.0, limiter.tokens.level, "expected the returned capacity not to exceed the bucket")
+}
+
+func TestRateLimiterStaysWithinQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  RateLimitOptions
+		costs int
+		burst float64
+	}{
+		{name: "batches larger than the burst", opts: RateLimitOptions{TokensPerMinute: 120_000}, costs: 100_000, burst: 20_000},
+		{name: "small batches", opts: RateLimitOptions{TokensPerMinute: 120_000}, costs: 1_000, burst: 20_000},
+		{name: "requests below one per burst period", opts: RateLimitOptions{RequestsPerMinute: 3}, costs: 1, burst: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, advance := testLimiter(tt.opts)
+			perMinute := float64(max(tt.opts.TokensPerMinute, tt.opts.RequestsPerMinute))
+
+			// Requests are sent back to back for ten minutes, each as soon as the limiter allows it
+			var elapsed time.Duration
+			var sent float64
+			for {
+				wait := limiter.reserve(tt.costs)
+				advance(wait)
+				if elapsed += wait; elapsed >= 10*time.Minute {
+					break
+				}
+				if tt.opts.RequestsPerMinute > 0 {
+					sent++
+				} else {
+					sent += float64(tt.costs)
+				}
+				allowed := tt.burst + perMinute*elapsed.Minutes()
+				require.LessOrEqual(t, sent, allowed+1e-6, "expected no more than the burst and the quota by %s", elapsed)
+			}
+			assert.GreaterOrEqual(t, sent, 9*perMinute, "expected the quota to be used")
+		})
+	}
+}
+
+func TestWithRateLimitLogsQueueTime(t *testing.T) {
+	embedder := WithRateLimit(NewFakeEmbedder("", 2), RateLimitOptions{RequestsPerMinute: 600})
+	logger := customhandler.NewLogger(customhandler.LevelInfo)
+	ctx := customhandler.WithLogger(context.Background(), logger)
+
+	// 600 requests per minute allow a burst of 100 requests, then one request every 100ms
+	for range 101 {
+		_, err := embedder.EmbedBatch(ctx, []string{"input"})
+		require.NoError(t, err)
+	}
+
+	require.Len(t, logger.Lines(), 1, "expected the queued request to be logged")
+	assert.Contains(t, logger.Lines()[0], "was queued for", "unexpected log line")
+}
+
+func TestWithRateLimitRespectsDeadline(t *testing.T) {
+	embedder := WithRateLimit(NewFakeEmbedder("", 2), RateLimitOptions{RequestsPerMinute: 6})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := embedder.Embed(ctx, "first")
+	require.NoError(t, err)
+
+	_, err = embedder.Embed(ctx, "second")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected the request to be rejected instead of queued past the deadline")
+}
+
+func TestWithRateLimitDisabled(t *testing.T) {
+	embedder := NewFakeEmbedder("", 2)
+	assert.Same(t, embedder, WithRateLimit(embedder, RateLimitOptions{}), "expected the embedder to be returned unchanged")
+}
+
+// fixedTokenizer counts every text as the same number of tokens.
+type fixedTokenizer int
+
+func (t fixedTokenizer) Split(text string) []string { return []string{text} }
+func (t fixedTokenizer) Count(string) int           { return int(t) }
+
+func TestWithRateLimitCountsTokensWithTokenizer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// 600 tokens per minute allow a burst of 100 tokens
+	opts := RateLimitOptions{TokensPerMinute: 600}
+	_, err := WithRateLimit(NewFakeEmbedder("", 2), opts).Embed(ctx, "input")
+	assert.NoError(t, err, "expected the approximate count of a short input to fit into the burst")
+
+	opts.Tokenizer = fixedTokenizer(1000)
+	_, err = WithRateLimit(NewFakeEmbedder("", 2), opts).Embed(ctx, "input")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected the count of the tokenizer to be charged to the budget")
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+)
+
+const (
+	defaultRetryMaxAttempts  = 5
+	defaultRetryInitialDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay     = 30 * time.Second
+)
+
+// ErrorClass tells whether a failed embedding request is worth retrying.
+type ErrorClass int
+
+const (
+	// ErrorPermanent is an error that will not go away by retrying, e.g. an invalid request.
+	ErrorPermanent ErrorClass = iota
+	// ErrorThrottled is an error caused by the service rate limiting the caller.
+	ErrorThrottled
+	// ErrorTransient is a temporary error, e.g. a server error or a dropped connection.
+	ErrorTransient
+)
+
+// String returns the name of the error class.
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorThrottled:
+		return "throttled"
+	case ErrorTransient:
+		return "transient"
+	default:
+		return "permanent"
+	}
+}
+
+// ClassifyError determines the class of an error returned by an Embedder. A cancelled or expired context is
+// permanent: the retry loop, which knows whether only the attempt timed out, retries the latter.
+func ClassifyError(err error) ErrorClass {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorPermanent
+	}
+
+	if statusCode, _, ok := responseStatus(err); ok {
+		switch statusCode {
+		case http.StatusTooManyRequests:
+			return ErrorThrottled
+		case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return ErrorTransient
+		default:
+			return ErrorPermanent
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorTransient
+	}
+
+	return ErrorPermanent
+}
+
+// responseStatus extracts the HTTP status code and headers from an error returned by an Embedder.
+func responseStatus(err error) (int, http.Header, bool) {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		var header http.Header
+		if respErr.RawResponse != nil {
+			header = respErr.RawResponse.Header
+		}
+		return respErr.StatusCode, header, true
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode, httpErr.Header, true
+	}
+
+	return 0, nil, false
+}
+
+// retryAfter returns the delay requested by the service in the retry-after-ms, x-ms-retry-after-ms
+// or Retry-After response headers of a failed request.
+func retryAfter(err error) (time.Duration, bool) {
+	_, header, ok := responseStatus(err)
+	if !ok || header == nil {
+		return 0, false
+	}
+
+	for _, name := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if ms, err := strconv.ParseFloat(header.Get(name), 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+
+	return 0, false
+}
+
+// RetryOptions configures how failed embedding requests are retried.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts, including the first one. Values below 2 disable retries.
+	MaxAttempts int `json:"maxAttempts"`
+	// InitialDelay is the upper bound of the jittered delay before the first retry. It doubles with every attempt.
+	InitialDelay Duration `json:"initialDelay"`
+	// MaxDelay caps the delay between attempts when the service does not request a specific delay.
+	MaxDelay Duration `json:"maxDelay"`
+}
+
+// DefaultRetryOptions returns the default retry options.
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		MaxAttempts:  defaultRetryMaxAttempts,
+		InitialDelay: Duration(defaultRetryInitialDelay),
+		MaxDelay:     Duration(defaultRetryMaxDelay),
+	}
+}
+
+// LoadEnv overrides the options with the EMBEDDING_RETRY_MAX_ATTEMPTS, EMBEDDING_RETRY_INITIAL_DELAY
+// and EMBEDDING_RETRY_MAX_DELAY environment variables that are set.
+func (o *RetryOptions) LoadEnv() error {
+	var err error
+	if o.MaxAttempts, err = IntFromEnv("EMBEDDING_RETRY_MAX_ATTEMPTS", o.MaxAttempts); err != nil {
+		return err
+	}
+	initialDelay, err := DurationFromEnv("EMBEDDING_RETRY_INITIAL_DELAY", time.Duration(o.InitialDelay))
+	if err != nil {
+		return err
+	}
+	maxDelay, err := DurationFromEnv("EMBEDDING_RETRY_MAX_DELAY", time.Duration(o.MaxDelay))
+	if err != nil {
+		return err
+	}
+	o.InitialDelay, o.MaxDelay = Duration(initialDelay), Duration(maxDelay)
+
+	return nil
+}
+
+// backoff returns the jittered exponential delay before the given retry (starting at 1).
+func (o RetryOptions) backoff(retry int) time.Duration {
+	maxDelay := time.Duration(o.MaxDelay)
+	ceiling := time.Duration(o.InitialDelay) << (retry - 1)
+	if ceiling <= 0 || ceiling > maxDelay {
+		ceiling = maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling) + 1
+}
+
+// retryEmbedder retries the throttled and transient failures of the Embedder it wraps.
+type retryEmbedder struct {
+	Embedder
+	opts RetryOptions
+}
+
+// WithRetry wraps an Embedder so that throttled and transient failures are retried with jittered
+// exponential backoff, honouring the delays requested by the service. Retries stop when the next attempt
+// could not complete before the deadline of the context, i.e. the remaining execution budget of the invocation.
+func WithRetry(embedder Embedder, opts RetryOptions) Embedder {
+	return &retryEmbedder{Embedder: embedder, opts: opts}
+}
+
+// Embed generates an embedding for the input, retrying failed attempts.
+func (e *retryEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	var embedding []float32
+	err := e.do(ctx, func() error {
+		var err error
+		embedding, err = e.Embedder.Embed(ctx, input)
+		return err
+	})
+	return embedding, err
+}
+
+// EmbedBatch generates embeddings for the inputs, retrying failed attempts.
+func (e *retryEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	var embeddings [][]float32
+	err := e.do(ctx, func() error {
+		var err error
+		embeddings, err = e.Embedder.EmbedBatch(ctx, inputs)
+		return err
+	})
+	return embeddings, err
+}
+
+// do calls attempt until it succeeds, fails permanently, or the attempts or time budget are exhausted.
+func (e *retryEmbedder) do(ctx context.Context, attempt func() error) error {
+	logger := customhandler.LoggerFromContext(ctx)
+
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil {
+			if n > 1 {
+				logger.Infof("Embedding request succeeded on attempt %d", n)
+			}
+			return nil
+		}
+
+		class := ClassifyError(err)
+		if class == ErrorPermanent && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			// Only the attempt timed out, e.g. after the timeout of the embedder: the invocation has time left
+			class = ErrorTransient
+		}
+		if class == ErrorPermanent || n >= e.opts.MaxAttempts {
+			if n > 1 {
+				logger.Errorf("Embedding request failed (%s) on attempt %d/%d, giving up: %v", class, n, e.opts.MaxAttempts, err)
+			}
+			return err
+		}
+
+		delay, requested := retryAfter(err)
+		if !requested {
+			delay = e.opts.backoff(n)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			logger.Errorf("Embedding request failed (%s) on attempt %d/%d, retrying in %s would exceed the invocation deadline: %v",
+				class, n, e.opts.MaxAttempts, delay.Round(time.Millisecond), err)
+			return err
+		}
+
+		logger.Warnf("Embedding request failed (%s) on attempt %d/%d, retrying in %s: %v", class, n, e.opts.MaxAttempts, delay.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, context.Cause(ctx))
+		case <-timer.C:
+		}
+	}
+}
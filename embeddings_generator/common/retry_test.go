@@ -0,0 +1,194 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedEmbedder fails its first requests with the given errors, then embeds each input as its length.
+type scriptedEmbedder struct {
+	errs     []error
+	attempts int
+}
+
+func (e *scriptedEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+func (e *scriptedEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	e.attempts++
+	if e.attempts <= len(e.errs) {
+		return nil, e.errs[e.attempts-1]
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = []float32{float32(len(input))}
+	}
+	return embeddings, nil
+}
+
+func (e *scriptedEmbedder) Model() string   { return "scripted" }
+func (e *scriptedEmbedder) Dimensions() int { return 1 }
+
+// statusError returns the error of a response with the given status code and headers.
+func statusError(statusCode int, header ...string) error {
+	h := http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		h.Set(header[i], header[i+1])
+	}
+	return &HTTPError{StatusCode: statusCode, Header: h}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected ErrorClass
+	}{
+		{name: "429", err: statusError(http.StatusTooManyRequests), expected: ErrorThrottled},
+		{name: "429 from the SDK", err: &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, expected: ErrorThrottled},
+		{name: "408", err: statusError(http.StatusRequestTimeout), expected: ErrorTransient},
+		{name: "500", err: statusError(http.StatusInternalServerError), expected: ErrorTransient},
+		{name: "502", err: statusError(http.StatusBadGateway), expected: ErrorTransient},
+		{name: "503 from the SDK", err: &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}, expected: ErrorTransient},
+		{name: "504", err: statusError(http.StatusGatewayTimeout), expected: ErrorTransient},
+		{name: "wrapped 503", err: fmt.Errorf("request failed: %w", statusError(http.StatusServiceUnavailable)), expected: ErrorTransient},
+		{name: "network error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, expected: ErrorTransient},
+		{name: "unexpected EOF", err: fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), expected: ErrorTransient},
+		{name: "400", err: statusError(http.StatusBadRequest), expected: ErrorPermanent},
+		{name: "401", err: &azcore.ResponseError{StatusCode: http.StatusUnauthorized}, expected: ErrorPermanent},
+		{name: "404", err: statusError(http.StatusNotFound), expected: ErrorPermanent},
+		{name: "cancelled", err: context.Canceled, expected: ErrorPermanent},
+		{name: "deadline", err: fmt.Errorf("request: %w", context.DeadlineExceeded), expected: ErrorPermanent},
+		{name: "other", err: errors.New("invalid response"), expected: ErrorPermanent},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, ClassifyError(tt.err), "unexpected class of %s", tt.name)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected time.Duration
+		found    bool
+	}{
+		{name: "retry-after-ms", err: statusError(429, "retry-after-ms", "1500"), expected: 1500 * time.Millisecond, found: true},
+		{name: "fractional retry-after-ms", err: statusError(429, "retry-after-ms", "2.5"), expected: 2500 * time.Microsecond, found: true},
+		{name: "x-ms-retry-after-ms", err: statusError(429, "x-ms-retry-after-ms", "250"), expected: 250 * time.Millisecond, found: true},
+		{name: "milliseconds before seconds", err: statusError(429, "retry-after-ms", "100", "Retry-After", "7"), expected: 100 * time.Millisecond, found: true},
+		{name: "Retry-After seconds", err: statusError(503, "Retry-After", "3"), expected: 3 * time.Second, found: true},
+		{name: "Retry-After date in the past", err: statusError(503, "Retry-After", "Mon, 02 Jan 2006 15:04:05 GMT"), expected: 0, found: true},
+		{name: "invalid", err: statusError(429, "Retry-After", "soon"), found: false},
+		{name: "negative", err: statusError(429, "retry-after-ms", "-5"), found: false},
+		{name: "no header", err: statusError(429), found: false},
+		{name: "no response", err: io.ErrUnexpectedEOF, found: false},
+	}
+
+	for _, tt := range tests {
+		delay, found := retryAfter(tt.err)
+		assert.Equal(t, tt.found, found, "unexpected result for %s", tt.name)
+		assert.Equal(t, tt.expected, delay, "unexpected delay for %s", tt.name)
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	delay, found := retryAfter(statusError(503, "Retry-After", date))
+	assert.True(t, found, "expected the date to be parsed")
+	assert.InDelta(t, time.Hour.Seconds(), delay.Seconds(), 2, "expected the time until the date")
+}
+
+func TestRetryOptionsBackoff(t *testing.T) {
+	opts := RetryOptions{InitialDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Second)}
+	for retry, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 70: time.Second} {
+		for range 20 {
+			delay := opts.backoff(retry)
+			assert.Positive(t, delay, "expected a positive delay before retry %d", retry)
+			assert.LessOrEqual(t, delay, ceiling, "expected the delay before retry %d to be at most %s", retry, ceiling)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	throttled := statusError(http.StatusTooManyRequests, "retry-after-ms", "1")
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		fails    bool
+	}{
+		{name: "retries throttled requests", errs: []error{throttled, throttled}, attempts: 3},
+		{name: "retries server errors", errs: []error{statusError(http.StatusInternalServerError, "retry-after-ms", "1")}, attempts: 2},
+		{name: "retries network errors", errs: []error{&net.OpError{Op: "read", Err: errors.New("connection reset")}}, attempts: 2},
+		{name: "retries attempts that time out", errs: []error{fmt.Errorf("failed to generate embedding: %w", context.DeadlineExceeded)}, attempts: 2},
+		{name: "does not retry bad requests", errs: []error{statusError(http.StatusBadRequest)}, attempts: 1, fails: true},
+		{name: "does not retry unauthorized requests", errs: []error{statusError(http.StatusUnauthorized)}, attempts: 1, fails: true},
+		{name: "gives up after the maximum attempts", errs: []error{throttled, throttled, throttled, throttled}, attempts: 3, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scripted := &scriptedEmbedder{errs: tt.errs}
+			opts := RetryOptions{MaxAttempts: 3, InitialDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}
+
+			embeddings, err := WithRetry(scripted, opts).EmbedBatch(context.Background(), []string{"abc"})
+			assert.Equal(t, tt.attempts, scripted.attempts, "unexpected number of attempts")
+			if tt.fails {
+				assert.Error(t, err, "expected the request to fail")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, [][]float32{{3}}, embeddings, "unexpected embeddings")
+		})
+	}
+}
+
+func TestWithRetryStopsBeforeDeadline(t *testing.T) {
+	scripted := &scriptedEmbedder{errs: []error{statusError(http.StatusTooManyRequests, "Retry-After", "10")}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := WithRetry(scripted, DefaultRetryOptions()).Embed(ctx, "abc")
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "expected no wait for a retry beyond the deadline")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*HTTPError).StatusCode, "expected the error of the last attempt")
+	assert.Equal(t, 1, scripted.attempts, "expected no retry")
+}
+
+func TestWithRetryDoesNotRetryExpiredInvocation(t *testing.T) {
+	scripted := &scriptedEmbedder{errs: []error{context.DeadlineExceeded}}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := WithRetry(scripted, DefaultRetryOptions()).Embed(ctx, "abc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected the error of the attempt")
+	assert.Equal(t, 1, scripted.attempts, "expected no retry once the invocation deadline has passed")
+}
+
+func TestWithRetryKeepsCancellationCause(t *testing.T) {
+	scripted := &scriptedEmbedder{errs: []error{statusError(http.StatusServiceUnavailable, "Retry-After", "10")}}
+	cause := errors.New("invocation deadline exceeded")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(10*time.Millisecond, func() { cancel(cause) })
+
+	_, err := WithRetry(scripted, DefaultRetryOptions()).Embed(ctx, "abc")
+	assert.ErrorIs(t, err, cause, "expected the cause of the cancellation")
+	var httpErr *HTTPError
+	assert.ErrorAs(t, err, &httpErr, "expected the error of the last attempt")
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits text into tokens.
+type Tokenizer interface {
+	// Split splits text into consecutive pieces, one per token. Concatenated, the pieces are equal to text.
+	Split(text string) []string
+	// Count returns the number of tokens in text.
+	Count(text string) int
+}
+
+// approximateTokenizer approximates the tokens of BPE tokenizers used by embedding models:
+// words and numbers (with their leading space) and individual punctuation characters are one token each.
+type approximateTokenizer struct{}
+
+// ApproximateTokenizer returns a Tokenizer that approximates the token boundaries of BPE tokenizers
+// without needing their vocabulary.
+func ApproximateTokenizer() Tokenizer {
+	return approximateTokenizer{}
+}
+
+// Split splits text into word, number, punctuation and whitespace pieces.
+func (approximateTokenizer) Split(text string) []string {
+	var pieces []string
+
+	start := 0
+	for start < len(text) {
+		end := start
+		r, size := utf8.DecodeRuneInString(text[end:])
+
+		// A single space is part of the word that follows it
+		if r == ' ' && start+size < len(text) {
+			next, _ := utf8.DecodeRuneInString(text[start+size:])
+			if isWordRune(next) {
+				end += size
+				r = next
+			}
+		}
+
+		switch {
+		case isWordRune(r):
+			for end < len(text) {
+				r, size = utf8.DecodeRuneInString(text[end:])
+				if !isWordRune(r) {
+					break
+				}
+				end += size
+			}
+		case unicode.IsSpace(r):
+			for end < len(text) {
+				r, size = utf8.DecodeRuneInString(text[end:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				end += size
+			}
+		default:
+			end += size
+		}
+
+		pieces = append(pieces, text[start:end])
+		start = end
+	}
+
+	return pieces
+}
+
+// Count returns the number of pieces Split would return.
+func (t approximateTokenizer) Count(text string) int {
+	return len(t.Split(text))
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
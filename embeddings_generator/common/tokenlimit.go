@@ -0,0 +1,210 @@
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// TokenLimitPolicy determines what happens to a text with more tokens than the embedding model accepts.
+type TokenLimitPolicy string
+
+const (
+	// TruncateTail keeps the beginning of the text and drops the tokens beyond the limit.
+	TruncateTail TokenLimitPolicy = "truncate-tail"
+	// TruncateHead keeps the end of the text and drops the tokens before it.
+	TruncateHead TokenLimitPolicy = "truncate-head"
+	// RejectText fails the text with a *TokenLimitError.
+	RejectText TokenLimitPolicy = "reject"
+	// ChunkText leaves the text to be split into chunks that fit into the limit.
+	ChunkText TokenLimitPolicy = "chunk"
+)
+
+// Tokenizers that can be selected by name.
+const (
+	// TokenizerApproximate is the ApproximateTokenizer, which needs no vocabulary.
+	TokenizerApproximate = "approximate"
+	// TokenizerCL100k is the cl100k_base encoding of the OpenAI embedding models, from the embedded ranks.
+	TokenizerCL100k = "cl100k_base"
+)
+
+// defaultMaxTokens is the input limit of models that are not in knownMaxTokens.
+const defaultMaxTokens = 8191
+
+// knownMaxTokens holds the maximum number of input tokens of well known embedding models.
+var knownMaxTokens = map[string]int{
+	"text-embedding-ada-002": 8191,
+	"text-embedding-3-small": 8191,
+	"text-embedding-3-large": 8191,
+	"nomic-embed-text":       8192,
+	"mxbai-embed-large":      512,
+	"all-minilm":             256,
+}
+
+// TokenLimitOptions configures how texts are counted in tokens and kept within the input limit of the model.
+type TokenLimitOptions struct {
+	// MaxTokens is the maximum number of tokens of a text. Zero uses the limit of the model.
+	MaxTokens int              `json:"maxTokens,omitempty"`
+	Policy    TokenLimitPolicy `json:"policy"`
+	// Tokenizer is TokenizerApproximate or TokenizerCL100k. By default, the OpenAI providers use TokenizerCL100k
+	// and the other providers use TokenizerApproximate.
+	Tokenizer string `json:"tokenizer,omitempty"`
+	// TokenizerFile is a tiktoken ranks file for exact token counts, which takes precedence over Tokenizer.
+	TokenizerFile string `json:"tokenizerFile,omitempty"`
+}
+
+// LoadEnv overrides the options with the EMBEDDING_MAX_TOKENS, TOKEN_LIMIT_POLICY, TOKENIZER and TOKENIZER_FILE
+// environment variables that are set. Texts are truncated at the tail by default.
+func (o *TokenLimitOptions) LoadEnv() error {
+	o.Policy = TokenLimitPolicy(strings.ToLower(StringFromEnv("TOKEN_LIMIT_POLICY", string(o.Policy))))
+	o.Tokenizer = strings.ToLower(StringFromEnv("TOKENIZER", o.Tokenizer))
+	o.TokenizerFile = StringFromEnv("TOKENIZER_FILE", o.TokenizerFile)
+
+	var err error
+	o.MaxTokens, err = IntFromEnv("EMBEDDING_MAX_TOKENS", o.MaxTokens)
+	return err
+}
+
+// WithDefaults returns the options with the defaults filled in for unset options.
+func (o TokenLimitOptions) WithDefaults() TokenLimitOptions {
+	if o.Policy == "" {
+		o.Policy = TruncateTail
+	}
+	return o
+}
+
+// Validate checks that the options are consistent.
+func (o TokenLimitOptions) Validate() error {
+	switch o.Policy {
+	case TruncateTail, TruncateHead, RejectText, ChunkText:
+	default:
+		return fmt.Errorf("unknown token limit policy %q", o.Policy)
+	}
+
+	if o.MaxTokens < 0 {
+		return fmt.Errorf("maxTokens must not be negative")
+	}
+
+	switch o.Tokenizer {
+	case "", TokenizerApproximate, TokenizerCL100k:
+	default:
+		return fmt.Errorf("unknown tokenizer %q", o.Tokenizer)
+	}
+
+	return nil
+}
+
+// TokenizerName returns the name of the tokenizer the options select for the provider: the name of the
+// tokenizer file, Tokenizer, or the default of the provider.
+func (o TokenLimitOptions) TokenizerName(provider string) string {
+	switch {
+	case o.TokenizerFile != "":
+		return filepath.Base(o.TokenizerFile)
+	case o.Tokenizer != "":
+		return o.Tokenizer
+	case provider == ProviderOpenAI || provider == ProviderAzureOpenAI:
+		return TokenizerCL100k
+	default:
+		return TokenizerApproximate
+	}
+}
+
+// NewTokenizer creates the tokenizer the options select for the provider.
+func (o TokenLimitOptions) NewTokenizer(provider string) (Tokenizer, error) {
+	switch {
+	case o.TokenizerFile != "":
+		return LoadBPETokenizer(o.TokenizerFile)
+	case o.TokenizerName(provider) == TokenizerCL100k:
+		return CL100kTokenizer()
+	default:
+		return ApproximateTokenizer(), nil
+	}
+}
+
+// MaxTokensFor returns the configured limit, or the limit of a well known model.
+func (o TokenLimitOptions) MaxTokensFor(model string) int {
+	if o.MaxTokens > 0 {
+		return o.MaxTokens
+	}
+	if n, ok := knownMaxTokens[model]; ok {
+		return n
+	}
+	return defaultMaxTokens
+}
+
+// TokenLimitError is returned for a text with more tokens than the limit when the policy is RejectText.
+type TokenLimitError struct {
+	Tokens    int
+	MaxTokens int
+}
+
+func (e *TokenLimitError) Error() string {
+	return fmt.Sprintf("text has %d tokens, more than the limit of %d", e.Tokens, e.MaxTokens)
+}
+
+// LimitedText is a text that was kept within the token limit.
+type LimitedText struct {
+	Text string
+	// Tokens is the number of tokens of Text.
+	Tokens int
+	// OriginalTokens is the number of tokens of the original text.
+	OriginalTokens int
+	// Truncated reports whether tokens were dropped from the original text.
+	Truncated bool
+	// NeedsChunking reports whether the text is longer than the limit and must be split into chunks.
+	NeedsChunking bool
+}
+
+// Limit applies the policy to a text with more than maxTokens tokens, as counted by the tokenizer.
+func (o TokenLimitOptions) Limit(tokenizer Tokenizer, text string, maxTokens int) (LimitedText, error) {
+	tokens := tokenizer.Count(text)
+	if tokens <= maxTokens {
+		return LimitedText{Text: text, Tokens: tokens, OriginalTokens: tokens}, nil
+	}
+
+	switch o.Policy {
+	case RejectText:
+		return LimitedText{}, &TokenLimitError{Tokens: tokens, MaxTokens: maxTokens}
+	case ChunkText:
+		return LimitedText{Text: text, Tokens: tokens, OriginalTokens: tokens, NeedsChunking: true}, nil
+	case TruncateHead:
+		text = truncate(tokenizer, text, maxTokens, false)
+	default:
+		text = truncate(tokenizer, text, maxTokens, true)
+	}
+
+	return LimitedText{Text: text, Tokens: tokenizer.Count(text), OriginalTokens: tokens, Truncated: true}, nil
+}
+
+// truncate returns the longest beginning (keepHead) or end of text that has at most maxTokens tokens.
+// The text is cut at the boundaries of the pieces returned by the tokenizer. Since pieces can merge into
+// different tokens once their neighbours are gone, the cut is found by counting the tokens of candidates.
+func truncate(tokenizer Tokenizer, text string, maxTokens int, keepHead bool) string {
+	pieces := tokenizer.Split(text)
+
+	// offsets[i] is the byte offset of the start of piece i, and offsets[len(pieces)] is the end of the text
+	offsets := make([]int, len(pieces)+1)
+	for i, piece := range pieces {
+		offsets[i+1] = offsets[i] + len(piece)
+	}
+
+	candidate := func(n int) string {
+		if keepHead {
+			return text[:offsets[n]]
+		}
+		return text[offsets[len(pieces)-n]:]
+	}
+
+	// Find the largest number of pieces whose text fits into the limit
+	low, high := 0, min(maxTokens, len(pieces))
+	for low < high {
+		mid := (low + high + 1) / 2
+		if tokenizer.Count(candidate(mid)) <= maxTokens {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	return candidate(low)
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCL100KPieces(t *testing.T) {
+	tests := map[string][]string{
+		"Hello world":     {"Hello", " world"},
+		"I'm  fine!\n\n":  {"I", "'m", " ", " fine", "!\n\n"},
+		"don't STOP'LL":   {"don", "'t", " STOP", "'LL"},
+		"1234567 apples":  {"123", "456", "7", " apples"},
+		"foo\n\nbar":      {"foo", "\n\n", "bar"},
+		"  \n  x":         {"  \n", " ", " x"},
+		"a  ":             {"a", "  "},
+		"(x) = y;":        {"(x", ")", " =", " y", ";"},
+		"héllo wörld, 東京": {"héllo", " wörld", ",", " 東京"},
+	}
+
+	for text, expected := range tests {
+		assert.Equal(t, expected, cl100kPieces(text), "unexpected pieces of %q", text)
+	}
+}
+
+// testRanks are the ranks of a tiny vocabulary: all single bytes, and a few merges.
+func testRanks() map[string]int {
+	ranks := map[string]int{}
+	for b := range 256 {
+		ranks[string([]byte{byte(b)})] = b
+	}
+	for i, token := range []string{"ab", "abc", " ab", "\xc3\xa9"} {
+		ranks[token] = 256 + i
+	}
+	return ranks
+}
+
+func TestBPETokenizer(t *testing.T) {
+	tokenizer := NewBPETokenizer(testRanks())
+
+	// "abc" has a lower rank than " ab", so " abc" is " " + "abc"
+	assert.Equal(t, []string{" ", "abc"}, tokenizer.Split(" abc"), "unexpected tokens")
+	assert.Equal(t, 2, tokenizer.Count("ab ab"), "expected ab and \" ab\"")
+	assert.Equal(t, []string{"abc", " ", "abc"}, tokenizer.Split("abc abc"), "unexpected tokens")
+
+	// é is a single token, but ö is two tokens that are kept together
+	assert.Equal(t, []string{"é"}, tokenizer.Split("é"), "unexpected tokens")
+	assert.Equal(t, 2, tokenizer.Count("ö"), "expected one token per byte")
+	assert.Equal(t, []string{"ö"}, tokenizer.Split("ö"), "expected the bytes of a character to stay together")
+}
+
+func TestCL100kRanksChecksum(t *testing.T) {
+	sum := sha256.Sum256(cl100kRanks)
+	assert.Equal(t, "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7", hex.EncodeToString(sum[:]), "expected the ranks published by tiktoken")
+}
+
+func TestCL100kTokenizer(t *testing.T) {
+	tokenizer, err := CL100kTokenizer()
+	require.NoError(t, err)
+
+	// Token counts of tiktoken's cl100k_base encoding
+	tests := map[string]int{
+		"hallo world!":      4,
+		"Hallo Welt!":       3,
+		"Bonjour le monde!": 4,
+		"Ciao mondo!":       4,
+		"¡Hola mundo!":      4,
+		"Hej världen!":      7,
+		"Привет мир!":       6,
+		"你好世界！":             6,
+		"こんにちは世界！":          5,
+		"안녕하세요 세계!":         10,
+	}
+	for text, expected := range tests {
+		assert.Equal(t, expected, tokenizer.Count(text), "unexpected token count of %q", text)
+	}
+
+	// tiktoken encodes this text as 15339, 1917, 0, 57668, 53901, 3922, 3574, 244, 98220, 6447; 世 is two tokens
+	text := "hello world!你好，世界！"
+	assert.Equal(t, 10, tokenizer.Count(text), "unexpected token count")
+	assert.Equal(t, []string{"hello", " world", "!", "你", "好", "，", "世", "界", "！"}, tokenizer.Split(text), "unexpected tokens")
+}
+
+func TestTokenizerName(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TokenLimitOptions
+		provider string
+		expected string
+	}{
+		{name: "OpenAI default", provider: ProviderOpenAI, expected: TokenizerCL100k},
+		{name: "Azure OpenAI default", provider: ProviderAzureOpenAI, expected: TokenizerCL100k},
+		{name: "Ollama default", provider: ProviderOllama, expected: TokenizerApproximate},
+		{name: "explicit", opts: TokenLimitOptions{Tokenizer: TokenizerApproximate}, provider: ProviderOpenAI, expected: TokenizerApproximate},
+		{name: "file", opts: TokenLimitOptions{Tokenizer: TokenizerApproximate, TokenizerFile: "/ranks/o200k_base.tiktoken"}, provider: ProviderOllama, expected: "o200k_base.tiktoken"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tt.opts.TokenizerName(tt.provider), "unexpected tokenizer for %s", tt.name)
+	}
+
+	assert.ErrorContains(t, TokenLimitOptions{Policy: TruncateTail, Tokenizer: "p50k"}.Validate(), "unknown tokenizer", "expected the unknown tokenizer to be reported")
+}
+
+func TestLoadBPETokenizer(t *testing.T) {
+	var lines []string
+	for token, rank := range testRanks() {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte(token)), rank))
+	}
+	path := filepath.Join(t.TempDir(), "test.tiktoken")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+
+	tokenizer, err := LoadBPETokenizer(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{" ", "abc"}, tokenizer.Split(" abc"), "unexpected tokens")
+
+	require.NoError(t, os.WriteFile(path, []byte("YWI=\n"), 0o600))
+	_, err = LoadBPETokenizer(path)
+	assert.ErrorContains(t, err, ":1: expected a token and a rank", "expected the invalid line to be reported")
+}
+
+func TestTokenLimit(t *testing.T) {
+	tokenizer := ApproximateTokenizer()
+	text := "one two three four five"
+
+	limited, err := TokenLimitOptions{Policy: TruncateTail}.Limit(tokenizer, text, 10)
+	require.NoError(t, err)
+	assert.Equal(t, LimitedText{Text: text, Tokens: 5, OriginalTokens: 5}, limited, "expected a text within the limit to be unchanged")
+
+	limited, err = TokenLimitOptions{Policy: TruncateTail}.Limit(tokenizer, text, 3)
+	require.NoError(t, err)
+	assert.Equal(t, LimitedText{Text: "one two three", Tokens: 3, OriginalTokens: 5, Truncated: true}, limited, "expected the head to be kept")
+
+	limited, err = TokenLimitOptions{Policy: TruncateHead}.Limit(tokenizer, text, 2)
+	require.NoError(t, err)
+	assert.Equal(t, LimitedText{Text: " four five", Tokens: 2, OriginalTokens: 5, Truncated: true}, limited, "expected the tail to be kept")
+
+	limited, err = TokenLimitOptions{Policy: ChunkText}.Limit(tokenizer, text, 3)
+	require.NoError(t, err)
+	assert.Equal(t, LimitedText{Text: text, Tokens: 5, OriginalTokens: 5, NeedsChunking: true}, limited, "expected the text to be chunked")
+
+	_, err = TokenLimitOptions{Policy: RejectText}.Limit(tokenizer, text, 3)
+	var limitErr *TokenLimitError
+	require.ErrorAs(t, err, &limitErr, "expected the text to be rejected")
+	assert.Equal(t, TokenLimitError{Tokens: 5, MaxTokens: 3}, *limitErr, "unexpected error")
+}
+
+func TestTruncateWithBPETokenizer(t *testing.T) {
+	tokenizer := NewBPETokenizer(testRanks())
+
+	// " abc" is a space and "abc", so the text is cut between them
+	limited, err := TokenLimitOptions{Policy: TruncateTail}.Limit(tokenizer, "abc abc abc", 3)
+	require.NoError(t, err)
+	assert.Equal(t, "abc abc", limited.Text, "unexpected truncated text")
+	assert.Equal(t, 3, limited.Tokens, "unexpected token count")
+}
+
+func TestMaxTokensFor(t *testing.T) {
+	assert.Equal(t, 8191, TokenLimitOptions{}.MaxTokensFor("text-embedding-3-large"), "expected the limit of the model")
+	assert.Equal(t, 512, TokenLimitOptions{}.MaxTokensFor("mxbai-embed-large"), "expected the limit of the model")
+	assert.Equal(t, defaultMaxTokens, TokenLimitOptions{}.MaxTokensFor("my-deployment"), "expected the default limit")
+	assert.Equal(t, 100, TokenLimitOptions{MaxTokens: 100}.MaxTokensFor("mxbai-embed-large"), "expected the configured limit")
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"embeddings_generator_function/common"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultParallelism = 4
+
+// Config is the configuration of the function. It is read from the optional JSON or YAML file named by
+// the CONFIG_FILE environment variable, and from environment variables, which take precedence over the file.
+type Config struct {
+	// VectorProperty, PropertyToEmbed, HashProperty and MetadataProperty configure a single vector. They are read
+	// from the COSMOS_VECTOR_PROPERTY, COSMOS_PROPERTY_TO_EMBED, COSMOS_HASH_PROPERTY and COSMOS_METADATA_PROPERTY
+	// environment variables.
+	VectorProperty   string `json:"vectorProperty,omitempty"`
+	PropertyToEmbed  string `json:"propertyToEmbed,omitempty"`
+	HashProperty     string `json:"hashProperty,omitempty"`
+	MetadataProperty string `json:"metadataProperty,omitempty"`
+	// Vectors configures several vectors (EMBEDDING_VECTORS). It cannot be combined with the single vector settings.
+	Vectors []VectorSpec `json:"vectors,omitempty"`
+
+	LogLevel         string `json:"logLevel"`
+	FailurePolicy    string `json:"failurePolicy"`
+	ValidationPolicy string `json:"validationPolicy,omitempty"`
+
+	// InvocationTimeout is the deadline of an invocation. It defaults to the functionTimeout of host.json, less a
+	// margin that leaves time to return the processed documents before the host cancels the invocation.
+	InvocationTimeout common.Duration `json:"invocationTimeout,omitempty"`
+	// EmbeddingTimeout limits the time an invocation spends creating the embeddings of all its documents, so
+	// that the documents whose embeddings cannot be created in time fail, and the others are still written before
+	// the invocation deadline. It defaults to the invocation timeout less a margin for writing the documents.
+	EmbeddingTimeout common.Duration `json:"embeddingTimeout,omitempty"`
+
+	// Parallelism is the maximum number of documents that are prepared or finished at the same time.
+	// The number of concurrent embedding requests is set by Batch.Concurrency.
+	Parallelism int `json:"parallelism"`
+
+	// MetadataFields are the fields of the metadata object written to the metadata property of each vector
+	// (METADATA_FIELDS, a comma separated list). All fields are written by default.
+	MetadataFields []string `json:"metadataFields,omitempty"`
+
+	// Normalize scales the stored vectors, or the vectors of the chunks, to unit length (NORMALIZE_VECTORS).
+	Normalize bool `json:"normalize,omitempty"`
+
+	Embedder  common.EmbedderOptions   `json:"embedder"`
+	Batch     common.BatchOptions      `json:"batch"`
+	Retry     common.RetryOptions      `json:"retry"`
+	RateLimit common.RateLimitOptions  `json:"rateLimit"`
+	Chunking  common.ChunkOptions      `json:"chunking"`
+	Tokens    common.TokenLimitOptions `json:"tokens"`
+	Cache     common.CacheOptions      `json:"cache"`
+	LoopGuard LoopGuardOptions         `json:"loopGuard"`
+	Output    OutputOptions            `json:"output"`
+
+	// The parsed settings, set by Validate.
+	vectors          []VectorSpec
+	logLevel         customhandler.Level
+	failurePolicy    FailurePolicy
+	validationPolicy ValidationPolicy
+	metadataFields   []string
+}
+
+// DefaultConfig returns the configuration used for the settings that are neither in the file nor in the environment.
+func DefaultConfig() *Config {
+	return &Config{
+		LogLevel:      customhandler.LevelInfo.String(),
+		FailurePolicy: string(BestEffort),
+		Parallelism:   defaultParallelism,
+		Batch:         common.DefaultBatchOptions(),
+		Retry:         common.DefaultRetryOptions(),
+		Cache:         common.DefaultCacheOptions(),
+		LoopGuard:     DefaultLoopGuardOptions(),
+		Output:        DefaultOutputOptions(),
+	}
+}
+
+// LoadConfig loads the configuration from the file named by CONFIG_FILE, if any, and the environment
+// variables, and validates it.
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to load config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if cfg.InvocationTimeout == 0 {
+		cfg.InvocationTimeout = common.Duration(invocationTimeoutFromHost(customhandler.HostFilePath()))
+	}
+	if cfg.EmbeddingTimeout == 0 {
+		cfg.EmbeddingTimeout = common.Duration(embeddingTimeoutFor(time.Duration(cfg.InvocationTimeout)))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile overrides the configuration with the settings of a JSON or (with a .yaml or .yml extension) YAML file.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON, so that both formats share the field names and decoding of the JSON tags.
+		var value any
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(c)
+}
+
+// loadEnv overrides the configuration with the environment variables that are set.
+func (c *Config) loadEnv() error {
+	c.VectorProperty = common.StringFromEnv("COSMOS_VECTOR_PROPERTY", c.VectorProperty)
+	c.PropertyToEmbed = common.StringFromEnv("COSMOS_PROPERTY_TO_EMBED", c.PropertyToEmbed)
+	c.HashProperty = common.StringFromEnv("COSMOS_HASH_PROPERTY", c.HashProperty)
+	c.MetadataProperty = common.StringFromEnv("COSMOS_METADATA_PROPERTY", c.MetadataProperty)
+	c.LogLevel = common.StringFromEnv("LOG_LEVEL", c.LogLevel)
+	c.FailurePolicy = common.StringFromEnv("FAILURE_POLICY", c.FailurePolicy)
+	c.ValidationPolicy = common.StringFromEnv("VALIDATION_POLICY", c.ValidationPolicy)
+
+	var err error
+	if c.Parallelism, err = common.IntFromEnv("PARALLELISM", c.Parallelism); err != nil {
+		return err
+	}
+
+	if value := os.Getenv("METADATA_FIELDS"); value != "" {
+		c.MetadataFields = strings.Split(value, ",")
+	}
+
+	if c.Normalize, err = common.BoolFromEnv("NORMALIZE_VECTORS", c.Normalize); err != nil {
+		return err
+	}
+
+	invocationTimeout, err := common.DurationFromEnv("INVOCATION_TIMEOUT", time.Duration(c.InvocationTimeout))
+	if err != nil {
+		return err
+	}
+	embeddingTimeout, err := common.DurationFromEnv("INVOCATION_EMBEDDING_TIMEOUT", time.Duration(c.EmbeddingTimeout))
+	if err != nil {
+		return err
+	}
+	c.InvocationTimeout, c.EmbeddingTimeout = common.Duration(invocationTimeout), common.Duration(embeddingTimeout)
+
+	if value := os.Getenv("EMBEDDING_VECTORS"); value != "" {
+		c.Vectors = nil
+		if err := json.Unmarshal([]byte(value), &c.Vectors); err != nil {
+			return fmt.Errorf("invalid EMBEDDING_VECTORS: %w", err)
+		}
+	}
+
+	if err := c.Embedder.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid embedder options: %w", err)
+	}
+	if err := c.Batch.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid embedding batch options: %w", err)
+	}
+	if err := c.Retry.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid embedding retry options: %w", err)
+	}
+	if err := c.RateLimit.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid embedding rate limit options: %w", err)
+	}
+	if err := c.Chunking.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid chunk options: %w", err)
+	}
+	if err := c.Tokens.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid token limit options: %w", err)
+	}
+	if err := c.Cache.LoadEnv(); err != nil {
+		return fmt.Errorf("invalid embedding cache options: %w", err)
+	}
+	if err := c.LoopGuard.loadEnv(); err != nil {
+		return fmt.Errorf("invalid loop guard options: %w", err)
+	}
+	if err := c.Output.loadEnv(); err != nil {
+		return fmt.Errorf("invalid output options: %w", err)
+	}
+
+	return nil
+}
+
+// invocationTimeoutFromHost derives the invocation timeout from the functionTimeout of the host.json file at
+// path: a tenth of the function timeout, but at most 30 seconds, is kept as a margin. It returns 0 if the
+// function timeout is unlimited, and falls back to the default function timeout if host.json cannot be read.
+func invocationTimeoutFromHost(path string) time.Duration {
+	functionTimeout, err := customhandler.FunctionTimeout(path)
+	if err != nil {
+		log.Printf("Using the default function timeout of %s: %v", customhandler.DefaultFunctionTimeout, err)
+		functionTimeout = customhandler.DefaultFunctionTimeout
+	}
+	if functionTimeout == 0 {
+		return 0
+	}
+
+	return functionTimeout - min(functionTimeout/10, 30*time.Second)
+}
+
+// embeddingTimeoutFor derives the embedding timeout from the invocation timeout: a fifth of the invocation
+// timeout, but at most a minute, is kept for finishing and writing the documents. It returns 0 if the
+// invocation timeout is unlimited.
+func embeddingTimeoutFor(invocationTimeout time.Duration) time.Duration {
+	return invocationTimeout - min(invocationTimeout/5, time.Minute)
+}
+
+// Validate checks the configuration and parses its settings. It reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	var err error
+
+	if c.logLevel, err = customhandler.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %w", err))
+	}
+	if c.failurePolicy, err = ParseFailurePolicy(c.FailurePolicy); err != nil {
+		errs = append(errs, fmt.Errorf("failurePolicy: %w", err))
+	}
+	if c.validationPolicy, err = ParseValidationPolicy(c.ValidationPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("validationPolicy: %w", err))
+	}
+
+	errs = append(errs, c.validateVectors()...)
+	errs = append(errs, c.LoopGuard.validate(c.vectors)...)
+	errs = append(errs, c.Output.validate(c.vectors)...)
+	// Sidecar documents are written to another container, so that they cannot trigger the function again
+	if c.Output.Mode == OutputSidecar {
+		c.LoopGuard.Property = ""
+	}
+	c.hideWrittenProperties()
+
+	if c.metadataFields, err = parseMetadataFields(strings.Join(c.MetadataFields, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("metadataFields: %w", err))
+	}
+
+	switch c.Embedder.Provider {
+	case common.ProviderAzureOpenAI:
+		if c.Embedder.Endpoint == "" {
+			errs = append(errs, errors.New("embedder: endpoint is required for Azure OpenAI (EMBEDDING_ENDPOINT or OPENAI_ENDPOINT)"))
+		}
+		if c.Embedder.Model == "" {
+			errs = append(errs, errors.New("embedder: model is required for Azure OpenAI (EMBEDDING_MODEL or OPENAI_DEPLOYMENT_NAME)"))
+		}
+		if _, err := c.Embedder.Auth.ResolveMethods(c.Embedder.APIKey); err != nil {
+			errs = append(errs, fmt.Errorf("embedder: auth: %w", err))
+		}
+	case common.ProviderOpenAI:
+		if c.Embedder.APIKey == "" {
+			errs = append(errs, errors.New("embedder: apiKey is required for OpenAI (EMBEDDING_API_KEY)"))
+		}
+	case common.ProviderOllama, common.ProviderFake:
+	default:
+		errs = append(errs, fmt.Errorf("embedder: unknown provider %q", c.Embedder.Provider))
+	}
+	if c.Embedder.Dimensions < 0 {
+		errs = append(errs, errors.New("embedder: dimensions must not be negative"))
+	}
+
+	if c.Parallelism <= 0 {
+		errs = append(errs, errors.New("parallelism must be positive"))
+	}
+
+	if c.Batch.MaxInputs <= 0 || c.Batch.MaxTokens <= 0 || c.Batch.Concurrency <= 0 {
+		errs = append(errs, errors.New("batch: maxInputs, maxTokens and concurrency must be positive"))
+	}
+
+	if c.Retry.MaxAttempts < 0 || c.Retry.InitialDelay < 0 || c.Retry.MaxDelay < 0 {
+		errs = append(errs, errors.New("retry: maxAttempts and delays must not be negative"))
+	}
+
+	if c.RateLimit.TokensPerMinute < 0 || c.RateLimit.RequestsPerMinute < 0 {
+		errs = append(errs, errors.New("rateLimit: tokensPerMinute and requestsPerMinute must not be negative"))
+	}
+
+	c.Chunking = c.Chunking.WithDefaults()
+	if c.Chunking.Size < 0 || c.Chunking.Overlap < 0 {
+		errs = append(errs, errors.New("chunking: size and overlap must not be negative"))
+	} else if err := c.Chunking.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("chunking: %w", err))
+	}
+
+	c.Tokens = c.Tokens.WithDefaults()
+	if err := c.Tokens.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tokens: %w", err))
+	}
+	// Without a model, the token limit is that of the default model of the embedder, which configure checks
+	if c.Tokens.MaxTokens > 0 || c.Embedder.Model != "" {
+		if err := c.checkChunkSize(c.Tokens.MaxTokensFor(c.Embedder.Model)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := c.Cache.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("cache: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateVectors resolves the vector specifications and checks that the properties they write
+// neither collide with each other, nor with the properties they read, nor with reserved properties.
+func (c *Config) validateVectors() []error {
+	legacy := []struct{ name, value string }{
+		{"COSMOS_VECTOR_PROPERTY", c.VectorProperty},
+		{"COSMOS_PROPERTY_TO_EMBED", c.PropertyToEmbed},
+		{"COSMOS_HASH_PROPERTY", c.HashProperty},
+	}
+
+	var specs []VectorSpec
+	if len(c.Vectors) > 0 {
+		for _, setting := range legacy {
+			if setting.value != "" {
+				return []error{fmt.Errorf("%s cannot be combined with a list of vectors (EMBEDDING_VECTORS)", setting.name)}
+			}
+		}
+		if c.MetadataProperty != "" {
+			return []error{errors.New("COSMOS_METADATA_PROPERTY cannot be combined with a list of vectors (EMBEDDING_VECTORS)")}
+		}
+		specs = slices.Clone(c.Vectors)
+	} else {
+		var missing []string
+		for _, setting := range legacy {
+			if setting.value == "" {
+				missing = append(missing, setting.name)
+			}
+		}
+		if len(missing) > 0 {
+			return []error{fmt.Errorf("no vectors configured: set EMBEDDING_VECTORS, or %s", strings.Join(missing, ", "))}
+		}
+		specs = []VectorSpec{{Target: c.VectorProperty, Source: c.PropertyToEmbed, HashProperty: c.HashProperty, MetadataProperty: c.MetadataProperty}}
+	}
+
+	var errs []error
+	for i := range specs {
+		if err := specs[i].init(); err != nil {
+			errs = append(errs, err)
+		} else if specs[i].Source != "" && strings.HasPrefix(specs[i].sourcePath[0], "_") {
+			errs = append(errs, fmt.Errorf("vector %s: source %s is a system property, which changes with every write", specs[i].Target, specs[i].Source))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	type property struct {
+		vector string
+		role   string
+		name   string
+		path   common.Path
+	}
+
+	var written []property
+	for _, s := range specs {
+		written = append(written,
+			property{s.Target, "target", s.Target, s.targetPath},
+			property{s.Target, "hashProperty", s.HashProperty, s.hashPath})
+		if s.MetadataProperty != "" {
+			written = append(written, property{s.Target, "metadataProperty", s.MetadataProperty, s.metadataPath})
+		}
+	}
+
+	for i, p := range written {
+		if reserved(p.path) {
+			errs = append(errs, fmt.Errorf("vector %s: %s %s is a reserved property", p.vector, p.role, p.name))
+		}
+		for _, other := range written[:i] {
+			if overlaps(p.path, other.path) {
+				errs = append(errs, fmt.Errorf("%s %s collides with %s %s", p.role, p.name, other.role, other.name))
+			}
+		}
+		for _, s := range specs {
+			if s.Source != "" && overlaps(p.path, s.sourcePath) {
+				errs = append(errs, fmt.Errorf("%s %s collides with source %s", p.role, p.name, s.Source))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		c.vectors = specs
+	}
+	return errs
+}
+
+// hideWrittenProperties hides the properties the function writes from the templates of the vectors: the
+// vectors, hashes and metadata, and the origin marker of the loop guard. Sources cannot refer to them.
+func (c *Config) hideWrittenProperties() {
+	var hidden []common.Path
+	for _, s := range c.vectors {
+		hidden = append(hidden, s.targetPath, s.hashPath)
+		if s.MetadataProperty != "" {
+			hidden = append(hidden, s.metadataPath)
+		}
+	}
+	if c.LoopGuard.Enabled() && c.LoopGuard.path != nil {
+		hidden = append(hidden, c.LoopGuard.path)
+	}
+	for i := range c.vectors {
+		c.vectors[i].hidden = hidden
+	}
+}
+
+// reserved reports whether a property path refers to the id of the document, or to a system
+// property or a property inside a system property, whose names start with an underscore.
+func reserved(path common.Path) bool {
+	return len(path) > 0 && (path[0] == "id" || strings.HasPrefix(path[0], "_"))
+}
+
+// overlaps reports whether two property paths are the same property, or one contains the other.
+func overlaps(a, b common.Path) bool {
+	n := min(len(a), len(b))
+	return slices.Equal(a[:n], b[:n])
+}
+
+// checkChunkSize checks that chunks measured in tokens fit into the token limit; chunks of characters are not
+// checked.
+func (c *Config) checkChunkSize(maxTokens int) error {
+	if (c.Chunking.Strategy == common.ChunkTokens || c.Chunking.Strategy == common.ChunkSentences) && c.Chunking.Size > maxTokens {
+		return fmt.Errorf("chunking: size (%d) must not exceed the token limit (%d)", c.Chunking.Size, maxTokens)
+	}
+	return nil
+}
+
+// embeddingSettings returns the settings of the configuration that determine the vectors, with the model,
+// dimensions and token limit resolved by the embedder. The chunk settings are left out when chunking is disabled.
+func (c *Config) embeddingSettings(embedder common.Embedder) EmbeddingSettings {
+	settings := EmbeddingSettings{
+		Provider:    c.Embedder.Provider,
+		Model:       embedder.Model(),
+		Dimensions:  embedder.Dimensions(),
+		Normalize:   c.Normalize,
+		Tokenizer:   c.Tokens.TokenizerName(c.Embedder.Provider),
+		MaxTokens:   c.Tokens.MaxTokensFor(embedder.Model()),
+		TokenPolicy: c.Tokens.Policy,
+	}
+	if c.Chunking.Enabled() {
+		settings.Chunking.Strategy = c.Chunking.Strategy
+		settings.Chunking.Size = c.Chunking.Size
+		settings.Chunking.Overlap = c.Chunking.Overlap
+		settings.Chunking.Output = c.Chunking.Output
+	}
+	return settings
+}
+
+// String returns the effective configuration as JSON, with secrets redacted.
+func (c *Config) String() string {
+	effective := *c
+	if len(c.vectors) > 0 {
+		effective.Vectors = c.vectors
+		effective.VectorProperty, effective.PropertyToEmbed, effective.HashProperty, effective.MetadataProperty = "", "", "", ""
+	}
+	if effective.Embedder.APIKey != "" {
+		effective.Embedder.APIKey = "REDACTED"
+	}
+	if effective.Cache.RedisPassword != "" {
+		effective.Cache.RedisPassword = "REDACTED"
+	}
+	if effective.Output.Cosmos.ConnectionString != "" {
+		effective.Output.Cosmos.ConnectionString = "REDACTED"
+	}
+	if effective.Output.Cosmos.Key != "" {
+		effective.Output.Cosmos.Key = "REDACTED"
+	}
+	if effective.Output.Target.ConnectionString != "" {
+		effective.Output.Target.ConnectionString = "REDACTED"
+	}
+	if effective.Output.Target.Key != "" {
+		effective.Output.Target.Key = "REDACTED"
+	}
+
+	data, err := json.Marshal(effective)
+	if err != nil {
+		return fmt.Sprintf("<invalid configuration: %v>", err)
+	}
+	return string(data)
+}
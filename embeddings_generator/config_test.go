@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"embeddings_generator_function/common"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigFromYAMLFileAndEnv(t *testing.T) {
+	t.Setenv("AzureWebJobsScriptRoot", t.TempDir())
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.yaml", `
+vectors:
+  - target: /embeddings/title
+    source: title
+    hashProperty: /embeddings/titleHash
+embedder:
+  provider: openai
+  apiKey: secret
+retry:
+  initialDelay: 1s
+failurePolicy: threshold:10
+`))
+	t.Setenv("EMBEDDING_RETRY_MAX_ATTEMPTS", "2")
+	t.Setenv("FAILURE_POLICY", "fail-fast")
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, FailurePolicy{Mode: FailFast}, cfg.failurePolicy, "expected the environment to override the file")
+	assert.Equal(t, common.RetryOptions{MaxAttempts: 2, InitialDelay: common.Duration(time.Second), MaxDelay: common.Duration(30 * time.Second)}, cfg.Retry, "unexpected retry options")
+	require.Len(t, cfg.vectors, 1, "expected the vector of the file")
+	assert.Equal(t, common.Path{"embeddings", "title"}, cfg.vectors[0].targetPath, "unexpected target")
+	assert.Equal(t, customhandler.DefaultFunctionTimeout-30*time.Second, time.Duration(cfg.InvocationTimeout), "expected the timeout derived from the default function timeout")
+	assert.NotContains(t, cfg.String(), "secret", "expected the API key to be redacted")
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.json", `{"vectorPropety": "vector"}`))
+
+	_, err := LoadConfig()
+	assert.ErrorContains(t, err, "vectorPropety", "expected the unknown field to be reported")
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr []string
+	}{
+		{
+			name:    "missing properties",
+			modify:  func(c *Config) { c.HashProperty = "" },
+			wantErr: []string{"COSMOS_HASH_PROPERTY"},
+		},
+		{
+			name: "legacy properties and vectors",
+			modify: func(c *Config) {
+				c.Vectors = []VectorSpec{{Target: "other", Source: "text", HashProperty: "otherHash"}}
+			},
+			wantErr: []string{"cannot be combined"},
+		},
+		{
+			name:    "target overwrites source",
+			modify:  func(c *Config) { c.VectorProperty = "text" },
+			wantErr: []string{"target text collides with source text"},
+		},
+		{
+			name:    "hash inside vector",
+			modify:  func(c *Config) { c.HashProperty = "vector.hash" },
+			wantErr: []string{"hashProperty vector.hash collides with target vector"},
+		},
+		{
+			name:    "reserved property",
+			modify:  func(c *Config) { c.HashProperty = "_hash" },
+			wantErr: []string{"_hash is a reserved property"},
+		},
+		{
+			name:    "system property as source",
+			modify:  func(c *Config) { c.PropertyToEmbed = "_etag" },
+			wantErr: []string{"source _etag is a system property"},
+		},
+		{
+			name:    "metadata collides with hash",
+			modify:  func(c *Config) { c.MetadataProperty = "hash" },
+			wantErr: []string{"metadataProperty hash collides with hashProperty hash"},
+		},
+		{
+			name:    "loop guard marker collides with source",
+			modify:  func(c *Config) { c.LoopGuard.Property = "text" },
+			wantErr: []string{"loopGuard: property text collides with source text"},
+		},
+		{
+			name:    "patch output without container",
+			modify:  func(c *Config) { c.Output.Mode = OutputPatch },
+			wantErr: []string{"output: cosmos: account endpoint is required", "database and container are required"},
+		},
+		{
+			name: "sidecar in the source container",
+			modify: func(c *Config) {
+				c.Output.Mode = OutputSidecar
+				c.Output.Cosmos = common.CosmosOptions{Endpoint: "https://example.documents.azure.com", Database: "db", Container: "items"}
+				c.Output.Target.Container = "items"
+			},
+			wantErr: []string{"the sidecar container must not be the source container"},
+		},
+		{
+			name: "projection collides with hash",
+			modify: func(c *Config) {
+				c.Output.Mode = OutputSidecar
+				c.Output.Projection = []string{"title", "hash"}
+			},
+			wantErr: []string{"output: target: account endpoint is required", "projection: hash collides with property /hash"},
+		},
+		{
+			name:    "unknown conflict policy",
+			modify:  func(c *Config) { c.Output.OnConflict = "merge" },
+			wantErr: []string{`unknown conflict policy "merge"`},
+		},
+		{
+			name: "chunks larger than the token limit",
+			modify: func(c *Config) {
+				c.Chunking.Strategy, c.Chunking.Size = common.ChunkTokens, 1000
+				c.Tokens.MaxTokens = 500
+			},
+			wantErr: []string{"size (1000) must not exceed the token limit (500)"},
+		},
+		{
+			name: "several problems",
+			modify: func(c *Config) {
+				c.LogLevel = "loud"
+				c.Batch.MaxInputs = 0
+				c.Chunking.Strategy = "paragraphs"
+				c.Tokens.Policy = "ignore"
+			},
+			wantErr: []string{"logLevel", "batch", "chunking", "tokens"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Embedder.Provider = common.ProviderFake
+			cfg.VectorProperty, cfg.PropertyToEmbed, cfg.HashProperty = "vector", "text", "hash"
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			for _, want := range tt.wantErr {
+				assert.ErrorContains(t, err, want, "expected the problem to be reported")
+			}
+		})
+	}
+}
+
+func TestInvocationTimeoutFromHost(t *testing.T) {
+	assert.Equal(t, 9*time.Minute+30*time.Second, invocationTimeoutFromHost(writeFile(t, "host.json", `{"functionTimeout": "00:10:00"}`)),
+		"expected a margin of 30 seconds")
+	assert.Equal(t, 54*time.Second, invocationTimeoutFromHost(writeFile(t, "host.json", `{"functionTimeout": "00:01:00"}`)),
+		"expected a margin of a tenth of the timeout")
+	assert.Zero(t, invocationTimeoutFromHost(writeFile(t, "host.json", `{"functionTimeout": "-1"}`)), "expected no timeout")
+}
+
+func TestEmbeddingTimeoutFor(t *testing.T) {
+	assert.Equal(t, 8*time.Minute+30*time.Second, embeddingTimeoutFor(9*time.Minute+30*time.Second), "expected a margin of a minute")
+	assert.Equal(t, 40*time.Second, embeddingTimeoutFor(50*time.Second), "expected a margin of a fifth of the timeout")
+	assert.Zero(t, embeddingTimeoutFor(0), "expected no timeout")
+}
+
+func TestConfigureResolvesTokenLimitOfDefaultModel(t *testing.T) {
+	t.Setenv("EMBEDDING_PROVIDER", common.ProviderOllama)
+	t.Setenv("COSMOS_VECTOR_PROPERTY", "vector")
+	t.Setenv("COSMOS_PROPERTY_TO_EMBED", "text")
+	t.Setenv("COSMOS_HASH_PROPERTY", "hash")
+	t.Setenv("EMBEDDING_CACHE_SIZE", "0")
+	t.Setenv("AzureWebJobsScriptRoot", t.TempDir())
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+	require.NoError(t, configure(cfg))
+	assert.Equal(t, 8192, maxTokens, "expected the limit of the default model of Ollama")
+	assert.Equal(t, 8192, settings.MaxTokens, "expected the settings to hash the limit of the default model")
+
+	cfg.Chunking.Strategy, cfg.Chunking.Size = common.ChunkTokens, 8193
+	assert.ErrorContains(t, configure(cfg), "size (8193) must not exceed the token limit (8192)", "expected the chunk size to be checked against the limit of the default model")
+}
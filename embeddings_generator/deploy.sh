@@ -26,8 +26,8 @@ echo "Function app plan $FUNCTION_APP_PLAN_NAME created."
 az functionapp create --name $FUNCTION_APP_NAME --storage-account $STORAGE_ACC_NAME --plan $FUNCTION_APP_PLAN_NAME --resource-group $RG_NAME --functions-version 4 --runtime custom
 echo "Function app $FUNCTION_APP_NAME created."
 
-# Build Go binary for Windows
-GOOS=windows GOARCH=amd64 go build -o main.exe main.go
+# Build Go binary for Windows, stamped with the version recorded in the embedding metadata
+GOOS=windows GOARCH=amd64 go build -ldflags "-X main.version=$(git describe --tags --always --dirty 2>/dev/null || echo dev)" -o main.exe .
 
 # Publish function app (respond "no" to AzureWebJobsStorage overwrite prompt)
 func azure functionapp publish $FUNCTION_APP_NAME --publish-local-settings
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"embeddings_generator_function/common"
+)
+
+// fingerprintPrefix starts the fingerprints of the current format, "v2:sha256:<settings hash>:<text hash>".
+// Version 1 fingerprints are the bare SHA-256 hash of the text; they do not record the settings, so the
+// vectors they belong to are considered stale.
+const fingerprintPrefix = "v2:sha256:"
+
+// EmbeddingSettings are the settings that determine the vector of a text, besides the text itself.
+// A vector whose fingerprint was computed with different settings is stale, and is embedded again.
+type EmbeddingSettings struct {
+	Provider   string `json:"provider"`
+	Model      string `json:"model"`
+	Dimensions int    `json:"dimensions"`
+	Normalize  bool   `json:"normalize"`
+	// Tokenizer is "approximate", "cl100k_base" or the name of the tokenizer file. It depends on the configuration
+	// only: the cl100k_base ranks are part of every build.
+	Tokenizer   string                  `json:"tokenizer"`
+	MaxTokens   int                     `json:"maxTokens"`
+	TokenPolicy common.TokenLimitPolicy `json:"tokenPolicy"`
+	Chunking    struct {
+		Strategy common.ChunkStrategy `json:"strategy"`
+		Size     int                  `json:"size"`
+		Overlap  int                  `json:"overlap"`
+		Output   common.ChunkOutput   `json:"output"`
+	} `json:"chunking"`
+}
+
+// Hash returns the SHA-256 hash of the settings.
+func (s EmbeddingSettings) Hash() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal embedding settings: %v", err))
+	}
+	return computeJSONHash(string(data))
+}
+
+// fingerprint is the parsed fingerprint of a vector.
+type fingerprint struct {
+	settingsHash string
+	textHash     string
+}
+
+// newFingerprint computes the fingerprint of the vector of a text embedded with the settings of settingsHash.
+func newFingerprint(settingsHash, text string) fingerprint {
+	return fingerprint{settingsHash: settingsHash, textHash: computeJSONHash(text)}
+}
+
+// String formats the fingerprint as stored in documents.
+func (f fingerprint) String() string {
+	return fingerprintPrefix + f.settingsHash + ":" + f.textHash
+}
+
+// parseFingerprint parses a stored fingerprint. Version 1 fingerprints have no settings hash.
+func parseFingerprint(value string) (fingerprint, error) {
+	if !strings.HasPrefix(value, fingerprintPrefix) {
+		if isSHA256(value) {
+			return fingerprint{textHash: value}, nil
+		}
+		return fingerprint{}, fmt.Errorf("unknown fingerprint format %q", value)
+	}
+
+	settingsHash, textHash, found := strings.Cut(strings.TrimPrefix(value, fingerprintPrefix), ":")
+	if !found || !isSHA256(settingsHash) || !isSHA256(textHash) {
+		return fingerprint{}, fmt.Errorf("invalid fingerprint %q", value)
+	}
+	return fingerprint{settingsHash: settingsHash, textHash: textHash}, nil
+}
+
+// isSHA256 reports whether s is a hex encoded SHA-256 hash.
+func isSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 2*sha256.Size
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"embeddings_generator_function/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprint(t *testing.T) {
+	settings := EmbeddingSettings{Provider: common.ProviderAzureOpenAI, Model: "text-embedding-ada-002", Dimensions: 1536}
+	fp := newFingerprint(settings.Hash(), "text")
+
+	parsed, err := parseFingerprint(fp.String())
+	require.NoError(t, err)
+	assert.Equal(t, fp, parsed, "expected the fingerprint to round-trip")
+	assert.Regexp(t, `^v2:sha256:[0-9a-f]{64}:[0-9a-f]{64}$`, fp.String(), "unexpected format")
+
+	legacy, err := parseFingerprint(computeJSONHash("text"))
+	require.NoError(t, err)
+	assert.Equal(t, fingerprint{textHash: fp.textHash}, legacy, "expected a version 1 fingerprint without settings")
+
+	for _, invalid := range []string{"", "abc", "v2:sha256:abc:def", "v3:sha256:" + fp.settingsHash + ":" + fp.textHash} {
+		_, err := parseFingerprint(invalid)
+		assert.Error(t, err, "expected %q to be invalid", invalid)
+	}
+}
+
+func TestEmbeddingSettingsHash(t *testing.T) {
+	base := EmbeddingSettings{Provider: common.ProviderAzureOpenAI, Model: "text-embedding-ada-002", Dimensions: 1536}
+	assert.Equal(t, base.Hash(), base.Hash(), "expected a stable hash")
+
+	changes := []func(s *EmbeddingSettings){
+		func(s *EmbeddingSettings) { s.Model = "text-embedding-3-large" },
+		func(s *EmbeddingSettings) { s.Dimensions = 256 },
+		func(s *EmbeddingSettings) { s.Normalize = true },
+		func(s *EmbeddingSettings) { s.Chunking.Strategy = common.ChunkSentences },
+		func(s *EmbeddingSettings) { s.TokenPolicy = common.TruncateHead },
+	}
+	for i, change := range changes {
+		changed := base
+		change(&changed)
+		assert.NotEqual(t, base.Hash(), changed.Hash(), "expected change %d to change the hash", i)
+	}
+}
+
+func TestEmbeddingSettingsTokenizer(t *testing.T) {
+	embedder := common.NewFakeEmbedder("text-embedding-3-small", 1536)
+	hash := func(provider string, tokens common.TokenLimitOptions) string {
+		cfg := &Config{Embedder: common.EmbedderOptions{Provider: provider}, Tokens: tokens}
+		return cfg.embeddingSettings(embedder).Hash()
+	}
+
+	assert.Equal(t, hash(common.ProviderOpenAI, common.TokenLimitOptions{Tokenizer: common.TokenizerCL100k}), hash(common.ProviderOpenAI, common.TokenLimitOptions{}),
+		"expected the default tokenizer of OpenAI to hash like the explicit cl100k_base tokenizer")
+	assert.Equal(t, hash(common.ProviderOllama, common.TokenLimitOptions{TokenizerFile: "/a/o200k_base.tiktoken"}), hash(common.ProviderOllama, common.TokenLimitOptions{TokenizerFile: "/b/o200k_base.tiktoken"}),
+		"expected the tokenizer file to be hashed by name")
+	assert.NotEqual(t, hash(common.ProviderOpenAI, common.TokenLimitOptions{Tokenizer: common.TokenizerApproximate}), hash(common.ProviderOpenAI, common.TokenLimitOptions{}),
+		"expected the tokenizer to change the hash")
+}
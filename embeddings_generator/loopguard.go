@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"embeddings_generator_function/common"
+)
+
+const (
+	defaultLoopGuardProperty       = "embeddingOrigin"
+	defaultLoopGuardMaxGenerations = 5
+	defaultLoopGuardWindow         = time.Minute
+
+	// originName identifies the writes of this function in origin markers.
+	originName = "embeddings-generator"
+)
+
+// LoopGuardOptions configures the protection against the loop caused by writing the enriched documents back to the
+// container that triggers the function: each write triggers the function again with the document it wrote.
+//
+// Every enriched document carries an origin marker with the hash of its content, without the properties the
+// function writes, and the number of consecutive writes (the generation). A document whose content still matches
+// its marker was triggered by the function's own write, and is not written again. A document that is written
+// more than MaxGenerations times in a row, each time within Window of the previous write (measured with the _ts
+// of the document), is reported as a suspected loop instead of being written.
+type LoopGuardOptions struct {
+	// Property is the property the origin marker is written to. Empty disables the guard.
+	Property string `json:"property"`
+	// MaxGenerations is the maximum number of consecutive writes. Zero does not limit them.
+	MaxGenerations int             `json:"maxGenerations"`
+	Window         common.Duration `json:"window"`
+
+	path common.Path
+}
+
+// DefaultLoopGuardOptions returns the loop guard used by default.
+func DefaultLoopGuardOptions() LoopGuardOptions {
+	return LoopGuardOptions{
+		Property:       defaultLoopGuardProperty,
+		MaxGenerations: defaultLoopGuardMaxGenerations,
+		Window:         common.Duration(defaultLoopGuardWindow),
+	}
+}
+
+// loadEnv overrides the options with the LOOP_GUARD (false disables the guard), LOOP_GUARD_PROPERTY,
+// LOOP_GUARD_MAX_GENERATIONS and LOOP_GUARD_WINDOW environment variables that are set.
+func (o *LoopGuardOptions) loadEnv() error {
+	o.Property = common.StringFromEnv("LOOP_GUARD_PROPERTY", o.Property)
+
+	var err error
+	if o.MaxGenerations, err = common.IntFromEnv("LOOP_GUARD_MAX_GENERATIONS", o.MaxGenerations); err != nil {
+		return err
+	}
+	window, err := common.DurationFromEnv("LOOP_GUARD_WINDOW", time.Duration(o.Window))
+	if err != nil {
+		return err
+	}
+	o.Window = common.Duration(window)
+
+	enabled, err := common.BoolFromEnv("LOOP_GUARD", true)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		o.Property = ""
+	}
+	return nil
+}
+
+// Enabled reports whether the guard is enabled.
+func (o LoopGuardOptions) Enabled() bool {
+	return o.Property != ""
+}
+
+// validate checks the options and parses the marker property, which must not collide with the properties of
+// the vectors.
+func (o *LoopGuardOptions) validate(specs []VectorSpec) []error {
+	if o.MaxGenerations < 0 {
+		return []error{errors.New("loopGuard: maxGenerations must not be negative")}
+	}
+	if !o.Enabled() {
+		return nil
+	}
+
+	path, err := common.ParsePath(o.Property)
+	if err != nil {
+		return []error{fmt.Errorf("loopGuard: property: %w", err)}
+	}
+	if reserved(path) {
+		return []error{fmt.Errorf("loopGuard: property %s is a reserved property", o.Property)}
+	}
+
+	type property struct {
+		role, name string
+		path       common.Path
+	}
+
+	var errs []error
+	for _, s := range specs {
+		properties := []property{{"target", s.Target, s.targetPath}, {"hashProperty", s.HashProperty, s.hashPath}}
+		if s.Source != "" {
+			properties = append(properties, property{"source", s.Source, s.sourcePath})
+		}
+		if s.MetadataProperty != "" {
+			properties = append(properties, property{"metadataProperty", s.MetadataProperty, s.metadataPath})
+		}
+		for _, p := range properties {
+			if overlaps(path, p.path) {
+				errs = append(errs, fmt.Errorf("loopGuard: property %s collides with %s %s", o.Property, p.role, p.name))
+			}
+		}
+	}
+
+	o.path = path
+	return errs
+}
+
+// originMarker is the marker the loop guard writes to the enriched documents.
+type originMarker struct {
+	Origin      string `json:"origin"`
+	Generation  int    `json:"generation"`
+	ContentHash string `json:"contentHash"`
+	// WrittenAt is the time of the write in seconds since the epoch, like _ts.
+	WrittenAt int64 `json:"writtenAt"`
+}
+
+// readMarker returns the origin marker of a document, if it has a valid one.
+func (o LoopGuardOptions) readMarker(doc map[string]any) (originMarker, bool) {
+	value, exists := o.path.Get(doc)
+	if !exists {
+		return originMarker{}, false
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return originMarker{}, false
+	}
+	var marker originMarker
+	if err := json.Unmarshal(data, &marker); err != nil || marker.Origin != originName || marker.ContentHash == "" {
+		return originMarker{}, false
+	}
+	return marker, true
+}
+
+// contentHash returns the hash of the content of a document: the document without its system properties, the
+// origin marker, and the properties written for the vectors.
+func (o LoopGuardOptions) contentHash(doc map[string]any, specs []VectorSpec) string {
+	content := common.CloneDocument(doc)
+	for key := range content {
+		if strings.HasPrefix(key, "_") {
+			delete(content, key)
+		}
+	}
+	o.path.Delete(content)
+	for _, spec := range specs {
+		spec.targetPath.Delete(content)
+		spec.hashPath.Delete(content)
+		if spec.MetadataProperty != "" {
+			spec.metadataPath.Delete(content)
+		}
+	}
+
+	// Maps are marshalled with sorted keys, so the hash does not depend on the order of the properties
+	data, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	return computeJSONHash(string(data))
+}
+
+// LoopError is returned for a document that was written too many times in a row.
+type LoopError struct {
+	Generation int
+	Window     time.Duration
+}
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("document was written %d times in a row, each within %s of the previous write", e.Generation-1, e.Window)
+}
+
+// recent reports whether the current change of a document happened within the window of the write of its
+// marker. The time of the change is the _ts of the document, or now if it has none.
+func (o LoopGuardOptions) recent(doc map[string]any, marker originMarker) bool {
+	modifiedAt := now().Unix()
+	if ts, ok := number(doc["_ts"]); ok {
+		modifiedAt = int64(ts)
+	}
+	return time.Duration(modifiedAt-marker.WrittenAt)*time.Second <= time.Duration(o.Window)
+}
+
+// nextGeneration returns the generation of the next write of a document with the given marker, or a *LoopError
+// if the write exceeds the maximum number of consecutive writes.
+func (o LoopGuardOptions) nextGeneration(doc map[string]any, marker originMarker, found bool) (int, error) {
+	if !found || !o.recent(doc, marker) {
+		return 1, nil
+	}
+
+	generation := marker.Generation + 1
+	if o.MaxGenerations > 0 && generation > o.MaxGenerations {
+		return 0, &LoopError{Generation: generation, Window: time.Duration(o.Window)}
+	}
+	return generation, nil
+}
+
+// newMarker returns the marker written to a document with the given content hash.
+func newMarker(contentHash string, generation int) originMarker {
+	return originMarker{Origin: originName, Generation: generation, ContentHash: contentHash, WrittenAt: now().Unix()}
+}
+
+// selfTriggeredTotal counts the documents suppressed as triggered by the function's own writes since the start.
+var selfTriggeredTotal atomic.Int64
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo returns the document Cosmos DB delivers to the function after it wrote an enriched document.
+func echo(t *testing.T, doc map[string]any, delay time.Duration) map[string]any {
+	t.Helper()
+
+	marker, ok := doc[defaultLoopGuardProperty].(originMarker)
+	require.True(t, ok, "expected an origin marker")
+
+	echoed := map[string]any{"_ts": float64(marker.WrittenAt + int64(delay/time.Second))}
+	for key, value := range doc {
+		echoed[key] = value
+	}
+	return echoed
+}
+
+func TestProcessDocumentsSuppressesSelfTriggeredDocuments(t *testing.T) {
+	setup(t, nil)
+
+	output, _ := processDocuments(context.Background(), testDocuments(2), failurePolicy)
+	require.Len(t, output, 2, "expected both documents to be enriched")
+	marker := output[0][defaultLoopGuardProperty].(originMarker)
+	assert.Equal(t, 1, marker.Generation, "expected the first generation")
+
+	before := selfTriggeredTotal.Load()
+	documents := []map[string]any{echo(t, output[0], time.Second), echo(t, output[1], time.Second)}
+	documents[1]["title"] = "changed by another writer"
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no document to be written again")
+	assert.Equal(t, 1, result.SelfTriggered, "expected the echo of the enrichment to be suppressed")
+	assert.Equal(t, before+1, selfTriggeredTotal.Load(), "expected the suppressed document to be counted")
+}
+
+func TestProcessDocumentsStopsWriteLoops(t *testing.T) {
+	setup(t, map[string]string{"LOOP_GUARD_MAX_GENERATIONS": "2", "LOOP_GUARD_WINDOW": "10s"})
+
+	doc := testDocuments(1)[0]
+	output, _ := processDocuments(context.Background(), []map[string]any{doc}, failurePolicy)
+	require.Len(t, output, 1, "expected the document to be enriched")
+
+	// Another writer modifies the text right after every enrichment
+	doc = echo(t, output[0], time.Second)
+	doc["text"] = "modified once"
+	output, _ = processDocuments(context.Background(), []map[string]any{doc}, failurePolicy)
+	require.Len(t, output, 1, "expected the modified document to be enriched")
+	assert.Equal(t, 2, output[0][defaultLoopGuardProperty].(originMarker).Generation, "expected the second generation")
+
+	doc = echo(t, output[0], time.Second)
+	doc["text"] = "modified twice"
+	output, result := processDocuments(context.Background(), []map[string]any{doc}, failurePolicy)
+	assert.Empty(t, output, "expected the loop to be stopped")
+	require.Len(t, result.Skipped, 1, "expected the document to be skipped")
+	assert.Equal(t, WriteLoop, result.Skipped[0].Kind, "unexpected kind")
+
+	// A modification after the window starts over
+	doc["_ts"] = doc["_ts"].(float64) + 60
+	output, _ = processDocuments(context.Background(), []map[string]any{doc}, failurePolicy)
+	require.Len(t, output, 1, "expected the document to be enriched")
+	assert.Equal(t, 1, output[0][defaultLoopGuardProperty].(originMarker).Generation, "expected the first generation")
+}
+
+func TestProcessDocumentsReembedsInvalidHash(t *testing.T) {
+	setup(t, nil)
+
+	documents := testDocuments(1)
+	documents[0]["hash"] = 42
+
+	output, _ := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 1, "expected a document with an invalid hash to be embedded again")
+	assert.Equal(t, newFingerprint(settingsHash, "text of document 0").String(), output[0]["hash"], "expected the hash to be repaired")
+}
+
+func TestProcessDocumentsWithoutLoopGuard(t *testing.T) {
+	setup(t, map[string]string{"LOOP_GUARD": "false"})
+
+	output, _ := processDocuments(context.Background(), testDocuments(1), failurePolicy)
+
+	require.Len(t, output, 1, "expected the document to be enriched")
+	assert.NotContains(t, output[0], defaultLoopGuardProperty, "expected no origin marker")
+}
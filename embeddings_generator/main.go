@@ -1,30 +1,65 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"embeddings_generator_function/common"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"maps"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
 )
 
 const defaultPort = "8080"
 
 var (
-	cosmosVectorPropertyName        string
-	cosmosVectorPropertyToEmbedName string
-	cosmosHashPropertyName          string
-	logs                            []string
+	logLevel         customhandler.Level
+	failurePolicy    FailurePolicy
+	validationPolicy ValidationPolicy
+	batchOptions     common.BatchOptions
+	embedder         common.Embedder
+	embeddingCache   *common.EmbeddingCache
+	normalize        bool
+	settings         EmbeddingSettings
+	settingsHash     string
+	metadataFields   []string
+	chunkOptions     common.ChunkOptions
+	tokenLimit       common.TokenLimitOptions
+	tokenizer        common.Tokenizer
+	maxTokens        int
+	vectorSpecs      []VectorSpec
+	loopGuard        LoopGuardOptions
+	outputMode       OutputMode
+	items            itemClient
+	projection       []common.Path
+	// sourcePartitionKey is the partition key path of the source container, referred to by sidecar documents
+	sourcePartitionKey common.Path
+
+	invocationTimeout time.Duration
+	embeddingTimeout  time.Duration
+	parallelism       int
+
+	maxConflictRetries int
+	onConflict         ConflictPolicy
+)
+
+var (
+	errInvocationDeadline = errors.New("invocation deadline exceeded")
+	errEmbeddingDeadline  = errors.New("embedding deadline exceeded")
 )
 
+// keysToRemove are the system properties that Cosmos DB adds to every document. They are removed
+// before the enriched documents are written back. The vector and hash properties are kept: the vectors
+// are overwritten anyway, and the hashes are needed to detect unchanged documents. The _etag is kept
+// by the document task, as the condition of the writes of the Cosmos DB client.
 var keysToRemove = []string{
-	cosmosVectorPropertyName,
-	//cosmosHashPropertyName,
 	"_rid",
 	"_self",
 	"_etag",
@@ -33,14 +68,99 @@ var keysToRemove = []string{
 	"_ts",
 }
 
-func init() {
-	logs = []string{}
-	cosmosVectorPropertyName = os.Getenv("COSMOS_VECTOR_PROPERTY")
-	cosmosVectorPropertyToEmbedName = os.Getenv("COSMOS_PROPERTY_TO_EMBED")
-	cosmosHashPropertyName = os.Getenv("COSMOS_HASH_PROPERTY")
+// configure applies a validated configuration and creates the embedder.
+func configure(cfg *Config) error {
+	logLevel = cfg.logLevel
+	failurePolicy = cfg.failurePolicy
+	validationPolicy = cfg.validationPolicy
+	batchOptions = cfg.Batch
+	chunkOptions = cfg.Chunking
+	tokenLimit = cfg.Tokens
+	vectorSpecs = cfg.vectors
+	loopGuard = cfg.LoopGuard
+	invocationTimeout = time.Duration(cfg.InvocationTimeout)
+	embeddingTimeout = time.Duration(cfg.EmbeddingTimeout)
+	parallelism = cfg.Parallelism
+	outputMode = cfg.Output.Mode
+	maxConflictRetries = cfg.Output.MaxConflictRetries
+	onConflict = cfg.Output.OnConflict
+	projection = cfg.Output.projection
+	sourcePartitionKey = cfg.Output.sourcePartitionKey
+
+	var err error
+	if tokenizer, err = cfg.Tokens.NewTokenizer(cfg.Embedder.Provider); err != nil {
+		return fmt.Errorf("failed to load tokenizer: %w", err)
+	}
+	chunkOptions.Tokenizer = tokenizer
+	log.Printf("Counting tokens with the %s tokenizer", cfg.Tokens.TokenizerName(cfg.Embedder.Provider))
+
+	embedder, err = common.NewEmbedder(cfg.Embedder)
+	if err != nil {
+		return fmt.Errorf("failed to create %s embedder: %w", cfg.Embedder.Provider, err)
+	}
+	// The token limit is that of the model the embedder uses, which is its default model if none is configured
+	maxTokens = cfg.Tokens.MaxTokensFor(embedder.Model())
+	if err := cfg.checkChunkSize(maxTokens); err != nil {
+		return err
+	}
+	// The rate limiter is applied to every attempt, so that retries count against the budgets too,
+	// and the tokens are counted like those of the chunks
+	rateLimit := cfg.RateLimit
+	rateLimit.Tokenizer = tokenizer
+	embedder = common.WithRetry(common.WithRateLimit(embedder, rateLimit), cfg.Retry)
+
+	embeddingCache = nil
+	if cfg.Cache.Enabled() {
+		if embeddingCache, err = common.NewEmbeddingCache(cfg.Cache); err != nil {
+			return fmt.Errorf("failed to create embedding cache: %w", err)
+		}
+		embedder = common.WithCache(embedder, embeddingCache)
+	}
+
+	items = nil
+	switch outputMode {
+	case OutputBinding:
+	case OutputSidecar:
+		target := cfg.Output.target()
+		client, err := common.NewCosmosClient(target)
+		if err != nil {
+			return fmt.Errorf("failed to create Cosmos DB client: %w", err)
+		}
+		items = client
+		log.Printf("Writing vectors to sidecar container %s of database %s, partitioned by %s", target.Container, target.Database, target.PartitionKey)
+	default:
+		client, err := common.NewCosmosClient(cfg.Output.Cosmos)
+		if err != nil {
+			return fmt.Errorf("failed to create Cosmos DB client: %w", err)
+		}
+		items = client
+		log.Printf("Writing enriched documents to container %s of database %s (output mode %s)", cfg.Output.Cosmos.Container, cfg.Output.Cosmos.Database, outputMode)
+	}
+
+	normalize = cfg.Normalize
+	metadataFields = cfg.metadataFields
+	settings = cfg.embeddingSettings(embedder)
+	settingsHash = settings.Hash()
+
+	log.Printf("Using %s embedder with model %s", cfg.Embedder.Provider, embedder.Model())
+	log.Printf("Embedding settings hash %s: %+v", settingsHash, settings)
+	if cfg.Embedder.Provider == common.ProviderAzureOpenAI && cfg.Embedder.Credential == nil {
+		log.Printf("Authenticating to Azure OpenAI with %s", cfg.Embedder.Auth.Describe(cfg.Embedder.APIKey))
+	}
+	return nil
 }
 
 func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	log.Printf("Effective configuration: %s", cfg)
+
+	if err := configure(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	addr := ":" + defaultPort
 	http.HandleFunc("/cosmosdbprocessor", EmbeddingHandler)
 
@@ -53,12 +173,17 @@ func main() {
 
 // EmbeddingHandler processes incoming Cosmos DB documents and generates embeddings for them.
 func EmbeddingHandler(w http.ResponseWriter, req *http.Request) {
-	logs = []string{"function invoked"}
-	logs = append(logs,
-		fmt.Sprintf("cosmosVectorPropertyName: %s", cosmosVectorPropertyName),
-		fmt.Sprintf("cosmosVectorPropertyToEmbedName: %s", cosmosVectorPropertyToEmbedName),
-		fmt.Sprintf("cosmosHashPropertyName: %s", cosmosHashPropertyName),
-	)
+	logger := customhandler.NewLogger(logLevel)
+
+	// The request context is cancelled when the host closes the connection, e.g. because it timed out the invocation
+	ctx := customhandler.WithLogger(req.Context(), logger)
+	if invocationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, invocationTimeout, errInvocationDeadline)
+		defer cancel()
+	}
+
+	logger.Infof("function invoked")
 
 	payloadBytes, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -67,52 +192,46 @@ func EmbeddingHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	documents, err := common.Parse[map[string]any](payloadBytes)
+	documents, err := customhandler.Parse[map[string]any](payloadBytes)
 	if err != nil {
 		log.Printf("Failed to parse payload: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to parse payload: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	logs = append(logs, fmt.Sprintf("Processing %d documents", len(documents)))
+	logger.Infof("Processing %d documents", len(documents))
 
-	var outputDocuments []map[string]any
-	for _, doc := range documents {
-		docID := doc["id"].(string)
-		logs = append(logs,
-			fmt.Sprintf("Processing document ID: %s", docID),
-			fmt.Sprintf("Document data: %s", doc[cosmosVectorPropertyToEmbedName].(string)),
-		)
-
-		isNew, hashValue := isDocumentNewOrModified(doc, cosmosHashPropertyName, cosmosVectorPropertyToEmbedName)
-		logs = append(logs, fmt.Sprintf("Document modification status: %t, hash: %s", isNew, hashValue))
-
-		if isNew {
-			// Cleanse the document of system properties
-			doc = cleanse(doc, keysToRemove)
-
-			docWithEmbedding, err := process(doc, hashValue, common.CreateEmbedding)
-			if err != nil {
-				log.Printf("Failed to process document %s: %v", docID, err)
-				http.Error(w, fmt.Sprintf("Failed to process document: %v", err), http.StatusInternalServerError)
-				return
-			}
+	outputDocuments, result := processDocuments(ctx, documents, failurePolicy)
 
-			outputDocuments = append(outputDocuments, docWithEmbedding)
-		}
+	if err := req.Context().Err(); err != nil {
+		log.Printf("Invocation cancelled by the host after processing %d of %d documents: %v", result.Enriched, len(documents), err)
+		return
+	}
+
+	for _, failure := range result.Failed {
+		logger.Errorf("Failed to process document %s (index %d): %s", failure.ID, failure.Index, failure.Reason)
+	}
+	if len(result.Skipped) > 0 {
+		logger.Warnf("Skipped %d invalid documents", len(result.Skipped))
+	}
+
+	if failurePolicy.exceeded(len(result.Failed), len(documents)) {
+		log.Printf("Failed to process %d of %d documents (failure policy %s)", len(result.Failed), len(documents), failurePolicy)
+		http.Error(w, fmt.Sprintf("Failed to process %d of %d documents: %s", len(result.Failed), len(documents), result.Failed[0].Reason), http.StatusInternalServerError)
+		return
 	}
 
 	output := map[string]any{}
 	if len(outputDocuments) > 0 {
-		logs = append(logs, fmt.Sprintf("Adding %d documents with embeddings", len(outputDocuments)))
+		logger.Infof("Adding %d documents with embeddings", len(outputDocuments))
 		output["outputData"] = outputDocuments
-		logs = append(logs, "Added enriched documents to binding output")
+		logger.Infof("Added enriched documents to binding output")
 	}
 
-	response := common.InvokeResponse{
+	response := customhandler.InvokeResponse{
 		Outputs:     output,
-		Logs:        logs,
-		ReturnValue: nil,
+		Logs:        logger.Lines(),
+		ReturnValue: result,
 	}
 
 	responseJSON, err := json.Marshal(response)
@@ -126,61 +245,463 @@ func EmbeddingHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(responseJSON)
 }
 
-// process generates embeddings for a document and adds them along with a hash value.
-func process(doc map[string]any, hashValue string, createEmbedding func(input string) ([]float32, error)) (map[string]any, error) {
-	result := maps.Clone(doc)
+// processDocuments generates embeddings for the new or modified documents of a batch.
+// The documents are prepared and finished by up to parallelism workers, and the texts of all documents
+// are embedded together in as few requests as possible. The lines each document logs are kept together,
+// and the output documents and failures are reported in the order of the input documents. A failed
+// document does not prevent the remaining ones from being processed, unless the policy is fail-fast.
+// Documents that fail validation are skipped or failed according to the validation policy.
+// Once ctx is done, the documents that have not been embedded yet fail with the cause of the context.
+func processDocuments(ctx context.Context, documents []map[string]any, policy FailurePolicy) ([]map[string]any, InvocationResult) {
+	logger := customhandler.LoggerFromContext(ctx)
+	result := InvocationResult{Received: len(documents)}
+
+	// With fail-fast, the first failed document cancels the work on the other documents
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	tasks := make([]documentTask, len(documents))
+	for index, doc := range documents {
+		tasks[index] = documentTask{index: index, doc: doc, logger: logger.Child()}
+	}
+
+	// flush moves the lines logged by the documents to the invocation logs, in document order
+	flush := func() {
+		for i := range tasks {
+			logger.Flush(tasks[i].logger)
+		}
+	}
+
+	// run calls fn for each document that has not failed yet, with up to parallelism documents at a time
+	run := func(fn func(ctx context.Context, t *documentTask) error) {
+		common.ForEach(len(tasks), parallelism, func(i int) {
+			t := &tasks[i]
+			if t.err != nil {
+				return
+			}
+			if t.err = fn(customhandler.WithLogger(ctx, t.logger), t); t.err != nil && policy.abortOnFailure() && !skipped(t.err) {
+				cancel(fmt.Errorf("document %d failed and the failure policy is %s", t.index, policy))
+			}
+		})
+		flush()
+	}
+
+	run(func(ctx context.Context, t *documentTask) error {
+		return t.prepare(ctx)
+	})
+
+	var inputs []string
+	var pending int
+	for i := range tasks {
+		t := &tasks[i]
+		if t.err != nil || len(t.vectors) == 0 {
+			continue
+		}
+		pending++
+		for j := range t.vectors {
+			t.vectors[j].firstInput = len(inputs)
+			for _, chunk := range t.vectors[j].chunks {
+				inputs = append(inputs, chunk.Text)
+			}
+		}
+	}
+
+	if len(inputs) > 0 {
+		logger.Infof("Creating %d embeddings for %d documents", len(inputs), pending)
+
+		embedCtx := ctx
+		if embeddingTimeout > 0 {
+			var cancel context.CancelFunc
+			embedCtx, cancel = context.WithTimeoutCause(ctx, embeddingTimeout, errEmbeddingDeadline)
+			defer cancel()
+		}
+		embedCtx, cacheStats := common.WithCacheStats(embedCtx)
+		results := common.EmbedAll(embedCtx, embedder, inputs, batchOptions)
+
+		if embeddingCache != nil {
+			stats, total := cacheStats(), embeddingCache.Stats()
+			logger.Infof("Embedding cache: %d hits, %d misses (%d hits, %d misses since start)", stats.Hits, stats.Misses, total.Hits, total.Misses)
+			result.Cache = &stats
+		}
+
+		run(func(ctx context.Context, t *documentTask) error {
+			return t.finish(ctx, results)
+		})
+	}
+
+	// The write phase runs even without embeddings, for sidecar documents whose projected properties changed
+	if outputMode != OutputBinding {
+		run(func(ctx context.Context, t *documentTask) error {
+			if t.output == nil {
+				return nil
+			}
+			return t.write(ctx)
+		})
+	}
+
+	// With fail-fast, the documents after the first failed one are not reported, but the writes of all documents
+	// are, because the documents written before the failure stopped the others stay written
+	var outputDocuments []map[string]any
+	aborted := false
+	for _, t := range tasks {
+		if t.selfTriggered {
+			result.SelfTriggered++
+		}
+		if t.written != nil {
+			if t.err != nil {
+				t.written.Outcome = WriteFailed
+			}
+			result.Writes = append(result.Writes, *t.written)
+			result.RequestCharge += t.written.RequestCharge
+		}
+		if aborted {
+			continue
+		}
+		if t.err != nil {
+			failure := DocumentFailure{ID: t.id, Index: t.index, Reason: t.err.Error()}
+
+			var validationErr *ValidationError
+			if errors.As(t.err, &validationErr) {
+				failure.Kind = validationErr.Kind
+			}
+
+			if skipped(t.err) {
+				logger.Warnf("Skipping document %s (index %d): %v", t.id, t.index, t.err)
+				result.Skipped = append(result.Skipped, failure)
+				continue
+			}
+
+			result.Failed = append(result.Failed, failure)
+			if policy.abortOnFailure() {
+				logger.Warnf("Skipping remaining documents, failure policy is %s", policy)
+				aborted = true
+			}
+			continue
+		}
+
+		if t.output == nil {
+			continue
+		}
+		result.Enriched++
+		// Documents written with the Cosmos DB client are not returned to the output binding
+		if outputMode == OutputBinding {
+			outputDocuments = append(outputDocuments, t.output)
+		}
+	}
 
-	embedding, err := createEmbedding(doc[cosmosVectorPropertyToEmbedName].(string))
+	if len(result.Writes) > 0 {
+		logger.Infof("Wrote %d documents with the Cosmos DB client for %.2f RUs", len(result.Writes), result.RequestCharge)
+	}
+	if result.SelfTriggered > 0 {
+		total := selfTriggeredTotal.Add(int64(result.SelfTriggered))
+		logger.Infof("Suppressed %d self-triggered documents (%d since start)", result.SelfTriggered, total)
+	}
+
+	if aborted {
+		return nil, result
+	}
+	return outputDocuments, result
+}
+
+// skipped reports whether a document that failed with err is skipped rather than failed, according to the validation policy.
+func skipped(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr) && validationPolicy.action(validationErr.Kind) == SkipDocument
+}
+
+// documentTask is the state of a document while it is processed.
+type documentTask struct {
+	index  int
+	doc    map[string]any
+	logger *customhandler.Logger
+
+	id          string
+	vectors     []pendingVector
+	enrichments []enrichment
+	output      map[string]any
+	err         error
+
+	// etag is the etag of the document as read from the change feed, the condition of the writes of the Cosmos DB client
+	etag string
+	// written is the outcome of writing the document with the Cosmos DB client
+	written *DocumentWrite
+
+	// contentHash and generation are written to the origin marker of the document by the loop guard
+	contentHash string
+	generation  int
+	// selfTriggered is set if the document was triggered by its own enrichment, and is not processed
+	selfTriggered bool
+	// sidecar is the existing sidecar document of the document with OutputSidecar
+	sidecar map[string]any
+}
+
+// pendingVector is a vector of a document whose text is new or modified, and needs to be embedded.
+type pendingVector struct {
+	spec      *VectorSpec
+	hashValue string
+	text      common.LimitedText
+	chunking  common.ChunkOptions
+	chunks    []common.Chunk
+	// firstInput is the index of the embedding input of the first chunk of the text
+	firstInput int
+}
+
+// prepare validates the document, keeps the texts of the vectors that need to be embedded within the token
+// limit, and splits them into chunks.
+func (t *documentTask) prepare(ctx context.Context) error {
+	logger := customhandler.LoggerFromContext(ctx)
+
+	t.id, _ = t.doc["id"].(string)
+	if ctx.Err() != nil {
+		return fmt.Errorf("document not processed: %w", context.Cause(ctx))
+	}
+
+	docID, texts, err := validateDocument(t.doc, vectorSpecs)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Processing document ID: %s", docID)
+
+	var marker originMarker
+	var hasMarker bool
+	if loopGuard.Enabled() {
+		t.contentHash = loopGuard.contentHash(t.doc, vectorSpecs)
+		marker, hasMarker = loopGuard.readMarker(t.doc)
+		if hasMarker && marker.ContentHash == t.contentHash && loopGuard.recent(t.doc, marker) {
+			logger.Infof("Document %s was triggered by its own enrichment (generation %d), not processing it", docID, marker.Generation)
+			t.selfTriggered = true
+			return nil
+		}
+	}
+
+	// With OutputSidecar, the hashes of the vectors are stored in the sidecar document
+	hashes := t.doc
+	if outputMode == OutputSidecar {
+		if hashes, err = t.readSidecar(ctx); err != nil {
+			return err
+		}
+	}
+
+	for i, text := range texts {
+		spec := &vectorSpecs[i]
+		logger.Debugf("Document data for vector %s: %s", spec.Target, text)
+
+		isNew, hashValue := isDocumentNewOrModified(ctx, hashes, spec, text)
+		logger.Infof("Document modification status for vector %s: %t, hash: %s", spec.Target, isNew, hashValue)
+
+		if !isNew {
+			continue
+		}
+
+		// The hash is computed from the original text, so that a truncated text is not embedded again
+		limited, err := tokenLimit.Limit(tokenizer, text, maxTokens)
+		if err != nil {
+			return &ValidationError{Kind: TooManyTokens, Property: spec.Target, Err: err}
+		}
+		if limited.Truncated {
+			logger.Warnf("Truncated text of vector %s from %d to %d tokens (%s)", spec.Target, limited.OriginalTokens, limited.Tokens, tokenLimit.Policy)
+		}
+
+		chunking := chunkingFor(limited)
+		chunks := chunking.Split(limited.Text)
+		if len(chunks) > 1 {
+			logger.Infof("Split text of vector %s (%d tokens) into %d chunks", spec.Target, limited.Tokens, len(chunks))
+		}
+
+		t.vectors = append(t.vectors, pendingVector{spec: spec, hashValue: hashValue, text: limited, chunking: chunking, chunks: chunks})
+	}
+
+	if len(t.vectors) > 0 && loopGuard.Enabled() {
+		if t.generation, err = loopGuard.nextGeneration(t.doc, marker, hasMarker); err != nil {
+			return &ValidationError{Kind: WriteLoop, Property: loopGuard.Property, Err: err}
+		}
+	}
+
+	if len(t.vectors) > 0 {
+		t.etag, _ = t.doc["_etag"].(string)
+		// Cleanse the document of system properties
+		t.doc = cleanse(t.doc, keysToRemove)
+	} else if outputMode == OutputSidecar && t.projectionChanged() {
+		logger.Infof("Projected properties of document %s changed, updating its sidecar document", docID)
+		t.output = t.sidecarBase()
+	}
+
+	return nil
+}
+
+// chunkingFor returns the chunk options for a text. A text that exceeds the token limit and is handed off to
+// chunking while chunking is disabled is split into chunks of the token limit, whose embeddings are averaged
+// so that the vector has the same shape as those of the other documents.
+func chunkingFor(text common.LimitedText) common.ChunkOptions {
+	if !text.NeedsChunking || chunkOptions.Enabled() {
+		return chunkOptions
+	}
+	return common.ChunkOptions{Strategy: common.ChunkTokens, Size: maxTokens, Output: common.ChunkOutputMean, Tokenizer: tokenizer}
+}
+
+// finish adds the embeddings of the document, taken from the results of the embedding requests.
+func (t *documentTask) finish(ctx context.Context, results []common.EmbeddingResult) error {
+	if len(t.vectors) == 0 {
+		return nil
+	}
+
+	enrichments := make([]enrichment, 0, len(t.vectors))
+	for _, v := range t.vectors {
+		embeddings := make([][]float32, len(v.chunks))
+		for i := range v.chunks {
+			if err := results[v.firstInput+i].Err; err != nil {
+				return fmt.Errorf("failed to create embedding for vector %s: %w", v.spec.Target, err)
+			}
+			embeddings[i] = results[v.firstInput+i].Embedding
+		}
+		embedding, err := v.chunking.Combine(v.chunks, embeddings)
+		if err != nil {
+			return fmt.Errorf("failed to combine embeddings for vector %s: %w", v.spec.Target, err)
+		}
+
+		enrichments = append(enrichments, enrichment{
+			spec:      v.spec,
+			hashValue: v.hashValue,
+			embedding: normalized(embedding),
+			metadata:  vectorMetadata(v, len(embeddings[0])),
+		})
+	}
+
+	t.enrichments = enrichments
+	return t.enrich(ctx)
+}
+
+// enrich sets the output document: the document with its enrichments, and its origin marker, or its sidecar
+// document with the enrichments.
+func (t *documentTask) enrich(ctx context.Context) error {
+	if outputMode == OutputSidecar {
+		output, err := process(ctx, t.sidecarBase(), t.enrichments)
+		t.output = output
+		return err
+	}
+
+	output, err := process(ctx, t.doc, t.enrichments)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create embedding: %w", err)
+		return err
+	}
+	if loopGuard.Enabled() {
+		if err := loopGuard.path.Set(output, newMarker(t.contentHash, t.generation)); err != nil {
+			return fmt.Errorf("failed to set origin marker: %w", err)
+		}
+	}
+	t.output = output
+	return nil
+}
+
+// normalized returns the embedding, or the embeddings of its chunks, scaled to unit length if vectors are normalized.
+func normalized(embedding any) any {
+	if !normalize {
+		return embedding
 	}
 
-	logs = append(logs, fmt.Sprintf("Created embedding for document: %v", doc))
-	result[cosmosVectorPropertyName] = embedding
-	result[cosmosHashPropertyName] = hashValue
+	switch e := embedding.(type) {
+	case []float32:
+		return common.Normalize(e)
+	case []common.ChunkEmbedding:
+		result := make([]common.ChunkEmbedding, len(e))
+		for i, chunk := range e {
+			chunk.Vector = common.Normalize(chunk.Vector)
+			result[i] = chunk
+		}
+		return result
+	default:
+		return embedding
+	}
+}
+
+// enrichment is a vector to add to a document, along with the hash of the text it was generated from and
+// the metadata that describes it. The embedding is either a vector, or the list of chunk embeddings if the
+// text was split into chunks.
+type enrichment struct {
+	spec      *VectorSpec
+	hashValue string
+	embedding any
+	metadata  map[string]any
+}
+
+// process adds the embeddings of a document along with their hash values, and their metadata for the
+// vectors that have a metadata property.
+func process(ctx context.Context, doc map[string]any, enrichments []enrichment) (map[string]any, error) {
+	result := common.CloneDocument(doc)
+
+	for _, e := range enrichments {
+		customhandler.LoggerFromContext(ctx).Debugf("Created embedding %s for document: %v", e.spec.Target, doc)
+		if err := e.spec.targetPath.Set(result, e.embedding); err != nil {
+			return nil, fmt.Errorf("failed to set vector %s: %w", e.spec.Target, err)
+		}
+		if err := e.spec.hashPath.Set(result, e.hashValue); err != nil {
+			return nil, fmt.Errorf("failed to set hash of vector %s: %w", e.spec.Target, err)
+		}
+		if e.spec.MetadataProperty != "" {
+			if err := e.spec.metadataPath.Set(result, e.metadata); err != nil {
+				return nil, fmt.Errorf("failed to set metadata of vector %s: %w", e.spec.Target, err)
+			}
+		}
+	}
 
 	return result, nil
 }
 
-// cleanse removes specified keys from a document.
+// cleanse removes specified keys from a document. Keys can be property paths of nested properties.
 func cleanse(doc map[string]any, keysToRemove []string) map[string]any {
 	for _, key := range keysToRemove {
-		delete(doc, key)
+		if path, err := common.ParsePath(key); err == nil {
+			path.Delete(doc)
+		}
 	}
 	return doc
 }
 
-// isDocumentNewOrModified checks if a document is new or has been modified.
-func isDocumentNewOrModified(doc map[string]any, hashPropertyName, propertyToEmbedName string) (bool, string) {
-	if _, exists := doc[hashPropertyName]; !exists {
-		newHash := computeJSONHash(doc, propertyToEmbedName)
-		logs = append(logs, "New document detected, generated hash: "+newHash)
-		return true, newHash
+// isDocumentNewOrModified checks if the vector of a document must be embedded, because the text embedded into
+// it is new or has been modified, or because the vector is stale: its fingerprint was computed with other embedding
+// settings, or has the version 1 format that does not record them, or its metadata records another model, provider
+// or number of dimensions. It returns the fingerprint for the current settings.
+func isDocumentNewOrModified(ctx context.Context, doc map[string]any, spec *VectorSpec, text string) (bool, string) {
+	logger := customhandler.LoggerFromContext(ctx)
+	current := newFingerprint(settingsHash, text)
+
+	existing, exists := spec.hashPath.Get(doc)
+	if !exists {
+		logger.Infof("New document detected, generated hash: %s", current)
+		return true, current.String()
 	}
 
-	existingHash, ok := doc[hashPropertyName].(string)
+	existingHash, ok := existing.(string)
 	if !ok {
-		logs = append(logs, "Invalid hash property in document")
-		return false, ""
+		// Embedding the document again repairs the hash, rather than leaving the vector unchecked for good
+		logger.Warnf("Invalid hash property in document: expected a string, got %T, new hash: %s", existing, current)
+		return true, current.String()
 	}
 
-	hash := computeJSONHash(doc, propertyToEmbedName)
-	if hash != existingHash {
-		logs = append(logs, fmt.Sprintf("Document modified - old hash: %s, new hash: %s", existingHash, hash))
-		return true, hash
+	stored, err := parseFingerprint(existingHash)
+	staleReason := staleMetadata(doc, spec)
+	switch {
+	case err != nil:
+		logger.Warnf("Document modified - %v, new hash: %s", err, current)
+	case stored.textHash != current.textHash:
+		logger.Infof("Document modified - old hash: %s, new hash: %s", existingHash, current)
+	case stored.settingsHash == "":
+		logger.Infof("Vector is stale - hash %s does not record the embedding settings, new hash: %s", existingHash, current)
+	case stored.settingsHash != current.settingsHash:
+		logger.Infof("Vector is stale - embedding settings changed, old hash: %s, new hash: %s", existingHash, current)
+	case staleReason != "":
+		logger.Infof("Vector is stale - metadata records %s, new hash: %s", staleReason, current)
+	default:
+		logger.Infof("Document unchanged, hash: %s", existingHash)
+		return false, ""
 	}
 
-	logs = append(logs, "Document unchanged, hash: "+existingHash)
-	return false, ""
+	return true, current.String()
 }
 
-// computeJSONHash generates a SHA256 hash of a document's specified property.
-func computeJSONHash(doc map[string]any, propertyName string) string {
-	property, ok := doc[propertyName].(string)
-	if !ok {
-		return ""
-	}
-
-	hash := sha256.Sum256([]byte(property))
+// computeJSONHash generates a SHA256 hash of the text embedded into a vector, i.e. of exactly
+// the document properties (or the template output) that feed the vector.
+func computeJSONHash(text string) string {
+	hash := sha256.Sum256([]byte(text))
 	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"embeddings_generator_function/common"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup configures the handler with a fake embedder, without embedding cache, and the given environment variables.
+func setup(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	t.Setenv("EMBEDDING_PROVIDER", common.ProviderFake)
+	t.Setenv("EMBEDDING_DIMENSIONS", "4")
+	t.Setenv("COSMOS_VECTOR_PROPERTY", "vector")
+	t.Setenv("COSMOS_PROPERTY_TO_EMBED", "text")
+	t.Setenv("COSMOS_HASH_PROPERTY", "hash")
+	t.Setenv("EMBEDDING_CACHE_SIZE", "0")
+	t.Setenv("AzureWebJobsScriptRoot", t.TempDir())
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+	require.NoError(t, configure(cfg))
+}
+
+func testDocuments(n int) []map[string]any {
+	documents := make([]map[string]any, n)
+	for i := range documents {
+		documents[i] = map[string]any{"id": fmt.Sprintf("doc-%02d", i), "text": fmt.Sprintf("text of document %d", i), "_rid": "rid"}
+	}
+	return documents
+}
+
+func TestProcessDocumentsKeepsOrder(t *testing.T) {
+	setup(t, map[string]string{"PARALLELISM": "8", "EMBEDDING_BATCH_MAX_INPUTS": "3", "EMBEDDING_BATCH_CONCURRENCY": "4"})
+
+	var firstLogs []string
+	for run := range 3 {
+		logger := customhandler.NewLogger(customhandler.LevelInfo)
+		ctx := customhandler.WithLogger(context.Background(), logger)
+
+		output, result := processDocuments(ctx, testDocuments(20), failurePolicy)
+
+		require.Len(t, output, 20, "expected all documents to be enriched")
+		assert.Equal(t, 20, result.Enriched, "unexpected enriched count")
+		for i, doc := range output {
+			assert.Equal(t, fmt.Sprintf("doc-%02d", i), doc["id"], "expected output in input order")
+			assert.Len(t, doc["vector"], 4, "expected a vector")
+			assert.NotContains(t, doc, "_rid", "expected system properties to be removed")
+		}
+
+		if run == 0 {
+			firstLogs = logger.Lines()
+			continue
+		}
+		assert.Equal(t, firstLogs, logger.Lines(), "expected the same logs on every run")
+	}
+}
+
+func TestProcessDocumentsSkipsUnchangedDocuments(t *testing.T) {
+	setup(t, nil)
+
+	documents := testDocuments(2)
+	documents[0]["hash"] = newFingerprint(settingsHash, documents[0]["text"].(string)).String()
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 1, "expected only the modified document")
+	assert.Equal(t, "doc-01", output[0]["id"], "unexpected document")
+	assert.Equal(t, newFingerprint(settingsHash, "text of document 1").String(), output[0]["hash"], "expected the fingerprint of the text")
+	assert.Equal(t, InvocationResult{Received: 2, Enriched: 1}, result, "unexpected result")
+}
+
+func TestProcessDocumentsReembedsStaleVectors(t *testing.T) {
+	setup(t, nil)
+
+	documents := testDocuments(3)
+	documents[0]["hash"] = newFingerprint(settingsHash, "text of document 0").String()
+	documents[1]["hash"] = computeJSONHash("text of document 1")
+	documents[2]["hash"] = newFingerprint(settingsHash, "text of document 2").String()
+
+	// Switching the model makes the vectors of all documents stale
+	setup(t, map[string]string{"EMBEDDING_MODEL": "other-model"})
+	documents[0]["hash"] = newFingerprint(settingsHash, "text of document 0").String()
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 2, "expected the vectors with a legacy hash or other settings to be embedded again")
+	assert.Equal(t, []any{"doc-01", "doc-02"}, []any{output[0]["id"], output[1]["id"]}, "unexpected documents")
+	assert.Equal(t, newFingerprint(settingsHash, "text of document 2").String(), output[1]["hash"], "expected the fingerprint for the current settings")
+	assert.Equal(t, 2, result.Enriched, "unexpected enriched count")
+}
+
+func TestProcessDocumentsValidationPolicy(t *testing.T) {
+	setup(t, map[string]string{"VALIDATION_POLICY": "missing-property=fail", "PARALLELISM": "4"})
+
+	documents := testDocuments(4)
+	delete(documents[1], "text")
+	delete(documents[2], "id")
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Len(t, output, 2, "expected the valid documents")
+	require.Len(t, result.Failed, 1, "expected the document without text to fail")
+	assert.Equal(t, DocumentFailure{ID: "doc-01", Index: 1, Kind: MissingProperty, Reason: "missing-property: text"}, result.Failed[0], "unexpected failure")
+	require.Len(t, result.Skipped, 1, "expected the document without id to be skipped")
+	assert.Equal(t, 2, result.Skipped[0].Index, "unexpected skipped document")
+}
+
+func TestProcessDocumentsFailFast(t *testing.T) {
+	setup(t, map[string]string{"VALIDATION_POLICY": "*=fail", "FAILURE_POLICY": "fail-fast", "PARALLELISM": "4"})
+
+	documents := testDocuments(10)
+	delete(documents[3], "text")
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no output")
+	require.NotEmpty(t, result.Failed, "expected a failure")
+	assert.True(t, failurePolicy.exceeded(len(result.Failed), len(documents)), "expected the invocation to fail")
+}
+
+func TestProcessDocumentsAfterDeadline(t *testing.T) {
+	setup(t, nil)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errInvocationDeadline)
+
+	output, result := processDocuments(ctx, testDocuments(2), failurePolicy)
+
+	assert.Empty(t, output, "expected no output")
+	require.Len(t, result.Failed, 2, "expected all documents to fail")
+	assert.Contains(t, result.Failed[0].Reason, errInvocationDeadline.Error(), "expected the cause in the reason")
+}
+
+func TestProcessDocumentsTokenLimit(t *testing.T) {
+	documents := func() []map[string]any {
+		return []map[string]any{
+			{"id": "short", "text": "short text"},
+			{"id": "long", "text": "a text that is too long"},
+		}
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		setup(t, map[string]string{"EMBEDDING_MAX_TOKENS": "3", "COSMOS_METADATA_PROPERTY": "embedding", "METADATA_FIELDS": "tokenCount,truncated"})
+
+		output, _ := processDocuments(context.Background(), documents(), failurePolicy)
+
+		require.Len(t, output, 2, "expected both documents to be enriched")
+		assert.Equal(t, map[string]any{"tokenCount": 2, "truncated": false}, output[0]["embedding"], "unexpected metadata")
+		assert.Equal(t, map[string]any{"tokenCount": 3, "truncated": true}, output[1]["embedding"], "unexpected metadata")
+		assert.Equal(t, newFingerprint(settingsHash, "a text that is too long").String(), output[1]["hash"], "expected the fingerprint of the original text")
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		setup(t, map[string]string{"EMBEDDING_MAX_TOKENS": "3", "TOKEN_LIMIT_POLICY": "reject"})
+
+		output, result := processDocuments(context.Background(), documents(), failurePolicy)
+
+		assert.Len(t, output, 1, "expected the short document to be enriched")
+		require.Len(t, result.Skipped, 1, "expected the long document to be skipped")
+		assert.Equal(t, TooManyTokens, result.Skipped[0].Kind, "unexpected kind")
+	})
+
+	t.Run("chunk", func(t *testing.T) {
+		setup(t, map[string]string{"EMBEDDING_MAX_TOKENS": "3", "TOKEN_LIMIT_POLICY": "chunk"})
+
+		output, _ := processDocuments(context.Background(), documents(), failurePolicy)
+
+		require.Len(t, output, 2, "expected both documents to be enriched")
+		assert.Len(t, output[1]["vector"], 4, "expected the chunk embeddings to be averaged into one vector")
+	})
+}
+
+func TestProcessDocumentsEmbeddingCache(t *testing.T) {
+	setup(t, map[string]string{"EMBEDDING_CACHE_SIZE": "10"})
+
+	documents := testDocuments(3)
+	documents[2]["text"] = documents[0]["text"]
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 3, "expected all documents to be enriched")
+	assert.Equal(t, output[0]["vector"], output[2]["vector"], "expected identical texts to have the same vector")
+	assert.Equal(t, &common.CacheStats{Hits: 1, Misses: 2}, result.Cache, "expected the duplicate text to be embedded once")
+
+	_, result = processDocuments(context.Background(), testDocuments(2), failurePolicy)
+	assert.Equal(t, &common.CacheStats{Hits: 2}, result.Cache, "expected the embeddings to be cached")
+	assert.Equal(t, common.CacheStats{Hits: 3, Misses: 2}, embeddingCache.Stats(), "unexpected total statistics")
+}
+
+func TestProcessDocumentsNormalizesVectors(t *testing.T) {
+	setup(t, map[string]string{"NORMALIZE_VECTORS": "true", "CHUNK_STRATEGY": "tokens", "CHUNK_SIZE": "2", "CHUNK_OUTPUT": "mean"})
+
+	output, _ := processDocuments(context.Background(), testDocuments(1), failurePolicy)
+
+	require.Len(t, output, 1, "expected the document to be enriched")
+	var sum float64
+	for _, value := range output[0]["vector"].([]float32) {
+		sum += float64(value) * float64(value)
+	}
+	assert.InDelta(t, 1, sum, 1e-5, "expected a unit vector")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// version is the version of the function, set at build time with -ldflags "-X main.version=...".
+// The VCS revision the binary was built from is used if it is not set.
+var version = ""
+
+// Fields of the metadata object written to the metadata property of a vector.
+const (
+	// MetadataModel is the model, or Azure OpenAI deployment, that generated the vector.
+	MetadataModel = "model"
+	// MetadataDimensions is the number of dimensions of the vector.
+	MetadataDimensions = "dimensions"
+	// MetadataProvider is the embedding provider.
+	MetadataProvider = "provider"
+	// MetadataTimestamp is the time the vector was generated, in RFC 3339 format.
+	MetadataTimestamp = "timestamp"
+	// MetadataTokenCount is the number of tokens of the embedded text, after truncation.
+	MetadataTokenCount = "tokenCount"
+	// MetadataTruncated tells whether the embedded text was truncated to the token limit.
+	MetadataTruncated = "truncated"
+	// MetadataFunctionVersion is the version of the function that generated the vector.
+	MetadataFunctionVersion = "functionVersion"
+	// MetadataHashAlgorithm is the format of the fingerprint in the hash property, e.g. "v2:sha256".
+	MetadataHashAlgorithm = "hashAlgorithm"
+)
+
+var allMetadataFields = []string{MetadataModel, MetadataDimensions, MetadataProvider, MetadataTimestamp, MetadataTokenCount,
+	MetadataTruncated, MetadataFunctionVersion, MetadataHashAlgorithm}
+
+// now returns the current time; tests replace it.
+var now = time.Now
+
+// parseMetadataFields parses a comma separated list of metadata fields. An empty list selects all fields.
+func parseMetadataFields(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return allMetadataFields, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(allMetadataFields, field) {
+			return nil, fmt.Errorf("unknown metadata field %q: expected one of %s", field, strings.Join(allMetadataFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// functionVersion returns the version of the function, or the VCS revision it was built from, or "unknown".
+func functionVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// vectorMetadata returns the metadata object of a vector with the configured fields.
+func vectorMetadata(v pendingVector, dimensions int) map[string]any {
+	values := map[string]any{
+		MetadataModel:           settings.Model,
+		MetadataDimensions:      dimensions,
+		MetadataProvider:        settings.Provider,
+		MetadataTimestamp:       now().UTC().Format(time.RFC3339),
+		MetadataTokenCount:      v.text.Tokens,
+		MetadataTruncated:       v.text.Truncated,
+		MetadataFunctionVersion: functionVersion(),
+		MetadataHashAlgorithm:   strings.TrimSuffix(fingerprintPrefix, ":"),
+	}
+
+	metadata := make(map[string]any, len(metadataFields))
+	for _, field := range metadataFields {
+		metadata[field] = values[field]
+	}
+	return metadata
+}
+
+// staleMetadata compares the metadata stored for a vector with the current settings. It returns a description
+// of the first difference in model, provider or dimensions, or an empty string if the metadata (or the fields
+// it has) match.
+func staleMetadata(doc map[string]any, spec *VectorSpec) string {
+	if spec.MetadataProperty == "" {
+		return ""
+	}
+	value, exists := spec.metadataPath.Get(doc)
+	if !exists {
+		return ""
+	}
+	stored, ok := value.(map[string]any)
+	if !ok {
+		return ""
+	}
+
+	if model, ok := stored[MetadataModel].(string); ok && model != settings.Model {
+		return fmt.Sprintf("model %s, not %s", model, settings.Model)
+	}
+	if provider, ok := stored[MetadataProvider].(string); ok && provider != settings.Provider {
+		return fmt.Sprintf("provider %s, not %s", provider, settings.Provider)
+	}
+	if dimensions, ok := number(stored[MetadataDimensions]); ok && settings.Dimensions > 0 && dimensions != float64(settings.Dimensions) {
+		return fmt.Sprintf("%v dimensions, not %d", dimensions, settings.Dimensions)
+	}
+	return ""
+}
+
+// number returns the value of a number decoded from JSON, or written by vectorMetadata.
+func number(value any) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessDocumentsWritesMetadata(t *testing.T) {
+	setup(t, map[string]string{"COSMOS_METADATA_PROPERTY": "meta.embedding"})
+	version = "1.2.3"
+	now = func() time.Time { return time.Date(2025, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600)) }
+	t.Cleanup(func() { version, now = "", time.Now })
+
+	output, _ := processDocuments(context.Background(), testDocuments(1), failurePolicy)
+
+	require.Len(t, output, 1, "expected the document to be enriched")
+	assert.Equal(t, map[string]any{"embedding": map[string]any{
+		"model":           "fake",
+		"dimensions":      4,
+		"provider":        "fake",
+		"timestamp":       "2025-03-01T11:00:00Z",
+		"tokenCount":      4,
+		"truncated":       false,
+		"functionVersion": "1.2.3",
+		"hashAlgorithm":   "v2:sha256",
+	}}, output[0]["meta"], "unexpected metadata")
+}
+
+func TestProcessDocumentsConsultsMetadata(t *testing.T) {
+	setup(t, map[string]string{"COSMOS_METADATA_PROPERTY": "embedding", "METADATA_FIELDS": "model,dimensions"})
+
+	documents := testDocuments(3)
+	for _, doc := range documents {
+		doc["hash"] = newFingerprint(settingsHash, doc["text"].(string)).String()
+	}
+	documents[0]["embedding"] = map[string]any{"model": "fake", "dimensions": float64(4)}
+	documents[1]["embedding"] = map[string]any{"model": "text-embedding-ada-002"}
+	documents[2]["embedding"] = map[string]any{"dimensions": float64(1536)}
+
+	output, _ := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 2, "expected the vectors whose metadata records other settings to be embedded again")
+	assert.Equal(t, "doc-01", output[0]["id"], "unexpected document")
+	assert.Equal(t, map[string]any{"model": "fake", "dimensions": 4}, output[0]["embedding"], "expected the configured fields")
+	assert.Equal(t, "doc-02", output[1]["id"], "unexpected document")
+}
+
+func TestParseMetadataFields(t *testing.T) {
+	fields, err := parseMetadataFields("")
+	require.NoError(t, err)
+	assert.Equal(t, allMetadataFields, fields, "expected all fields by default")
+
+	fields, err = parseMetadataFields("model, tokenCount")
+	require.NoError(t, err)
+	assert.Equal(t, []string{MetadataModel, MetadataTokenCount}, fields, "unexpected fields")
+
+	_, err = parseMetadataFields("model,cost")
+	assert.ErrorContains(t, err, `unknown metadata field "cost"`, "expected the unknown field to be reported")
+}
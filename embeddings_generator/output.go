@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"embeddings_generator_function/common"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+)
+
+const defaultMaxConflictRetries = 3
+
+// OutputMode selects how the enriched documents are written.
+type OutputMode string
+
+const (
+	// OutputBinding returns the enriched documents to the cosmosDB output binding, which upserts them whole.
+	OutputBinding OutputMode = "binding"
+	// OutputPatch patches the properties written for the vectors (and the origin marker of the loop guard) with
+	// the Cosmos DB client, on the condition that the document has not changed since it was read. Concurrent
+	// edits of the other properties are kept, and the request units of writing the whole document are saved.
+	OutputPatch OutputMode = "patch"
+	// OutputReplace replaces the enriched documents with the Cosmos DB client, on the condition that the document
+	// has not changed since it was read, so that concurrent edits are not overwritten by the version that was read.
+	OutputReplace OutputMode = "replace"
+	// OutputUpsert upserts the enriched documents with the Cosmos DB client, like the output binding, but the
+	// status code and request charge of each write are reported, and the partition key path is configurable.
+	OutputUpsert OutputMode = "upsert"
+	// OutputSidecar upserts the vectors to sidecar documents in another container, which may belong to another
+	// database or account, and leaves the source documents untouched. The sidecar document of a source document
+	// has the same id, sourceId and sourcePartitionKey properties that refer to it, the properties written for
+	// the vectors, and the projected properties of the source document. The hashes of the sidecar document decide
+	// which vectors are embedded, so it is read for every document. Sidecar documents are not deleted with their
+	// source documents, since the change feed does not deliver deletions.
+	OutputSidecar OutputMode = "sidecar"
+)
+
+var outputModes = []OutputMode{OutputBinding, OutputPatch, OutputReplace, OutputUpsert, OutputSidecar}
+
+// ConflictPolicy determines what happens when the text of a vector changed while the document was embedded,
+// so that the conditional write of the document fails.
+type ConflictPolicy string
+
+const (
+	// ConflictDrop drops the write; the change feed delivers the current version, whose vectors are embedded in turn.
+	ConflictDrop ConflictPolicy = "drop"
+	// ConflictReembed embeds the current version of the document and writes it in the same invocation.
+	ConflictReembed ConflictPolicy = "reembed"
+)
+
+var conflictPolicies = []ConflictPolicy{ConflictDrop, ConflictReembed}
+
+// WriteOutcome is the outcome of writing a document with the Cosmos DB client.
+type WriteOutcome string
+
+const (
+	// WriteWritten means that the document was written on the version read from the change feed.
+	WriteWritten WriteOutcome = "written"
+	// WriteRebased means that the document changed while it was embedded, but not the texts of its vectors,
+	// so the vectors were written on the current version.
+	WriteRebased WriteOutcome = "rebased"
+	// WriteReembedded means that the text of a vector changed while the document was embedded, and the current
+	// version was embedded and written (ConflictReembed).
+	WriteReembedded WriteOutcome = "reembedded"
+	// WriteDropped means that the text of a vector changed while the document was embedded, and the write was
+	// dropped (ConflictDrop), or that the document was deleted.
+	WriteDropped WriteOutcome = "dropped"
+	// WriteFailed means that the document could not be written; the reason is reported with the failed documents.
+	WriteFailed WriteOutcome = "failed"
+)
+
+// DocumentWrite describes the outcome of writing a document with the Cosmos DB client.
+type DocumentWrite struct {
+	ID      string       `json:"id"`
+	Index   int          `json:"index"`
+	Outcome WriteOutcome `json:"outcome"`
+	// Attempts is the number of conditional writes, including those that failed because the document changed.
+	Attempts int    `json:"attempts"`
+	Reason   string `json:"reason,omitempty"`
+	// StatusCode is the status code of the last write, or 0 if it failed without a response.
+	StatusCode int `json:"statusCode,omitempty"`
+	// RequestCharge is the number of request units charged for the writes of the document, and the reads of
+	// its current version after conflicts.
+	RequestCharge float64 `json:"requestCharge"`
+}
+
+// record records the status code and the request charge of a write that returned item or err.
+func (w *DocumentWrite) record(item *common.CosmosItem, err error) {
+	if err != nil {
+		var charge float64
+		w.StatusCode, charge = common.ErrorStatus(err)
+		w.RequestCharge += charge
+		return
+	}
+	w.StatusCode = item.StatusCode
+	w.RequestCharge += item.RequestCharge
+}
+
+// OutputOptions configures how the enriched documents are written.
+type OutputOptions struct {
+	// Mode is OutputBinding (default), OutputPatch, OutputReplace, OutputUpsert or OutputSidecar.
+	Mode OutputMode `json:"mode"`
+	// MaxConflictRetries is the number of times a conditional write is attempted again after the document changed.
+	MaxConflictRetries int `json:"maxConflictRetries"`
+	// OnConflict is ConflictDrop (default) or ConflictReembed.
+	OnConflict ConflictPolicy `json:"onConflict"`
+	// Cosmos configures the Cosmos DB client of the modes other than OutputBinding. With OutputSidecar, it
+	// describes the source container.
+	Cosmos common.CosmosOptions `json:"cosmos"`
+	// Target configures the sidecar container of OutputSidecar, with the COSMOS_TARGET_ variables. The account and
+	// the database default to those of Cosmos, so that setting the container is enough to use another container
+	// of the same database.
+	Target common.CosmosOptions `json:"target"`
+	// Projection lists the properties of the source documents copied to the sidecar documents (OUTPUT_PROJECTION,
+	// comma separated).
+	Projection []string `json:"projection,omitempty"`
+
+	projection         []common.Path
+	sourcePartitionKey common.Path
+}
+
+// DefaultOutputOptions returns the output options used by default.
+func DefaultOutputOptions() OutputOptions {
+	return OutputOptions{Mode: OutputBinding, MaxConflictRetries: defaultMaxConflictRetries, OnConflict: ConflictDrop}
+}
+
+// loadEnv overrides the options with the OUTPUT_MODE, OUTPUT_MAX_CONFLICT_RETRIES, OUTPUT_ON_CONFLICT and
+// OUTPUT_PROJECTION environment variables, the Cosmos DB variables described at common.CosmosOptions.LoadEnv, and
+// the same variables prefixed with COSMOS_TARGET_ instead of COSMOS_ for the target, that are set.
+func (o *OutputOptions) loadEnv() error {
+	o.Mode = OutputMode(strings.ToLower(common.StringFromEnv("OUTPUT_MODE", string(o.Mode))))
+	o.OnConflict = ConflictPolicy(strings.ToLower(common.StringFromEnv("OUTPUT_ON_CONFLICT", string(o.OnConflict))))
+
+	var err error
+	if o.MaxConflictRetries, err = common.IntFromEnv("OUTPUT_MAX_CONFLICT_RETRIES", o.MaxConflictRetries); err != nil {
+		return err
+	}
+
+	if value := os.Getenv("OUTPUT_PROJECTION"); value != "" {
+		o.Projection = nil
+		for _, property := range strings.Split(value, ",") {
+			if property = strings.TrimSpace(property); property != "" {
+				o.Projection = append(o.Projection, property)
+			}
+		}
+	}
+
+	if err := o.Cosmos.LoadEnv(); err != nil {
+		return err
+	}
+	return o.Target.LoadEnvWithPrefix("COSMOS_TARGET_")
+}
+
+// validate checks the options. The Cosmos DB options are only checked if the mode uses the client, and the sidecar
+// options if the mode is OutputSidecar.
+func (o *OutputOptions) validate(specs []VectorSpec) []error {
+	var errs []error
+	if !slices.Contains(outputModes, o.Mode) {
+		errs = append(errs, fmt.Errorf("output: unknown mode %q", o.Mode))
+	}
+	if !slices.Contains(conflictPolicies, o.OnConflict) {
+		errs = append(errs, fmt.Errorf("output: unknown conflict policy %q", o.OnConflict))
+	}
+	if o.MaxConflictRetries < 0 {
+		errs = append(errs, errors.New("output: maxConflictRetries must not be negative"))
+	}
+	switch o.Mode {
+	case OutputBinding:
+	case OutputSidecar:
+		errs = append(errs, o.validateSidecar(specs)...)
+	default:
+		if err := o.Cosmos.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("output: cosmos: %w", err))
+		}
+	}
+	return errs
+}
+
+// itemClient reads and writes the documents of the container, or of the sidecar container with OutputSidecar.
+// It is implemented by *common.CosmosClient.
+type itemClient interface {
+	PartitionKey(doc map[string]any) (any, error)
+	ReadItem(ctx context.Context, id string, partitionKey any) (*common.CosmosItem, error)
+	UpsertItem(ctx context.Context, partitionKey any, doc map[string]any, opts *common.ItemOptions) (*common.CosmosItem, error)
+	ReplaceItem(ctx context.Context, id string, partitionKey any, doc map[string]any, opts *common.ItemOptions) (*common.CosmosItem, error)
+	PatchItem(ctx context.Context, id string, partitionKey any, operations []common.PatchOperation, opts *common.ItemOptions) (*common.CosmosItem, error)
+}
+
+// write writes the document, on the condition that it has not changed since it was read from the change feed.
+// If it has, the current version is read. If the texts of the vectors did not change, the vectors are written on
+// the current version. Otherwise the write is dropped, or the current version is embedded and written, according
+// to the conflict policy. The outcome is recorded in t.written.
+func (t *documentTask) write(ctx context.Context) error {
+	logger := customhandler.LoggerFromContext(ctx)
+	t.written = &DocumentWrite{ID: t.id, Index: t.index, Outcome: WriteWritten}
+	partitionKey, err := items.PartitionKey(t.output)
+	if err != nil {
+		return fmt.Errorf("failed to write document: %w", err)
+	}
+
+	for {
+		t.written.Attempts++
+		err := t.writeVersion(ctx, partitionKey)
+		if err == nil {
+			logger.Infof("Wrote document %s (%s, %s)", t.id, outputMode, t.written.Outcome)
+			return nil
+		}
+		if !common.IsPreconditionFailed(err) {
+			return fmt.Errorf("failed to write document: %w", err)
+		}
+		if t.written.Attempts > maxConflictRetries {
+			return fmt.Errorf("document changed %d times while it was written: %w", t.written.Attempts, err)
+		}
+
+		current, err := items.ReadItem(ctx, t.id, partitionKey)
+		if current != nil {
+			t.written.RequestCharge += current.RequestCharge
+		}
+		if common.IsNotFound(err) {
+			t.drop(ctx, "the document was deleted")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the current version of the document: %w", err)
+		}
+
+		changed := t.changedVector(current.Document)
+		switch {
+		case changed == "":
+			logger.Infof("Document %s changed since it was read, but not the texts of its vectors; writing on etag %s", t.id, current.ETag)
+			if err := t.rebase(ctx, current.Document); err != nil {
+				return err
+			}
+			if t.written.Outcome == WriteWritten {
+				t.written.Outcome = WriteRebased
+			}
+		case onConflict == ConflictDrop:
+			t.drop(ctx, fmt.Sprintf("the text of vector %s changed since the document was read", changed))
+			return nil
+		default:
+			logger.Infof("The text of vector %s of document %s changed since it was read; embedding etag %s", changed, t.id, current.ETag)
+			if err := t.reembed(ctx, current.Document); err != nil {
+				return err
+			}
+			if t.output == nil {
+				t.drop(ctx, "the current version needs no new embeddings")
+				return nil
+			}
+			t.written.Outcome = WriteReembedded
+		}
+	}
+}
+
+// writeVersion writes the document on the condition that its etag is t.etag, except for upserts and sidecar
+// documents, which are only written by the function.
+func (t *documentTask) writeVersion(ctx context.Context, partitionKey any) error {
+	switch outputMode {
+	case OutputUpsert, OutputSidecar:
+		item, err := items.UpsertItem(ctx, partitionKey, t.output, nil)
+		t.written.record(item, err)
+		return err
+	case OutputReplace:
+		item, err := items.ReplaceItem(ctx, t.id, partitionKey, t.output, &common.ItemOptions{IfMatch: t.etag})
+		t.written.record(item, err)
+		return err
+	default:
+		return t.patch(ctx, partitionKey, t.etag)
+	}
+}
+
+// drop drops the write of the document.
+func (t *documentTask) drop(ctx context.Context, reason string) {
+	customhandler.LoggerFromContext(ctx).Infof("Dropping write of document %s: %s", t.id, reason)
+	t.written.Outcome, t.written.Reason = WriteDropped, reason
+	t.output = nil
+}
+
+// rebase applies the enrichments of the document to its current version, whose vectors have the same texts.
+func (t *documentTask) rebase(ctx context.Context, doc map[string]any) error {
+	if loopGuard.Enabled() {
+		t.contentHash = loopGuard.contentHash(doc, vectorSpecs)
+	}
+	t.etag, _ = doc["_etag"].(string)
+	t.doc = cleanse(doc, keysToRemove)
+	return t.enrich(ctx)
+}
+
+// reembed prepares, embeds and enriches the current version of the document. It leaves t.output nil if the
+// current version needs no new embeddings.
+func (t *documentTask) reembed(ctx context.Context, doc map[string]any) error {
+	t.doc, t.vectors, t.enrichments, t.output = doc, nil, nil, nil
+	if err := t.prepare(ctx); err != nil || len(t.vectors) == 0 {
+		return err
+	}
+
+	var inputs []string
+	for i := range t.vectors {
+		t.vectors[i].firstInput = len(inputs)
+		for _, chunk := range t.vectors[i].chunks {
+			inputs = append(inputs, chunk.Text)
+		}
+	}
+	return t.finish(ctx, common.EmbedAll(ctx, embedder, inputs, batchOptions))
+}
+
+// patch applies the patch operations of the document to the version with the given etag. The client applies a
+// patch longer than common.MaxPatchOperations atomically, so the document never holds some of the vectors only.
+func (t *documentTask) patch(ctx context.Context, partitionKey any, etag string) error {
+	item, err := items.PatchItem(ctx, t.id, partitionKey, t.patchOperations(), &common.ItemOptions{IfMatch: etag})
+	t.written.record(item, err)
+	return err
+}
+
+// patchOperations returns the operations that set the vectors, hashes and metadata of the enrichments of the
+// document, and its origin marker. Since a set operation fails if the parent of the property does not exist, a
+// property whose parent is missing from the document is set by setting its first missing ancestor to an object
+// that contains it.
+func (t *documentTask) patchOperations() []common.PatchOperation {
+	var operations []common.PatchOperation
+	created := map[string]bool{}
+	set := func(path common.Path, value any) {
+		operations = append(operations, patchSet(t.doc, created, path, value))
+	}
+
+	for _, e := range t.enrichments {
+		set(e.spec.targetPath, e.embedding)
+		set(e.spec.hashPath, e.hashValue)
+		if e.spec.MetadataProperty != "" {
+			set(e.spec.metadataPath, e.metadata)
+		}
+	}
+	if loopGuard.Enabled() {
+		set(loopGuard.path, newMarker(t.contentHash, t.generation))
+	}
+	return operations
+}
+
+// patchSet returns the operation that sets the property at path of doc to value. If an ancestor of the property
+// is missing (or null), the operation sets the first missing ancestor to nested objects that contain the value
+// instead. created holds the paths of the objects created by earlier operations of the patch, which exist when
+// the operation is applied.
+func patchSet(doc map[string]any, created map[string]bool, path common.Path, value any) common.PatchOperation {
+	for i := 1; i < len(path); i++ {
+		ancestor := path[:i]
+		if created[ancestor.String()] {
+			continue
+		}
+		if parent, exists := ancestor.Get(doc); exists && parent != nil {
+			continue
+		}
+
+		for j := i; j < len(path); j++ {
+			created[path[:j].String()] = true
+		}
+		for j := len(path) - 1; j >= i; j-- {
+			value = map[string]any{path[j]: value}
+		}
+		return common.PatchSet(ancestor, value)
+	}
+	return common.PatchSet(path, value)
+}
+
+// changedVector returns the target of the first embedded vector whose text differs in doc, or an empty string if
+// the texts of all embedded vectors are the same.
+func (t *documentTask) changedVector(doc map[string]any) string {
+	for _, v := range t.vectors {
+		text, err := v.spec.Text(doc)
+		if err != nil || newFingerprint(settingsHash, text).String() != v.hashValue {
+			return v.spec.Target
+		}
+	}
+	return ""
+}
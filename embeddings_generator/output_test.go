@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"embeddings_generator_function/common"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeItems stores the documents of a container in memory. beforeWrite, if set, is called before each write to
+// simulate a concurrent edit, and reports whether it edited the document.
+type fakeItems struct {
+	documents   map[string]map[string]any
+	versions    int
+	patches     [][]common.PatchOperation
+	replaces    []map[string]any
+	beforeWrite func(doc map[string]any) bool
+}
+
+func newFakeItems(documents ...map[string]any) *fakeItems {
+	items := &fakeItems{documents: map[string]map[string]any{}}
+	for _, doc := range documents {
+		items.store(common.CloneDocument(doc))
+	}
+	return items
+}
+
+func (f *fakeItems) store(doc map[string]any) {
+	f.versions++
+	doc["_etag"] = fmt.Sprintf(`"%d"`, f.versions)
+	f.documents[doc["id"].(string)] = doc
+}
+
+func (f *fakeItems) PartitionKey(doc map[string]any) (any, error) {
+	return doc["id"], nil
+}
+
+func (f *fakeItems) ReadItem(ctx context.Context, id string, partitionKey any) (*common.CosmosItem, error) {
+	doc, exists := f.documents[id]
+	if !exists {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	return &common.CosmosItem{Document: common.CloneDocument(doc), ETag: doc["_etag"].(string), StatusCode: http.StatusOK, RequestCharge: 1}, nil
+}
+
+func (f *fakeItems) UpsertItem(ctx context.Context, partitionKey any, doc map[string]any, opts *common.ItemOptions) (*common.CosmosItem, error) {
+	status := http.StatusOK
+	if _, exists := f.documents[doc["id"].(string)]; !exists {
+		status = http.StatusCreated
+	}
+	doc = common.CloneDocument(doc)
+	f.store(doc)
+	return &common.CosmosItem{Document: common.CloneDocument(doc), ETag: doc["_etag"].(string), StatusCode: status, RequestCharge: 10}, nil
+}
+
+func (f *fakeItems) ReplaceItem(ctx context.Context, id string, partitionKey any, doc map[string]any, opts *common.ItemOptions) (*common.CosmosItem, error) {
+	current, exists := f.documents[id]
+	if !exists {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	if f.beforeWrite != nil && f.beforeWrite(current) {
+		f.store(current)
+	}
+	if opts != nil && opts.IfMatch != "" && opts.IfMatch != current["_etag"] {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+
+	f.replaces = append(f.replaces, common.CloneDocument(doc))
+	doc = common.CloneDocument(doc)
+	f.store(doc)
+	return &common.CosmosItem{Document: common.CloneDocument(doc), ETag: doc["_etag"].(string), StatusCode: http.StatusOK, RequestCharge: 10}, nil
+}
+
+func (f *fakeItems) PatchItem(ctx context.Context, id string, partitionKey any, operations []common.PatchOperation, opts *common.ItemOptions) (*common.CosmosItem, error) {
+	doc, exists := f.documents[id]
+	if !exists {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	if f.beforeWrite != nil && f.beforeWrite(doc) {
+		f.store(doc)
+	}
+	if opts != nil && opts.IfMatch != "" && opts.IfMatch != doc["_etag"] {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+
+	// Like Cosmos DB, a set fails if the parent of the property does not exist, and no operation is applied
+	patched := common.CloneDocument(doc)
+	for _, op := range operations {
+		path, _ := common.ParsePath(op.Path)
+		if len(path) > 1 {
+			parent, _ := path[:len(path)-1].Get(patched)
+			if _, ok := parent.(map[string]any); !ok {
+				return nil, &azcore.ResponseError{StatusCode: http.StatusBadRequest, ErrorCode: "BadRequest"}
+			}
+		}
+		if err := path.Set(patched, op.Value); err != nil {
+			return nil, err
+		}
+	}
+	f.patches = append(f.patches, operations)
+	f.store(patched)
+	return &common.CosmosItem{Document: common.CloneDocument(patched), ETag: patched["_etag"].(string), StatusCode: http.StatusOK, RequestCharge: 10}, nil
+}
+
+// setupOutput configures the handler to write the documents of a fake container that holds the given documents,
+// as they are when read from the change feed, in the given output mode.
+func setupOutput(t *testing.T, mode OutputMode, env map[string]string, documents []map[string]any) *fakeItems {
+	t.Helper()
+
+	if env == nil {
+		env = map[string]string{}
+	}
+	env["OUTPUT_MODE"] = string(mode)
+	env["COSMOS_ENDPOINT"] = "https://example.documents.azure.com"
+	env["COSMOS_KEY"] = "a2V5"
+	env["COSMOS_DATABASE_NAME"] = "db"
+	env["COSMOS_CONTAINER_NAME"] = "items"
+	setup(t, env)
+
+	fake := newFakeItems(documents...)
+	for _, doc := range documents {
+		doc["_etag"] = fake.documents[doc["id"].(string)]["_etag"]
+	}
+	items = fake
+	t.Cleanup(func() { items = nil })
+	return fake
+}
+
+func TestProcessDocumentsPatchesDocuments(t *testing.T) {
+	documents := testDocuments(2)
+	fake := setupOutput(t, OutputPatch, nil, documents)
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no documents for the output binding")
+	assert.Equal(t, 2, result.Enriched, "expected both documents to be patched")
+	assert.Equal(t, []DocumentWrite{
+		{ID: "doc-00", Outcome: WriteWritten, Attempts: 1, StatusCode: http.StatusOK, RequestCharge: 10},
+		{ID: "doc-01", Index: 1, Outcome: WriteWritten, Attempts: 1, StatusCode: http.StatusOK, RequestCharge: 10},
+	}, result.Writes, "unexpected outcomes")
+	assert.Equal(t, 20.0, result.RequestCharge, "unexpected request charge")
+	require.Len(t, fake.patches, 2, "expected a patch per document")
+
+	var paths []string
+	for _, op := range fake.patches[0] {
+		paths = append(paths, op.Path)
+	}
+	assert.Equal(t, []string{"/vector", "/hash", "/" + defaultLoopGuardProperty}, paths, "expected only the written properties to be patched")
+	assert.Len(t, fake.documents["doc-00"]["vector"], 4, "expected the vector to be stored")
+	assert.Equal(t, "rid", fake.documents["doc-00"]["_rid"], "expected the rest of the document to be kept")
+}
+
+func TestProcessDocumentsPatchesConcurrentlyEditedDocuments(t *testing.T) {
+	documents := testDocuments(1)
+	fake := setupOutput(t, OutputPatch, nil, documents)
+
+	fake.beforeWrite = func(doc map[string]any) bool {
+		if _, edited := doc["title"]; edited {
+			return false
+		}
+		doc["title"] = "edited while embedding"
+		return true
+	}
+
+	_, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Equal(t, 1, result.Enriched, "expected the document to be patched")
+	assert.Equal(t, []DocumentWrite{{ID: "doc-00", Outcome: WriteRebased, Attempts: 2, StatusCode: http.StatusOK, RequestCharge: 11}}, result.Writes, "unexpected outcome")
+	stored := fake.documents["doc-00"]
+	assert.Equal(t, "edited while embedding", stored["title"], "expected the concurrent edit to be kept")
+	assert.Len(t, stored["vector"], 4, "expected the vector to be stored")
+}
+
+func TestProcessDocumentsDropsWritesOfModifiedTexts(t *testing.T) {
+	documents := testDocuments(1)
+	fake := setupOutput(t, OutputPatch, nil, documents)
+	fake.beforeWrite = func(doc map[string]any) bool {
+		doc["text"] = "rewritten while embedding"
+		return true
+	}
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no documents for the output binding")
+	assert.Zero(t, result.Enriched, "expected the stale write to be dropped")
+	assert.Empty(t, result.Failed, "expected the document not to fail")
+	require.Len(t, result.Writes, 1, "expected the outcome to be recorded")
+	assert.Equal(t, WriteDropped, result.Writes[0].Outcome, "unexpected outcome")
+	assert.NotContains(t, fake.documents["doc-00"], "vector", "expected the stale vector not to be written")
+}
+
+func TestProcessDocumentsReplacesDocuments(t *testing.T) {
+	documents := testDocuments(1)
+	fake := setupOutput(t, OutputReplace, nil, documents)
+	fake.beforeWrite = func(doc map[string]any) bool {
+		if _, edited := doc["title"]; edited {
+			return false
+		}
+		doc["title"] = "edited while embedding"
+		return true
+	}
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no documents for the output binding")
+	assert.Equal(t, []DocumentWrite{{ID: "doc-00", Outcome: WriteRebased, Attempts: 2, StatusCode: http.StatusOK, RequestCharge: 11}}, result.Writes, "unexpected outcome")
+	require.Len(t, fake.replaces, 1, "expected a single successful replace")
+	assert.Equal(t, "edited while embedding", fake.replaces[0]["title"], "expected the concurrent edit not to be overwritten")
+	assert.Len(t, fake.replaces[0]["vector"], 4, "expected the vector to be written")
+}
+
+func TestProcessDocumentsReembedsOnConflict(t *testing.T) {
+	documents := testDocuments(1)
+	fake := setupOutput(t, OutputReplace, map[string]string{"OUTPUT_ON_CONFLICT": "reembed"}, documents)
+	fake.beforeWrite = func(doc map[string]any) bool {
+		if doc["text"] == "rewritten while embedding" {
+			return false
+		}
+		doc["text"] = "rewritten while embedding"
+		return true
+	}
+
+	_, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Equal(t, []DocumentWrite{{ID: "doc-00", Outcome: WriteReembedded, Attempts: 2, StatusCode: http.StatusOK, RequestCharge: 11}}, result.Writes, "unexpected outcome")
+	require.Len(t, fake.replaces, 1, "expected the current version to be written")
+	assert.Equal(t, "rewritten while embedding", fake.replaces[0]["text"], "expected the current version")
+	assert.Equal(t, newFingerprint(settingsHash, "rewritten while embedding").String(), fake.replaces[0]["hash"], "expected the fingerprint of the current text")
+}
+
+func TestProcessDocumentsFailsAfterRepeatedConflicts(t *testing.T) {
+	documents := testDocuments(1)
+	fake := setupOutput(t, OutputPatch, map[string]string{"OUTPUT_MAX_CONFLICT_RETRIES": "2"}, documents)
+	fake.beforeWrite = func(doc map[string]any) bool { return true }
+
+	_, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, result.Failed, 1, "expected the document to fail")
+	assert.Contains(t, result.Failed[0].Reason, "changed 3 times", "unexpected reason")
+	require.Len(t, result.Writes, 1, "expected the outcome to be recorded")
+	assert.Equal(t, WriteFailed, result.Writes[0].Outcome, "unexpected outcome")
+	assert.Equal(t, http.StatusPreconditionFailed, result.Writes[0].StatusCode, "expected the status of the last write")
+	assert.Equal(t, 3, result.Writes[0].Attempts, "unexpected attempts")
+}
+
+func TestProcessDocumentsUpsertsDocuments(t *testing.T) {
+	documents := testDocuments(2)
+	fake := setupOutput(t, OutputUpsert, nil, documents[:1])
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no documents for the output binding")
+	assert.Equal(t, []DocumentWrite{
+		{ID: "doc-00", Outcome: WriteWritten, Attempts: 1, StatusCode: http.StatusOK, RequestCharge: 10},
+		{ID: "doc-01", Index: 1, Outcome: WriteWritten, Attempts: 1, StatusCode: http.StatusCreated, RequestCharge: 10},
+	}, result.Writes, "expected the status of each write")
+	assert.Len(t, fake.documents["doc-01"]["vector"], 4, "expected the new document to be stored")
+	assert.NotContains(t, fake.documents["doc-00"], "_rid", "expected the system properties to be removed")
+}
+
+func TestProcessDocumentsFailFastRecordsAllWrites(t *testing.T) {
+	documents := testDocuments(3)
+	fake := setupOutput(t, OutputPatch, map[string]string{"FAILURE_POLICY": "fail-fast", "PARALLELISM": "1", "OUTPUT_MAX_CONFLICT_RETRIES": "0"}, documents)
+	fake.beforeWrite = func(doc map[string]any) bool { return doc["id"] == "doc-00" }
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no output")
+	require.Len(t, result.Failed, 1, "expected the first document to fail")
+	assert.Equal(t, "doc-00", result.Failed[0].ID, "unexpected failed document")
+	assert.Zero(t, result.Enriched, "expected the documents after the failed one not to be reported")
+
+	var written []string
+	for _, write := range result.Writes {
+		if write.Outcome == WriteWritten {
+			written = append(written, write.ID)
+		}
+	}
+	require.Len(t, result.Writes, 3, "expected the writes of all documents to be recorded")
+	assert.Equal(t, WriteFailed, result.Writes[0].Outcome, "expected the write of the failed document to be recorded")
+	assert.Equal(t, []string{"doc-01", "doc-02"}, written, "expected the documents written before the others stopped to be recorded")
+	assert.Equal(t, 20.0, result.RequestCharge, "expected the charge of the documents written after the failure")
+	assert.Len(t, fake.documents["doc-02"]["vector"], 4, "expected the document to stay written")
+}
+
+func TestProcessDocumentsPatchesNestedProperties(t *testing.T) {
+	documents := titledDocuments(2, "title")
+	documents[1]["embeddings"] = map[string]any{"other": 1}
+	documents[1]["hashes"] = nil
+	fake := setupOutput(t, OutputPatch, map[string]string{
+		"COSMOS_VECTOR_PROPERTY":   "",
+		"COSMOS_PROPERTY_TO_EMBED": "",
+		"COSMOS_HASH_PROPERTY":     "",
+		"EMBEDDING_VECTORS": `[
+			{"target": "embeddings.text", "source": "text", "hashProperty": "hashes.text"},
+			{"target": "embeddings.title", "source": "title", "hashProperty": "hashes.title"}
+		]`,
+		"LOOP_GUARD_PROPERTY": "meta.origin",
+	}, documents)
+
+	_, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Empty(t, result.Failed, "expected the documents to be patched")
+	assert.Equal(t, 2, result.Enriched, "expected both documents to be patched")
+	require.Len(t, fake.patches, 2, "expected a patch per document")
+
+	var paths [2][]string
+	for i, patch := range fake.patches {
+		for _, op := range patch {
+			paths[i] = append(paths[i], op.Path)
+		}
+	}
+	assert.Equal(t, []string{"/embeddings", "/hashes", "/embeddings/title", "/hashes/title", "/meta"}, paths[0], "expected the missing parents to be set")
+	assert.Equal(t, []string{"/embeddings/text", "/hashes", "/embeddings/title", "/hashes/title", "/meta"}, paths[1], "expected the existing parents to be kept")
+
+	for _, id := range []string{"doc-00", "doc-01"} {
+		stored := fake.documents[id]
+		for _, path := range []common.Path{{"embeddings", "text"}, {"embeddings", "title"}} {
+			vector, _ := path.Get(stored)
+			assert.Len(t, vector, 4, "expected vector %s of %s to be stored", path, id)
+		}
+		for _, path := range []common.Path{{"hashes", "text"}, {"hashes", "title"}, {"meta", "origin"}} {
+			_, exists := path.Get(stored)
+			assert.True(t, exists, "expected %s of %s to be stored", path, id)
+		}
+	}
+	assert.Equal(t, 1, fake.documents["doc-01"]["embeddings"].(map[string]any)["other"], "expected the other embeddings to be kept")
+}
+
+func TestPatchSet(t *testing.T) {
+	doc := map[string]any{"a": map[string]any{}, "n": nil}
+	created := map[string]bool{}
+
+	tests := []struct {
+		path     common.Path
+		expected common.PatchOperation
+	}{
+		{path: common.Path{"top"}, expected: common.PatchSet(common.Path{"top"}, 1)},
+		{path: common.Path{"a", "b"}, expected: common.PatchSet(common.Path{"a", "b"}, 1)},
+		{path: common.Path{"n", "b"}, expected: common.PatchSet(common.Path{"n"}, map[string]any{"b": 1})},
+		{path: common.Path{"x", "y", "z"}, expected: common.PatchSet(common.Path{"x"}, map[string]any{"y": map[string]any{"z": 1}})},
+		{path: common.Path{"x", "y", "w"}, expected: common.PatchSet(common.Path{"x", "y", "w"}, 1)},
+		{path: common.Path{"x", "v"}, expected: common.PatchSet(common.Path{"x", "v"}, 1)},
+		{path: common.Path{"a", "c", "d"}, expected: common.PatchSet(common.Path{"a", "c"}, map[string]any{"d": 1})},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, patchSet(doc, created, tt.path, 1), "unexpected operation for %s", tt.path)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"embeddings_generator_function/common"
+)
+
+// FailureMode determines how the handler reacts to documents that could not be processed.
+type FailureMode string
+
+const (
+	// FailFast aborts the invocation on the first failed document, so that the whole batch is retried.
+	FailFast FailureMode = "fail-fast"
+	// BestEffort writes the successfully processed documents and reports the failed ones.
+	BestEffort FailureMode = "best-effort"
+	// FailAboveThreshold behaves like BestEffort unless more than MaxFailurePercent of the documents failed.
+	FailAboveThreshold FailureMode = "threshold"
+)
+
+// FailurePolicy decides whether an invocation fails because of failed documents.
+type FailurePolicy struct {
+	Mode              FailureMode
+	MaxFailurePercent float64
+}
+
+// ParseFailurePolicy parses a failure policy setting. Supported values are
+// "fail-fast", "best-effort" and "threshold:<percent>" (e.g. "threshold:10").
+// An empty value selects best-effort.
+func ParseFailurePolicy(value string) (FailurePolicy, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch {
+	case value == "" || value == string(BestEffort):
+		return FailurePolicy{Mode: BestEffort}, nil
+	case value == string(FailFast):
+		return FailurePolicy{Mode: FailFast}, nil
+	case strings.HasPrefix(value, string(FailAboveThreshold)+":"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(value, string(FailAboveThreshold)+":"), "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return FailurePolicy{}, fmt.Errorf("invalid failure threshold in %q: must be a percentage between 0 and 100", value)
+		}
+		return FailurePolicy{Mode: FailAboveThreshold, MaxFailurePercent: percent}, nil
+	default:
+		return FailurePolicy{}, fmt.Errorf("unknown failure policy %q", value)
+	}
+}
+
+// String returns the policy in the format accepted by ParseFailurePolicy.
+func (p FailurePolicy) String() string {
+	if p.Mode == FailAboveThreshold {
+		return fmt.Sprintf("%s:%g", p.Mode, p.MaxFailurePercent)
+	}
+	return string(p.Mode)
+}
+
+// abortOnFailure reports whether processing should stop at the first failed document.
+func (p FailurePolicy) abortOnFailure() bool {
+	return p.Mode == FailFast
+}
+
+// exceeded reports whether the number of failed documents out of total fails the invocation.
+func (p FailurePolicy) exceeded(failed, total int) bool {
+	if failed == 0 || total == 0 {
+		return false
+	}
+
+	switch p.Mode {
+	case FailFast:
+		return true
+	case FailAboveThreshold:
+		return float64(failed)*100/float64(total) > p.MaxFailurePercent
+	default:
+		return false
+	}
+}
+
+// DocumentFailure describes a document that could not be processed or was skipped.
+// Index is the position of the document in the trigger batch, which identifies documents without an id.
+type DocumentFailure struct {
+	ID     string              `json:"id,omitempty"`
+	Index  int                 `json:"index"`
+	Kind   ValidationErrorKind `json:"kind,omitempty"`
+	Reason string              `json:"reason"`
+}
+
+// InvocationResult summarises the outcome of an invocation. It is returned to the host as the return value.
+type InvocationResult struct {
+	Received int               `json:"received"`
+	Enriched int               `json:"enriched"`
+	Failed   []DocumentFailure `json:"failed,omitempty"`
+	Skipped  []DocumentFailure `json:"skipped,omitempty"`
+	// SelfTriggered counts the documents that were not written because the invocation was triggered by their
+	// enrichment, see LoopGuardOptions.
+	SelfTriggered int `json:"selfTriggered,omitempty"`
+	// Writes are the outcomes of the documents written with the Cosmos DB client, in the output modes other than binding.
+	Writes []DocumentWrite `json:"writes,omitempty"`
+	// RequestCharge is the number of request units charged for the writes.
+	RequestCharge float64 `json:"requestCharge,omitempty"`
+	// Cache counts the lookups of the embedding cache during the invocation, if the cache is enabled.
+	Cache *common.CacheStats `json:"cache,omitempty"`
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected FailurePolicy
+	}{
+		{value: "", expected: FailurePolicy{Mode: BestEffort}},
+		{value: "best-effort", expected: FailurePolicy{Mode: BestEffort}},
+		{value: " Fail-Fast ", expected: FailurePolicy{Mode: FailFast}},
+		{value: "threshold:10", expected: FailurePolicy{Mode: FailAboveThreshold, MaxFailurePercent: 10}},
+		{value: "threshold:12.5%", expected: FailurePolicy{Mode: FailAboveThreshold, MaxFailurePercent: 12.5}},
+		{value: "THRESHOLD:0", expected: FailurePolicy{Mode: FailAboveThreshold}},
+		{value: "threshold:100", expected: FailurePolicy{Mode: FailAboveThreshold, MaxFailurePercent: 100}},
+	}
+
+	for _, tt := range tests {
+		policy, err := ParseFailurePolicy(tt.value)
+		require.NoError(t, err, "failed to parse %q", tt.value)
+		assert.Equal(t, tt.expected, policy, "unexpected policy for %q", tt.value)
+
+		reparsed, err := ParseFailurePolicy(policy.String())
+		require.NoError(t, err, "failed to parse the string %q of %q", policy.String(), tt.value)
+		assert.Equal(t, policy, reparsed, "expected the string of %q to parse to the same policy", tt.value)
+	}
+}
+
+func TestParseFailurePolicyRejectsInvalidValues(t *testing.T) {
+	tests := map[string]string{
+		"retry":           "unknown failure policy",
+		"threshold":       "unknown failure policy",
+		"threshold:":      "invalid failure threshold",
+		"threshold:ten":   "invalid failure threshold",
+		"threshold:-1":    "invalid failure threshold",
+		"threshold:100.1": "invalid failure threshold",
+	}
+
+	for value, message := range tests {
+		_, err := ParseFailurePolicy(value)
+		assert.ErrorContains(t, err, message, "expected %q to be rejected", value)
+	}
+}
+
+func TestFailurePolicyExceeded(t *testing.T) {
+	tests := []struct {
+		policy   string
+		failed   int
+		total    int
+		expected bool
+	}{
+		{policy: "best-effort", failed: 0, total: 10, expected: false},
+		{policy: "best-effort", failed: 10, total: 10, expected: false},
+		{policy: "fail-fast", failed: 0, total: 10, expected: false},
+		{policy: "fail-fast", failed: 1, total: 10, expected: true},
+		{policy: "threshold:10", failed: 1, total: 10, expected: false},
+		{policy: "threshold:10", failed: 2, total: 10, expected: true},
+		{policy: "threshold:10", failed: 1, total: 9, expected: true},
+		{policy: "threshold:0", failed: 0, total: 10, expected: false},
+		{policy: "threshold:0", failed: 1, total: 1000, expected: true},
+		{policy: "threshold:100", failed: 10, total: 10, expected: false},
+		{policy: "threshold:50", failed: 0, total: 0, expected: false},
+	}
+
+	for _, tt := range tests {
+		policy, err := ParseFailurePolicy(tt.policy)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, policy.exceeded(tt.failed, tt.total), "unexpected result of %s for %d of %d failed documents", tt.policy, tt.failed, tt.total)
+	}
+}
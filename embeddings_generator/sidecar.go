@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"embeddings_generator_function/common"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
+)
+
+const (
+	// sidecarSourceID and sidecarSourcePartitionKey are the properties of a sidecar document that refer to its
+	// source document.
+	sidecarSourceID           = "sourceId"
+	sidecarSourcePartitionKey = "sourcePartitionKey"
+
+	// defaultSidecarPartitionKey partitions the sidecar container like the source container, so that the id of
+	// the source document identifies its sidecar document within the partition.
+	defaultSidecarPartitionKey = "/" + sidecarSourcePartitionKey
+)
+
+// target returns the options of the sidecar container: those of Target, with the account and the database of
+// Cosmos unless Target sets its own, and partitioned by sourcePartitionKey by default.
+func (o OutputOptions) target() common.CosmosOptions {
+	target := o.Target
+	if !target.HasAccount() {
+		target.ConnectionString, target.Endpoint, target.Key, target.Emulator = o.Cosmos.ConnectionString, o.Cosmos.Endpoint, o.Cosmos.Key, o.Cosmos.Emulator
+		target.Credential, target.HTTPClient = o.Cosmos.Credential, o.Cosmos.HTTPClient
+	}
+	if target.Database == "" {
+		target.Database = o.Cosmos.Database
+	}
+	if target.PartitionKey == "" {
+		target.PartitionKey = defaultSidecarPartitionKey
+	}
+	return target
+}
+
+// validateSidecar checks the sidecar container, which must not be the source container, and parses the partition
+// key path of the source container and the projected properties, which must not collide with the properties of
+// the vectors.
+func (o *OutputOptions) validateSidecar(specs []VectorSpec) []error {
+	var errs []error
+	target := o.target()
+	if err := target.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("output: target: %w", err))
+	} else if target.SameContainer(o.Cosmos) {
+		errs = append(errs, errors.New("output: target: the sidecar container must not be the source container"))
+	}
+
+	sourcePartitionKey := o.Cosmos.PartitionKey
+	if sourcePartitionKey == "" {
+		sourcePartitionKey = "/id"
+	}
+	path, err := common.ParsePath(sourcePartitionKey)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("output: cosmos: partition key: %w", err))
+	}
+	o.sourcePartitionKey = path
+
+	written := []common.Path{{sidecarSourceID}, {sidecarSourcePartitionKey}}
+	for _, s := range specs {
+		written = append(written, s.targetPath, s.hashPath)
+		if s.MetadataProperty != "" {
+			written = append(written, s.metadataPath)
+		}
+	}
+
+	o.projection = nil
+	for _, property := range o.Projection {
+		path, err := common.ParsePath(property)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("output: projection: %w", err))
+			continue
+		}
+		if reserved(path) {
+			errs = append(errs, fmt.Errorf("output: projection: %s is a reserved property", property))
+			continue
+		}
+		for _, w := range written {
+			if overlaps(path, w) {
+				errs = append(errs, fmt.Errorf("output: projection: %s collides with property %s of the sidecar documents", property, w))
+			}
+		}
+		o.projection = append(o.projection, path)
+	}
+	return errs
+}
+
+// sidecarBase returns the sidecar document of the source document without its vectors: the existing sidecar
+// document, if any, with the references to the source document and its projected properties.
+func (t *documentTask) sidecarBase() map[string]any {
+	doc := map[string]any{}
+	if t.sidecar != nil {
+		doc = cleanse(common.CloneDocument(t.sidecar), keysToRemove)
+		delete(doc, "_etag")
+	}
+
+	partitionKey, _ := sourcePartitionKey.Get(t.doc)
+	doc["id"], doc[sidecarSourceID], doc[sidecarSourcePartitionKey] = t.id, t.id, partitionKey
+	for _, path := range projection {
+		if value, exists := path.Get(t.doc); exists {
+			// The paths were checked, so that the value can be set
+			_ = path.Set(doc, value)
+		} else {
+			path.Delete(doc)
+		}
+	}
+	return doc
+}
+
+// readSidecar reads the sidecar document of the source document into t.sidecar, and returns the document whose
+// hashes decide which vectors are embedded: the sidecar document, or an empty document if there is none yet.
+func (t *documentTask) readSidecar(ctx context.Context) (map[string]any, error) {
+	partitionKey, err := items.PartitionKey(t.sidecarBase())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sidecar document: %w", err)
+	}
+	item, err := items.ReadItem(ctx, t.id, partitionKey)
+	if common.IsNotFound(err) {
+		customhandler.LoggerFromContext(ctx).Infof("Document %s has no sidecar document yet", t.id)
+		return map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sidecar document: %w", err)
+	}
+	t.sidecar = item.Document
+	return t.sidecar, nil
+}
+
+// projectionChanged reports whether the projected properties of the source document differ from those of its
+// sidecar document.
+func (t *documentTask) projectionChanged() bool {
+	if t.sidecar == nil {
+		return len(projection) > 0
+	}
+	for _, path := range projection {
+		value, exists := path.Get(t.doc)
+		stored, stores := path.Get(t.sidecar)
+		if exists != stores || !reflect.DeepEqual(value, stored) {
+			return true
+		}
+	}
+	return false
+}
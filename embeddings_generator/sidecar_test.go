@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupSidecar configures the handler to write sidecar documents, with the title of the source documents
+// projected, to a fake sidecar container that holds the given sidecar documents.
+func setupSidecar(t *testing.T, sidecars ...map[string]any) *fakeItems {
+	t.Helper()
+
+	setup(t, map[string]string{
+		"OUTPUT_MODE":                  string(OutputSidecar),
+		"OUTPUT_PROJECTION":            "title",
+		"COSMOS_ENDPOINT":              "https://example.documents.azure.com",
+		"COSMOS_KEY":                   "a2V5",
+		"COSMOS_DATABASE_NAME":         "db",
+		"COSMOS_CONTAINER_NAME":        "items",
+		"COSMOS_TARGET_CONTAINER_NAME": "vectors",
+	})
+
+	fake := newFakeItems(sidecars...)
+	items = fake
+	t.Cleanup(func() { items = nil })
+	return fake
+}
+
+// titledDocuments returns test documents with a title.
+func titledDocuments(n int, title string) []map[string]any {
+	documents := testDocuments(n)
+	for _, doc := range documents {
+		doc["title"] = title
+	}
+	return documents
+}
+
+func TestProcessDocumentsWritesSidecarDocuments(t *testing.T) {
+	fake := setupSidecar(t)
+	assert.False(t, loopGuard.Enabled(), "expected the loop guard to be disabled for sidecar documents")
+
+	documents := titledDocuments(2, "first")
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	assert.Empty(t, output, "expected no documents for the output binding")
+	assert.Equal(t, 2, result.Enriched, "expected a sidecar document per document")
+	require.Len(t, result.Writes, 2, "expected the writes to be recorded")
+	assert.Equal(t, http.StatusCreated, result.Writes[0].StatusCode, "expected the sidecar document to be created")
+
+	sidecar := fake.documents["doc-00"]
+	require.NotNil(t, sidecar, "expected the sidecar document to be keyed by the id of the source document")
+	assert.Equal(t, "doc-00", sidecar[sidecarSourceID], "expected a reference to the source document")
+	assert.Equal(t, "doc-00", sidecar[sidecarSourcePartitionKey], "expected the partition key of the source document")
+	assert.Equal(t, "first", sidecar["title"], "expected the title to be projected")
+	assert.Len(t, sidecar["vector"], 4, "expected the vector to be stored")
+	assert.Equal(t, newFingerprint(settingsHash, "text of document 0").String(), sidecar["hash"], "expected the hash to be stored")
+	assert.NotContains(t, sidecar, "text", "expected the other properties not to be copied")
+	assert.NotContains(t, sidecar, defaultLoopGuardProperty, "expected no origin marker")
+	assert.NotContains(t, documents[0], "vector", "expected the source document to be untouched")
+}
+
+func TestProcessDocumentsUpdatesSidecarProjections(t *testing.T) {
+	fake := setupSidecar(t)
+	_, result := processDocuments(context.Background(), titledDocuments(1, "first"), failurePolicy)
+	require.Equal(t, 1, result.Enriched, "expected the sidecar document to be written")
+	vector := fake.documents["doc-00"]["vector"]
+
+	_, result = processDocuments(context.Background(), titledDocuments(1, "first"), failurePolicy)
+	assert.Zero(t, result.Enriched, "expected an unchanged document not to be written")
+	assert.Empty(t, result.Writes, "expected no writes")
+
+	_, result = processDocuments(context.Background(), titledDocuments(1, "second"), failurePolicy)
+	assert.Equal(t, 1, result.Enriched, "expected the changed projection to be written")
+	require.Len(t, result.Writes, 1, "expected the write to be recorded")
+	assert.Equal(t, http.StatusOK, result.Writes[0].StatusCode, "expected the sidecar document to be replaced")
+	assert.Equal(t, "second", fake.documents["doc-00"]["title"], "expected the new title")
+	assert.Equal(t, vector, fake.documents["doc-00"]["vector"], "expected the vector to be kept")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationErrorKind identifies why a document could not be validated.
+type ValidationErrorKind string
+
+const (
+	// MissingID means that the document has no id property.
+	MissingID ValidationErrorKind = "missing-id"
+	// InvalidID means that the id property of the document is not a non-empty string.
+	InvalidID ValidationErrorKind = "invalid-id"
+	// MissingProperty means that a property the embedded text is read from is missing.
+	MissingProperty ValidationErrorKind = "missing-property"
+	// InvalidPropertyType means that a property the embedded text is read from is not a string.
+	InvalidPropertyType ValidationErrorKind = "invalid-property-type"
+	// TemplateFailed means that the template of a vector could not be rendered for the document.
+	TemplateFailed ValidationErrorKind = "template-failed"
+	// TooManyTokens means that the embedded text exceeds the token limit and the token limit policy is reject.
+	TooManyTokens ValidationErrorKind = "too-many-tokens"
+	// WriteLoop means that the document was enriched too many times in a row, see LoopGuardOptions.
+	WriteLoop ValidationErrorKind = "write-loop"
+)
+
+var validationErrorKinds = []ValidationErrorKind{MissingID, InvalidID, MissingProperty, InvalidPropertyType, TemplateFailed, TooManyTokens, WriteLoop}
+
+// ValidationError is returned for documents that cannot be processed because of their content.
+type ValidationError struct {
+	Kind     ValidationErrorKind
+	Property string
+	Err      error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Kind, e.Property, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Property)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationAction determines what happens to a document that fails validation.
+type ValidationAction string
+
+const (
+	// SkipDocument leaves the document unchanged and reports it as skipped.
+	SkipDocument ValidationAction = "skip"
+	// FailDocument reports the document as failed, which is subject to the failure policy.
+	FailDocument ValidationAction = "fail"
+)
+
+// ValidationPolicy maps each kind of validation error to the action taken for the document.
+type ValidationPolicy map[ValidationErrorKind]ValidationAction
+
+// ParseValidationPolicy parses a comma separated list of kind=action pairs, e.g.
+// "missing-id=fail,missing-property=skip". The kind "*" sets the action of all kinds.
+// Kinds that are not listed are skipped.
+func ParseValidationPolicy(value string) (ValidationPolicy, error) {
+	policy := ValidationPolicy{}
+	for _, kind := range validationErrorKinds {
+		policy[kind] = SkipDocument
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kind, action, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid validation policy entry %q: expected kind=action", pair)
+		}
+
+		a := ValidationAction(strings.ToLower(strings.TrimSpace(action)))
+		if a != SkipDocument && a != FailDocument {
+			return nil, fmt.Errorf("invalid validation action %q: expected %s or %s", action, SkipDocument, FailDocument)
+		}
+
+		k := ValidationErrorKind(strings.ToLower(strings.TrimSpace(kind)))
+		if k == "*" {
+			for _, kind := range validationErrorKinds {
+				policy[kind] = a
+			}
+			continue
+		}
+		if _, known := policy[k]; !known {
+			return nil, fmt.Errorf("unknown validation error kind %q", kind)
+		}
+		policy[k] = a
+	}
+
+	return policy, nil
+}
+
+// action returns the action for a validation error kind.
+func (p ValidationPolicy) action(kind ValidationErrorKind) ValidationAction {
+	if action, ok := p[kind]; ok {
+		return action
+	}
+	return SkipDocument
+}
+
+// validateDocument checks that a document has a string id and the properties needed by the vector
+// specifications, and returns the id and the text of each vector.
+func validateDocument(doc map[string]any, specs []VectorSpec) (string, []string, error) {
+	value, exists := doc["id"]
+	if !exists {
+		return "", nil, &ValidationError{Kind: MissingID, Property: "id"}
+	}
+
+	id, ok := value.(string)
+	if !ok || id == "" {
+		return "", nil, &ValidationError{Kind: InvalidID, Property: "id", Err: fmt.Errorf("expected a non-empty string, got %T", value)}
+	}
+
+	texts := make([]string, len(specs))
+	for i := range specs {
+		text, err := specs[i].Text(doc)
+		if err != nil {
+			return id, nil, err
+		}
+		texts[i] = text
+	}
+
+	return id, texts, nil
+}
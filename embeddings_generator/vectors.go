@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"embeddings_generator_function/common"
+)
+
+// VectorSpec describes a vector that is generated for each document.
+// The embedded text is either the value of the Source property or the output of the Go text Template,
+// which is executed with the document as data, e.g. "{{.title}}\n{{.description}}\n{{join .tags \", \"}}".
+// A template fails for documents that lack a property it refers to; use {{with index . "name"}}...{{end}}
+// for optional properties. Templates do not see the system properties and the properties the function writes,
+// which change with every write. Target, Source, HashProperty and MetadataProperty are property paths as accepted
+// by common.ParsePath, e.g. "/review/body" or "embeddings.review".
+type VectorSpec struct {
+	// Target is the property the vector is written to.
+	Target string `json:"target"`
+	// Source is the property that contains the text to embed.
+	Source string `json:"source,omitempty"`
+	// Template renders the text to embed from the document.
+	Template string `json:"template,omitempty"`
+	// HashProperty is the property the hash of the embedded text is written to.
+	HashProperty string `json:"hashProperty"`
+	// MetadataProperty is the optional property that an object describing the embedding is written to,
+	// e.g. {"model": "text-embedding-3-small", "dimensions": 1536, "tokenCount": 812, ...}.
+	MetadataProperty string `json:"metadataProperty,omitempty"`
+
+	targetPath   common.Path
+	sourcePath   common.Path
+	hashPath     common.Path
+	metadataPath common.Path
+	tmpl         *template.Template
+	// hidden are the properties written by the function, which are removed from the document a template sees.
+	hidden []common.Path
+}
+
+// templateFuncs are the functions available to vector templates in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"join": func(values any, sep string) (string, error) {
+		items, ok := values.([]any)
+		if !ok {
+			return "", fmt.Errorf("join expects an array, got %T", values)
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(parts, sep), nil
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// init validates the specification and parses its property paths and template.
+func (s *VectorSpec) init() error {
+	if s.Target == "" {
+		return errors.New("vector specification without target property")
+	}
+	if s.HashProperty == "" {
+		return fmt.Errorf("vector %s: hashProperty is required", s.Target)
+	}
+	if (s.Source == "") == (s.Template == "") {
+		return fmt.Errorf("vector %s: exactly one of source and template is required", s.Target)
+	}
+
+	var err error
+	if s.targetPath, err = common.ParsePath(s.Target); err != nil {
+		return fmt.Errorf("vector %s: invalid target: %w", s.Target, err)
+	}
+	if s.hashPath, err = common.ParsePath(s.HashProperty); err != nil {
+		return fmt.Errorf("vector %s: invalid hashProperty: %w", s.Target, err)
+	}
+	if s.MetadataProperty != "" {
+		if s.metadataPath, err = common.ParsePath(s.MetadataProperty); err != nil {
+			return fmt.Errorf("vector %s: invalid metadataProperty: %w", s.Target, err)
+		}
+	}
+	if s.Source != "" {
+		if s.sourcePath, err = common.ParsePath(s.Source); err != nil {
+			return fmt.Errorf("vector %s: invalid source: %w", s.Target, err)
+		}
+	}
+
+	if s.Template != "" {
+		tmpl, err := template.New(s.Target).Funcs(templateFuncs).Option("missingkey=error").Parse(s.Template)
+		if err != nil {
+			return fmt.Errorf("vector %s: failed to parse template: %w", s.Target, err)
+		}
+		s.tmpl = tmpl
+	}
+
+	return nil
+}
+
+// Text returns the text of the document that is embedded into the vector.
+// It returns a *ValidationError if the document lacks the properties needed for the text.
+func (s *VectorSpec) Text(doc map[string]any) (string, error) {
+	if s.tmpl == nil {
+		value, exists := s.sourcePath.Get(doc)
+		if !exists {
+			return "", &ValidationError{Kind: MissingProperty, Property: s.Source}
+		}
+		text, ok := value.(string)
+		if !ok {
+			return "", &ValidationError{Kind: InvalidPropertyType, Property: s.Source, Err: fmt.Errorf("expected a string, got %T", value)}
+		}
+		return text, nil
+	}
+
+	var builder strings.Builder
+	if err := s.tmpl.Execute(&builder, s.templateData(doc)); err != nil {
+		return "", &ValidationError{Kind: TemplateFailed, Property: s.Target, Err: err}
+	}
+	return builder.String(), nil
+}
+
+// templateData returns the document as templates see it: without its system properties and the hidden
+// properties. Otherwise a template that refers to them, e.g. with {{.}}, would render a different text after
+// every write, and the document would be embedded again on every change.
+func (s *VectorSpec) templateData(doc map[string]any) map[string]any {
+	data := common.CloneDocument(doc)
+	for key := range data {
+		if strings.HasPrefix(key, "_") {
+			delete(data, key)
+		}
+	}
+	for _, path := range s.hidden {
+		path.Delete(data)
+		// Remove the objects that only held written properties, which did not exist before the first write
+		for i := len(path) - 1; i > 0; i-- {
+			if parent, _ := path[:i].Get(data); !isEmptyObject(parent) {
+				break
+			}
+			path[:i].Delete(data)
+		}
+	}
+	return data
+}
+
+// isEmptyObject reports whether value is an object without properties.
+func isEmptyObject(value any) bool {
+	object, ok := value.(map[string]any)
+	return ok && len(object) == 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"embeddings_generator_function/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVectorSpecInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    VectorSpec
+		wantErr string
+	}{
+		{name: "without target", spec: VectorSpec{Source: "text", HashProperty: "hash"}, wantErr: "without target property"},
+		{name: "without hash", spec: VectorSpec{Target: "vector", Source: "text"}, wantErr: "hashProperty is required"},
+		{name: "without source or template", spec: VectorSpec{Target: "vector", HashProperty: "hash"}, wantErr: "exactly one of source and template"},
+		{name: "with source and template", spec: VectorSpec{Target: "vector", Source: "text", Template: "{{.text}}", HashProperty: "hash"}, wantErr: "exactly one of source and template"},
+		{name: "invalid target", spec: VectorSpec{Target: "vector[", Source: "text", HashProperty: "hash"}, wantErr: "invalid target"},
+		{name: "invalid source", spec: VectorSpec{Target: "vector", Source: "a..b", HashProperty: "hash"}, wantErr: "invalid source"},
+		{name: "invalid template", spec: VectorSpec{Target: "vector", Template: "{{.text", HashProperty: "hash"}, wantErr: "failed to parse template"},
+		{name: "unknown template function", spec: VectorSpec{Target: "vector", Template: "{{shout .text}}", HashProperty: "hash"}, wantErr: "failed to parse template"},
+	}
+
+	for _, tt := range tests {
+		assert.ErrorContains(t, tt.spec.init(), tt.wantErr, "expected %s to be rejected", tt.name)
+	}
+}
+
+func TestVectorSpecText(t *testing.T) {
+	doc := map[string]any{
+		"title":   "Title",
+		"tags":    []any{"a", "b"},
+		"count":   3,
+		"review":  map[string]any{"body": "Body"},
+		"summary": "  Summary  ",
+	}
+
+	tests := []struct {
+		name     string
+		spec     VectorSpec
+		expected string
+		kind     ValidationErrorKind
+	}{
+		{name: "source", spec: VectorSpec{Source: "review.body"}, expected: "Body"},
+		{name: "missing source", spec: VectorSpec{Source: "description"}, kind: MissingProperty},
+		{name: "source that is not a string", spec: VectorSpec{Source: "count"}, kind: InvalidPropertyType},
+		{name: "template", spec: VectorSpec{Template: "{{.title}}\n{{join .tags \", \"}}\n{{.review.body}}"}, expected: "Title\na, b\nBody"},
+		{name: "template functions", spec: VectorSpec{Template: "{{lower .title}} {{upper .title}} {{trim .summary}}"}, expected: "title TITLE Summary"},
+		{name: "template with a missing property", spec: VectorSpec{Template: "{{.title}} {{.description}}"}, kind: TemplateFailed},
+		{name: "template with a missing nested property", spec: VectorSpec{Template: "{{.review.title}}"}, kind: TemplateFailed},
+		{name: "template with an optional property", spec: VectorSpec{Template: "{{.title}}{{with index . \"description\"}} {{.}}{{end}}"}, expected: "Title"},
+		{name: "join of a string", spec: VectorSpec{Template: "{{join .title \", \"}}"}, kind: TemplateFailed},
+	}
+
+	for _, tt := range tests {
+		spec := tt.spec
+		spec.Target, spec.HashProperty = "vector", "hash"
+		require.NoError(t, spec.init(), "invalid specification for %s", tt.name)
+
+		text, err := spec.Text(doc)
+		if tt.kind == "" {
+			require.NoError(t, err, "failed to get the text for %s", tt.name)
+			assert.Equal(t, tt.expected, text, "unexpected text for %s", tt.name)
+			continue
+		}
+		var validationErr *ValidationError
+		require.ErrorAs(t, err, &validationErr, "expected a validation error for %s", tt.name)
+		assert.Equal(t, tt.kind, validationErr.Kind, "unexpected kind of validation error for %s", tt.name)
+	}
+}
+
+func TestVectorSpecTemplateDoesNotSeeWrittenProperties(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Vectors = []VectorSpec{
+		{Target: "embeddings.all", Template: "{{range $key, $value := .}}{{$key}} {{end}}", HashProperty: "hashes.all", MetadataProperty: "meta"},
+		{Target: "vector", Source: "title", HashProperty: "hash"},
+	}
+	cfg.Embedder.Provider = common.ProviderFake
+	require.NoError(t, cfg.Validate())
+
+	doc := map[string]any{"id": "doc-1", "title": "Title", "_etag": `"1"`, "_ts": 1}
+	before, err := cfg.vectors[0].Text(doc)
+	require.NoError(t, err)
+	assert.Equal(t, "id title ", before, "expected the system properties to be hidden")
+
+	// The document as written by the function
+	doc["embeddings"] = map[string]any{"all": []any{1.0}}
+	doc["hashes"] = map[string]any{"all": "h"}
+	doc["meta"], doc["vector"], doc["hash"] = map[string]any{}, []any{1.0}, "h"
+	doc[cfg.LoopGuard.Property] = map[string]any{"origin": originName}
+	doc["_etag"] = `"2"`
+	after, err := cfg.vectors[0].Text(doc)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "expected the written properties not to change the text")
+	assert.Contains(t, doc, "embeddings", "expected the document to be left unchanged")
+
+	doc["embeddings"].(map[string]any)["other"] = "Other"
+	after, err = cfg.vectors[0].Text(doc)
+	require.NoError(t, err)
+	assert.Equal(t, "embeddings id title ", after, "expected the other properties of a parent of a written property to be visible")
+}
+
+func TestConfigValidateRejectsDuplicateTargets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Vectors = []VectorSpec{
+		{Target: "embeddings.title", Source: "title", HashProperty: "hashes.title"},
+		{Target: "/embeddings/title", Source: "body", HashProperty: "hashes.body"},
+		{Target: "embeddings", Source: "summary", HashProperty: "hashes.summary"},
+	}
+
+	err := cfg.validateVectors()
+	require.Len(t, err, 3, "expected every collision to be reported")
+	assert.ErrorContains(t, err[0], "target /embeddings/title collides with target embeddings.title", "expected the duplicate target to be rejected")
+	assert.ErrorContains(t, err[1], "target embeddings collides with target embeddings.title", "expected the enclosing target to be rejected")
+	assert.Nil(t, cfg.vectors, "expected no vectors to be resolved")
+}
+
+func TestProcessDocumentsSeveralVectors(t *testing.T) {
+	setup(t, map[string]string{
+		"COSMOS_VECTOR_PROPERTY":   "",
+		"COSMOS_PROPERTY_TO_EMBED": "",
+		"COSMOS_HASH_PROPERTY":     "",
+		"EMBEDDING_VECTORS": `[
+			{"target": "embeddings.text", "source": "text", "hashProperty": "hashes.text"},
+			{"target": "embeddings.title", "template": "{{.title}}: {{.text}}", "hashProperty": "hashes.title"}
+		]`,
+	})
+
+	documents := testDocuments(2)
+	documents[0]["title"] = "First"
+
+	output, result := processDocuments(context.Background(), documents, failurePolicy)
+
+	require.Len(t, output, 1, "expected the document with a title to be enriched")
+	assert.Equal(t, "doc-00", output[0]["id"], "unexpected document")
+	embeddings, ok := output[0]["embeddings"].(map[string]any)
+	require.True(t, ok, "expected the vectors to be nested")
+	assert.Len(t, embeddings["text"], 4, "expected the vector of the text")
+	assert.Len(t, embeddings["title"], 4, "expected the vector of the template")
+	assert.NotEqual(t, embeddings["text"], embeddings["title"], "expected different vectors for different texts")
+	hashes, ok := output[0]["hashes"].(map[string]any)
+	require.True(t, ok, "expected the hashes to be nested")
+	assert.NotEqual(t, hashes["text"], hashes["title"], "expected a hash per vector")
+
+	require.Len(t, result.Skipped, 1, "expected the document without title to be skipped")
+	assert.Equal(t, "doc-01", result.Skipped[0].ID, "unexpected skipped document")
+	assert.Equal(t, TemplateFailed, result.Skipped[0].Kind, "expected the template to fail")
+}
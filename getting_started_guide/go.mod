@@ -2,10 +2,6 @@ module cosmosdb_go_function_trigger
 
 go 1.23.6
 
-require github.com/stretchr/testify v1.10.0
+require github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler v0.3.0
 
-require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-)
+replace github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler => ../customhandler
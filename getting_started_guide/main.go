@@ -8,6 +8,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+
+	"github.com/abhirockzz/golang_cosmosdb_azure_functions/customhandler"
 )
 
 const defaultPort = "8080"
@@ -37,7 +39,7 @@ func processAndLog(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var triggerPayload common.CosmosDBTriggerPayload
+	var triggerPayload customhandler.CosmosDBTriggerPayload
 	if err := json.Unmarshal(payloadBytes, &triggerPayload); err != nil {
 		http.Error(w, "Failed to parse JSON payload: "+err.Error(), http.StatusBadRequest)
 		return
@@ -45,8 +47,8 @@ func processAndLog(w http.ResponseWriter, req *http.Request) {
 
 	logs = append(logs, fmt.Sprintf("Raw event payload: %s", triggerPayload))
 
-	// Use ParseDocuments (a specialized version of Parse) to get strongly typed documents
-	documents, err := common.Parse[common.CosmosDBDocument](payloadBytes)
+	// Use ParseDocuments (a variant of Parse for an already unmarshaled payload) to get strongly typed documents
+	documents, err := customhandler.ParseDocuments[common.CosmosDBDocument](triggerPayload.Data.Documents)
 	if err != nil {
 		log.Printf("Failed to parse payload: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to parse payload: %v", err), http.StatusBadRequest)
@@ -59,7 +61,7 @@ func processAndLog(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Construct the response with logs
-	invokeResponse := common.InvokeResponse{Outputs: nil, Logs: logs, ReturnValue: nil}
+	invokeResponse := customhandler.InvokeResponse{Outputs: nil, Logs: logs, ReturnValue: nil}
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	// Set the response headers and write the response